@@ -0,0 +1,184 @@
+package redissession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultAsyncWorkers = 4
+	defaultAsyncQueue   = 1024
+)
+
+type asyncSave struct {
+	session  *Session
+	name     string
+	id       string
+	key      string
+	ttl      time.Duration
+	snapshot json.RawMessage
+	labels   []string
+	removed  []string
+}
+
+// WithAsyncSaves configures the worker pool used by SaveAsync: workers
+// goroutines draining a queue of queueSize pending writes. onError, if set,
+// receives failed background writes. Without this call SaveAsync starts a
+// small default pool on first use.
+func (s *RedisStore) WithAsyncSaves(workers, queueSize int, onError func(session *Session, err error)) *RedisStore {
+	s.asyncWorkers = workers
+	s.asyncQueueSize = queueSize
+	s.asyncError = onError
+	return s
+}
+
+// SaveAsync validates and serializes session synchronously, sets the cookie,
+// and hands encryption and the Redis write to a background worker. This
+// takes sealing off the request path at the cost of durability: a crash, or
+// a failed write (see WithAsyncSaves), loses the update even though the
+// client already has its cookie. A write still queued when the session is
+// rotated or destroyed is dropped. Call Flush or Close before shutting down.
+// After Close, SaveAsync returns ErrStoreClosed.
+func (s *RedisStore) SaveAsync(r *http.Request, w http.ResponseWriter, session *Session) error {
+	if headersWritten(w) {
+		return ErrHeadersAlreadySent
+	}
+	if err := validateCookieName(session.Name()); err != nil {
+		return err
+	}
+	s.bind(r, session)
+	key, ttl, err := s.prepareSave(session)
+	if err != nil {
+		if errors.Is(err, ErrSkipSave) {
+			return nil
+		}
+		return err
+	}
+	send := s.cookieDue(session)
+	if unchangedEmpty(session) {
+		return s.setCookies(w, session, send)
+	}
+	count := session.SaveCount()
+	session.setSaveCount(count + 1)
+	var prev cookieState
+	if send {
+		prev = session.markCookieSent()
+	}
+	snapshot, err := s.crypto.marshal(session)
+	if err == nil {
+		labels, removed := session.labelChanges()
+		job := asyncSave{
+			session:  session,
+			name:     session.Name(),
+			id:       session.ID(),
+			key:      key,
+			ttl:      ttl,
+			snapshot: snapshot,
+			labels:   labels,
+			removed:  removed,
+		}
+		err = s.enqueue(r.Context(), job)
+	}
+	if err != nil {
+		session.setSaveCount(count)
+		if send {
+			session.restoreCookie(prev)
+		}
+		return err
+	}
+	session.clearRemovedLabels()
+	session.markClean()
+
+	return s.setCookies(w, session, send)
+}
+
+// Flush waits until no write queued by SaveAsync is pending, or ctx is done.
+// Under continued SaveAsync traffic that includes writes queued while it
+// waits.
+func (s *RedisStore) Flush(ctx context.Context) error {
+	s.asyncMu.Lock()
+	if s.asyncPending == 0 {
+		s.asyncMu.Unlock()
+		return nil
+	}
+	idle := s.asyncIdle
+	s.asyncMu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// asyncAdd counts a queued write, arming a fresh idle channel for Flush when
+// none was pending.
+func (s *RedisStore) asyncAdd() {
+	s.asyncMu.Lock()
+	defer s.asyncMu.Unlock()
+	if s.asyncPending == 0 {
+		s.asyncIdle = make(chan struct{})
+	}
+	s.asyncPending++
+}
+
+// asyncDone counts a finished write, releasing Flush once none is pending.
+func (s *RedisStore) asyncDone() {
+	s.asyncMu.Lock()
+	defer s.asyncMu.Unlock()
+	s.asyncPending--
+	if s.asyncPending == 0 {
+		close(s.asyncIdle)
+	}
+}
+
+// enqueue hands job to the worker pool. The read lock keeps Close from
+// closing the queue while a send is in flight.
+func (s *RedisStore) enqueue(ctx context.Context, job asyncSave) error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+	if s.closed {
+		return ErrStoreClosed
+	}
+	s.asyncOnce.Do(s.startAsyncWorkers)
+	s.asyncAdd()
+	select {
+	case s.asyncQueue <- job:
+		return nil
+	case <-ctx.Done():
+		s.asyncDone()
+		return ctx.Err()
+	}
+}
+
+func (s *RedisStore) startAsyncWorkers() {
+	workers := s.asyncWorkers
+	if workers <= 0 {
+		workers = defaultAsyncWorkers
+	}
+	size := s.asyncQueueSize
+	if size <= 0 {
+		size = defaultAsyncQueue
+	}
+	s.asyncQueue = make(chan asyncSave, size)
+	for i := 0; i < workers; i++ {
+		go s.asyncWorker()
+	}
+}
+
+func (s *RedisStore) asyncWorker() {
+	for job := range s.asyncQueue {
+		// A session rotated or destroyed since the job was queued must not
+		// have its old key written back.
+		if job.session.ID() == job.id && !job.session.isDestroyed() {
+			err := s.write(context.Background(), job.session, job.name, job.id, job.key, job.ttl, job.snapshot, job.labels, job.removed)
+			if err != nil && s.asyncError != nil {
+				s.asyncError(job.session, err)
+			}
+		}
+		s.asyncDone()
+	}
+}
@@ -0,0 +1,51 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+)
+
+// LoadMany loads the sessions called name with the given ids, in order,
+// skipping ids that are unknown, expired, revoked or cannot be decrypted.
+// Sessions are read as by Peek, so loading them neither slides a Rolling TTL
+// nor runs the OnLoad hook.
+func (s *RedisStore) LoadMany(ctx context.Context, name string, ids []string) ([]*Session, error) {
+	return s.loadMany(ctx, name, ids, nil)
+}
+
+// LoadManyWithErrors is LoadMany, but also returns why each skipped id
+// failed, keyed by id. Ids that are not valid session ids are reported as
+// ErrSessionNotFound; well-formed ids that simply do not exist are not
+// reported.
+func (s *RedisStore) LoadManyWithErrors(ctx context.Context, name string, ids []string) ([]*Session, map[string]error, error) {
+	failed := make(map[string]error)
+	sessions, err := s.loadMany(ctx, name, ids, failed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sessions, failed, nil
+}
+
+func (s *RedisStore) loadMany(ctx context.Context, name string, ids []string, failed map[string]error) ([]*Session, error) {
+	sessions := make([]*Session, 0, len(ids))
+	for _, id := range ids {
+		if !s.crypto.ValidSessionID(id) {
+			if failed != nil {
+				failed[id] = ErrSessionNotFound
+			}
+			continue
+		}
+		session, err := s.Peek(ctx, name, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if failed != nil && !errors.Is(err, ErrSessionNotFound) {
+				failed[id] = err
+			}
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
@@ -0,0 +1,42 @@
+package redissession
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// WithBearerTokens makes New take the session id from an
+// "Authorization: Bearer" token when the request carries one, e.g. a JWT
+// issued by an API gateway with the session id as a claim. verify checks the
+// token and returns that id; plug in whatever JWT library the gateway's
+// tokens need, the package bundles none. Requests with a bearer token ignore
+// the session cookie. A token verify rejects gets a fresh session, and
+// NewWithResult reports verify's error. Save still sets a cookie unless
+// WithCookieBehavior says otherwise. A nil verify turns this off.
+func (s *RedisStore) WithBearerTokens(verify func(token string) (sessionID string, err error)) *RedisStore {
+	s.bearer = verify
+	return s
+}
+
+// bearerToken returns r's bearer token if WithBearerTokens is enabled.
+func (s *RedisStore) bearerToken(r *http.Request) (string, bool) {
+	if s.bearer == nil {
+		return "", false
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// openBearer is open for the session id carried by token.
+func (s *RedisStore) openBearer(ctx context.Context, name, token string) (openResult, error) {
+	sessionID, verifyErr := s.bearer(token)
+	if verifyErr != nil {
+		return s.fresh(ctx, name, verifyErr)
+	}
+	return s.open(ctx, name, sessionID)
+}
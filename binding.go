@@ -0,0 +1,77 @@
+package redissession
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// BindingFunc extracts the factor a session is bound to from a request,
+// e.g. a client certificate fingerprint. ok is false when the request
+// carries no such factor.
+type BindingFunc func(r *http.Request) (factor string, ok bool)
+
+// TLSClientCertBinding binds sessions to the SHA-256 fingerprint of the
+// client certificate presented over mutual TLS. Requests without one
+// report no factor.
+func TLSClientCertBinding(r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:]), true
+}
+
+// WithBinding ties sessions to the factor fn extracts from the request, so
+// a stolen cookie is useless without it. Save records a hash of the factor
+// in sessions not yet bound, and New verifies it on load: a bound session
+// requested with a different factor, or none, is rejected with
+// ErrSessionBindingMismatch (reported by NewWithResult) and replaced by a
+// fresh one. Sessions saved from requests without the factor stay unbound,
+// so the option is harmless where mTLS is not in use. A nil fn disables
+// binding.
+func (s *RedisStore) WithBinding(fn BindingFunc) *RedisStore {
+	s.binding = fn
+	return s
+}
+
+// bind records the request's binding factor in session if it has none.
+func (s *RedisStore) bind(r *http.Request, session *Session) {
+	if s.binding == nil {
+		return
+	}
+	factor, ok := s.binding(r)
+	if !ok {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.binding == "" {
+		session.binding = bindingHash(factor)
+		session.dirty = true
+	}
+}
+
+// checkBinding verifies a loaded session against the request's factor.
+func (s *RedisStore) checkBinding(r *http.Request, session *Session) error {
+	if s.binding == nil {
+		return nil
+	}
+	session.mu.RLock()
+	bound := session.binding
+	session.mu.RUnlock()
+	if bound == "" {
+		return nil
+	}
+	factor, ok := s.binding(r)
+	if !ok || subtle.ConstantTimeCompare([]byte(bindingHash(factor)), []byte(bound)) != 1 {
+		return ErrSessionBindingMismatch
+	}
+	return nil
+}
+
+func bindingHash(factor string) string {
+	sum := sha256.Sum256([]byte(factor))
+	return hex.EncodeToString(sum[:])
+}
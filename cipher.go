@@ -8,23 +8,118 @@ import (
 	"crypto/sha256"
 	"crypto/subtle"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"slices"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
 type Crypto struct {
+	aead          cipher.AEAD
+	signingKey    []byte
+	hash          func() hash.Hash
+	sigSize       int
+	legacy        []cryptoKey
+	fallbackAADs  [][]byte
+	codec         Codec
+	unixTimes     bool
+	allowUnsigned bool
+	idEncoding    IDEncoding
+	compress      bool
+	minSavings    float64
+	transformer   ValueTransformer
+}
+
+// cryptoKey is an AEAD and optional signing key pair, with the hash the
+// signature HMAC uses and that hash's output size.
+type cryptoKey struct {
 	aead       cipher.AEAD
 	signingKey []byte
+	hash       func() hash.Hash
+	sigSize    int
 }
 
 func NewCrypto(aead cipher.AEAD, signingKey []byte) *Crypto {
 	return &Crypto{
 		aead:       aead,
 		signingKey: signingKey,
+		hash:       sha256.New,
+		sigSize:    sha256.Size,
+		codec:      JSONCodec{},
+	}
+}
+
+// WithSigningHash sets the hash behind the HMAC signature, e.g.
+// sha512.New512_256 where policy requires it; nil restores the default
+// sha256.New. The signature takes the hash's Size() bytes of each payload.
+// Payloads signed with a different hash no longer verify, so change it
+// together with the key, through WithNewPrimary.
+func (c *Crypto) WithSigningHash(fn func() hash.Hash) *Crypto {
+	if fn == nil {
+		fn = sha256.New
 	}
+	c.hash = fn
+	c.sigSize = fn().Size()
+	return c
+}
+
+func (c *Crypto) primary() cryptoKey {
+	return cryptoKey{c.aead, c.signingKey, c.hash, c.sigSize}
+}
+
+// WithFallbackAADs makes DecryptAndVerify retry with each of aads (nil for no
+// AAD) when the payload does not open with the requested one. It is meant for
+// a migration window after introducing or changing the AAD: sessions opened
+// this way are re-sealed with the canonical AAD on their next save, and the
+// fallbacks should be removed once old payloads have expired.
+func (c *Crypto) WithFallbackAADs(aads ...[]byte) *Crypto {
+	c.fallbackAADs = aads
+	return c
+}
+
+// WithNewPrimary returns a new Crypto that seals with aead and signingKey
+// while still opening payloads sealed by c's primary key and any keys c
+// itself kept for that, newest first. The new Crypto starts out with c's
+// signing hash; old keys keep verifying with the hash they had. c is not
+// modified, so it can keep serving requests while the new value is rolled
+// out. Once sessions sealed under the old keys have expired, switch to a
+// plain NewCrypto.
+func (c *Crypto) WithNewPrimary(aead cipher.AEAD, signingKey []byte) *Crypto {
+	legacy := make([]cryptoKey, 0, len(c.legacy)+1)
+	legacy = append(legacy, c.primary())
+	legacy = append(legacy, c.legacy...)
+	return &Crypto{
+		aead:          aead,
+		signingKey:    signingKey,
+		hash:          c.hash,
+		sigSize:       c.sigSize,
+		legacy:        legacy,
+		fallbackAADs:  slices.Clone(c.fallbackAADs),
+		codec:         c.codec,
+		unixTimes:     c.unixTimes,
+		allowUnsigned: c.allowUnsigned,
+		idEncoding:    c.idEncoding,
+		compress:      c.compress,
+		minSavings:    c.minSavings,
+		transformer:   c.transformer,
+	}
+}
+
+// WithAllowUnsignedLegacy makes DecryptAndVerify also accept payloads sealed
+// without a signature, as written by a Crypto that had no signing key, when
+// they fail the signed layout. It is meant for the migration window after
+// introducing a signing key: such sessions still load, the AEAD tag alone
+// authenticating them, and are re-sealed with a signature on their next
+// save. Remove it once the unsigned sessions have expired, since until then
+// a payload stripped of its signature is not rejected.
+func (c *Crypto) WithAllowUnsignedLegacy(allow bool) *Crypto {
+	c.allowUnsigned = allow
+	return c
 }
 
 func NewAESGCM(key []byte) (cipher.AEAD, error) {
@@ -59,79 +154,234 @@ func NewXChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
 	return aead, nil
 }
 
+const sessionIDBytes = 32 // 256 bits
+
 func (c *Crypto) GenerateSessionID() (string, error) {
-	bytes := make([]byte, 32) // 256 bits
+	bytes := make([]byte, sessionIDBytes)
 	if _, err := rand.Read(bytes); err != nil {
 		return "", fmt.Errorf("failed to generate session ID: %w", err)
 	}
-	return base64.RawURLEncoding.EncodeToString(bytes), nil
+	return c.ids().Encode(bytes), nil
+}
+
+// ValidSessionID reports whether id has the shape GenerateSessionID produces,
+// so obviously forged cookie values can be rejected without a Redis lookup.
+// Only the canonical encoding of exactly sessionIDBytes bytes is accepted, so
+// each session has a single id string and a single Redis key.
+func (c *Crypto) ValidSessionID(id string) bool {
+	// IDEncoding allows at most two characters per byte; this bounds the
+	// work spent on garbage.
+	if id == "" || len(id) > 2*sessionIDBytes {
+		return false
+	}
+	enc := c.ids()
+	b, err := enc.Decode(id)
+	return err == nil && len(b) == sessionIDBytes && enc.Encode(b) == id
+}
+
+// PayloadStats breaks down the size of a sealed payload: the serialized
+// plaintext, the binary form after encryption (and signing), and the final
+// base64 string that is stored.
+type PayloadStats struct {
+	PlaintextSize int
+	SealedSize    int
+	EncodedSize   int
 }
 
 func (c *Crypto) EncryptAndSign(data interface{}, aad []byte) (string, error) {
-	jsonData, err := json.Marshal(data)
+	encoded, _, err := c.EncryptAndSignWithStats(data, aad)
+	return encoded, err
+}
+
+func (c *Crypto) EncryptAndSignWithStats(data interface{}, aad []byte) (string, PayloadStats, error) {
+	var stats PayloadStats
+	jsonData, err := c.marshal(data)
 	if err != nil {
-		return "", fmt.Errorf("failed to marshal data: %w", err)
+		return "", stats, fmt.Errorf("failed to marshal data: %w", err)
+	}
+	stats.PlaintextSize = len(jsonData)
+	if jsonData, err = c.compressPayload(jsonData); err != nil {
+		return "", stats, fmt.Errorf("failed to compress data: %w", err)
 	}
 	nonce := make([]byte, c.aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", fmt.Errorf("failed to generate nonce: %w", err)
+		return "", stats, fmt.Errorf("failed to generate nonce: %w", err)
 	}
-	ciphertext := c.aead.Seal(nonce, nonce, jsonData, aad)
+	sealed := c.aead.Seal(nonce, nonce, jsonData, aad)
 
 	if c.signingKey != nil {
-		signature := c.sign(ciphertext)
-		combined := append(signature, ciphertext...)
-		return base64.StdEncoding.EncodeToString(combined), nil
+		signature := c.sign(sealed)
+		sealed = append(signature, sealed...)
 	}
 
-	return base64.StdEncoding.EncodeToString(ciphertext), nil
+	encoded := base64.RawStdEncoding.EncodeToString(sealed)
+	stats.SealedSize = len(sealed)
+	stats.EncodedSize = len(encoded)
+	return encoded, stats, nil
+}
+
+// Overhead returns the bytes EncryptAndSign adds to the marshaled JSON before
+// encoding: the nonce, the AEAD tag and, when signing, the HMAC signature
+// (32 bytes with the default SHA-256). The stored value is that total base64
+// encoded without padding, so it grows by another third;
+// base64.RawStdEncoding.EncodedLen(n + Overhead()) is the exact size for an
+// n byte plaintext. With compression on it includes the header byte, and the
+// size is an upper bound.
+func (c *Crypto) Overhead() int {
+	n := c.aead.NonceSize() + c.aead.Overhead()
+	if c.compress {
+		n++
+	}
+	if c.signingKey != nil {
+		n += c.sigSize
+	}
+	return n
 }
 
+// DecryptAndVerify opens a payload sealed by EncryptAndSign into dest, trying
+// the primary key and then the legacy ones. When no key opens it, the error
+// tells why: ErrSignatureInvalid if no signing key verifies it (forged or
+// tampered with, worth alerting on); ErrKeyMismatch, which also matches
+// ErrEncryptionFailed, if a signature verified but that key's AEAD could not
+// decrypt it, meaning the encryption key paired with the signing key is
+// wrong (an expected sight mid-rotation) or the payload was moved to another
+// session name or id; ErrEncryptionFailed for an unsigned payload that does
+// not decrypt; ErrInvalidSessionData if it is malformed.
 func (c *Crypto) DecryptAndVerify(encryptedData string, dest interface{}, aad []byte) error {
-	decoded, err := base64.StdEncoding.DecodeString(encryptedData)
+	// Payloads are written without padding; trimming it keeps values sealed
+	// by older versions (padded StdEncoding) readable.
+	decoded, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(encryptedData, "="))
 	if err != nil {
-		return fmt.Errorf("failed to decode base64: %w", err)
+		return fmt.Errorf("%w: failed to decode base64: %v", ErrInvalidSessionData, err)
 	}
-	nonceSize := c.aead.NonceSize()
-	overhead := c.aead.Overhead()
-	if c.signingKey != nil {
-		minLength := 32 + nonceSize + overhead + 1
+	plaintext, err := c.open(c.primary(), decoded, aad)
+	for i := 0; err != nil && i < len(c.legacy); i++ {
+		p, legacyErr := c.open(c.legacy[i], decoded, aad)
+		if legacyErr == nil {
+			plaintext, err = p, nil
+		} else if errors.Is(legacyErr, ErrKeyMismatch) {
+			// A key whose signature verified says more about the payload
+			// than the keys that did not recognize it.
+			err = legacyErr
+		}
+	}
+	if err != nil && c.allowUnsigned {
+		if p, unsignedErr := c.openUnsigned(decoded, aad); unsignedErr == nil {
+			plaintext, err = p, nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if plaintext, err = decompressPayload(plaintext); err != nil {
+		return err
+	}
+	if err := c.unmarshal(plaintext, dest); err != nil {
+		return fmt.Errorf("%w: failed to unmarshal data: %v", ErrInvalidSessionData, err)
+	}
+	return nil
+}
+
+// open verifies and decrypts a decoded payload with one key, trying the
+// fallback AADs after aad.
+func (c *Crypto) open(key cryptoKey, decoded, aad []byte) ([]byte, error) {
+	nonceSize := key.aead.NonceSize()
+	overhead := key.aead.Overhead()
+	if key.signingKey != nil {
+		minLength := key.sigSize + nonceSize + overhead + 1
 		if len(decoded) < minLength {
-			return ErrInvalidSessionData
+			return nil, ErrInvalidSessionData
 		}
-		signature := decoded[:32]
-		ciphertext := decoded[32:]
-		if !c.verify(ciphertext, signature) {
-			return ErrSignatureInvalid
+		signature := decoded[:key.sigSize]
+		ciphertext := decoded[key.sigSize:]
+		if !key.verify(ciphertext, signature) {
+			return nil, ErrSignatureInvalid
 		}
 		decoded = ciphertext
 	} else {
 		minLength := nonceSize + overhead + 1
 		if len(decoded) < minLength {
-			return ErrInvalidSessionData
+			return nil, ErrInvalidSessionData
 		}
 	}
 	nonce := decoded[:nonceSize]
 	ciphertext := decoded[nonceSize:]
-	plaintext, err := c.aead.Open(nil, nonce, ciphertext, aad)
+	plaintext, err := key.aead.Open(nil, nonce, ciphertext, aad)
+	for i := 0; err != nil && i < len(c.fallbackAADs); i++ {
+		plaintext, err = key.aead.Open(nil, nonce, ciphertext, c.fallbackAADs[i])
+	}
 	if err != nil {
-		return ErrEncryptionFailed
+		if key.signingKey != nil {
+			return nil, errKeyMismatch
+		}
+		return nil, ErrEncryptionFailed
 	}
-	if err := json.Unmarshal(plaintext, dest); err != nil {
-		return fmt.Errorf("failed to unmarshal data: %w", err)
+	return plaintext, nil
+}
+
+// errKeyMismatch is returned by open when the signature verified but the
+// AEAD did not open; it still matches ErrEncryptionFailed.
+var errKeyMismatch = fmt.Errorf("%w: %w", ErrKeyMismatch, ErrEncryptionFailed)
+
+// openUnsigned tries the unsigned layout with every AEAD c knows, for
+// WithAllowUnsignedLegacy.
+func (c *Crypto) openUnsigned(decoded, aad []byte) ([]byte, error) {
+	plaintext, err := c.open(cryptoKey{aead: c.aead}, decoded, aad)
+	for i := 0; err != nil && i < len(c.legacy); i++ {
+		plaintext, err = c.open(cryptoKey{aead: c.legacy[i].aead}, decoded, aad)
 	}
-	return nil
+	return plaintext, err
 }
 
 func (c *Crypto) sign(data []byte) []byte {
-	h := hmac.New(sha256.New, c.signingKey)
+	return c.primary().sign(data)
+}
+
+// verify checks signature against the primary signing key and then the
+// legacy ones, so values signed before a WithNewPrimary rotation still
+// verify.
+func (c *Crypto) verify(data, signature []byte) bool {
+	if c.primary().verify(data, signature) {
+		return true
+	}
+	for _, k := range c.legacy {
+		if k.signingKey != nil && k.verify(data, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k cryptoKey) sign(data []byte) []byte {
+	h := hmac.New(k.hash, k.signingKey)
 	h.Write(data)
 	return h.Sum(nil)
 }
 
-func (c *Crypto) verify(data, signature []byte) bool {
-	expected := c.sign(data)
-	return subtle.ConstantTimeCompare(signature, expected) == 1
+func (k cryptoKey) verify(data, signature []byte) bool {
+	return subtle.ConstantTimeCompare(signature, k.sign(data)) == 1
+}
+
+func (c *Crypto) selfTest() error {
+	id, err := c.GenerateSessionID()
+	if err != nil {
+		return err
+	}
+	in := NewSession(id, time.Minute)
+	in.Set("self-test", id)
+	aad := []byte("self-test")
+	encrypted, err := c.EncryptAndSign(in, aad)
+	if err != nil {
+		return err
+	}
+	var out Session
+	if err := c.DecryptAndVerify(encrypted, &out, aad); err != nil {
+		return err
+	}
+	if out.ID() != id || out.Get("self-test") != id {
+		return ErrInvalidSessionData
+	}
+	return nil
 }
 
 func GenerateKey(length int) ([]byte, error) {
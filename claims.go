@@ -0,0 +1,135 @@
+package redissession
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// cookieClaimsContext is prefixed to the signed part of a session cookie
+// carrying claims, so neither a companion cookie nor any other value signed
+// with the same key can pass for one.
+const cookieClaimsContext = "redissession cookie claims\x00"
+
+type cookieClaimsContextKey struct{ name string }
+
+// WithCookieClaims makes the session cookie carry the claims fn returns, such
+// as a tenant id or shard hint, next to the session id, so a request can be
+// routed before Redis is consulted. The value becomes
+// id.base64url(JSON).base64url(HMAC), the HMAC covering the cookie name, id
+// and claims, and requires a signing key; cookies signed by a key kept with
+// WithNewPrimary still verify. A session for which fn returns no claims keeps
+// a bare id. New verifies the claims and attaches them to the request context
+// ahead of the load, where CookieClaimsFromContext reads them; a cookie whose
+// claims were tampered with is rejected with ErrSignatureInvalid (reported by
+// NewWithResult) and replaced by a fresh session. Bare ids are still accepted,
+// without claims, so cookies issued before the option was enabled stay valid.
+// Under CookieOnChange a change in the claims alone does not resend the
+// cookie. A nil fn disables claims.
+func (s *RedisStore) WithCookieClaims(fn func(*Session) map[string]string) *RedisStore {
+	s.cookieClaims = fn
+	return s
+}
+
+// CookieClaims verifies and returns the claims carried by the session cookie
+// called name without touching Redis, for routing middleware that runs ahead
+// of New. It returns ErrSessionNotFound if r has no such cookie,
+// ErrSignatureInvalid if the claims do not verify, and nil claims for a
+// cookie with a bare id.
+func (s *RedisStore) CookieClaims(r *http.Request, name string) (map[string]string, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	_, claims, err := s.parseSessionCookie(name, cookie.Value)
+	return claims, err
+}
+
+// CookieClaimsFromContext returns the verified cookie claims New attached to
+// the context of a request for the session called name.
+func CookieClaimsFromContext(ctx context.Context, name string) (map[string]string, bool) {
+	claims, ok := ctx.Value(cookieClaimsContextKey{name}).(map[string]string)
+	return claims, ok
+}
+
+// sessionCookie is the session cookie for session, with its claims if
+// WithCookieClaims is set.
+func (s *RedisStore) sessionCookie(session *Session) (*http.Cookie, error) {
+	cookie := s.options.NewCookie(session)
+	if s.cookieClaims == nil {
+		return cookie, nil
+	}
+	claims := s.cookieClaims(session)
+	if len(claims) == 0 {
+		return cookie, nil
+	}
+	if s.crypto.signingKey == nil {
+		return nil, ErrInvalidConfiguration
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return nil, err
+	}
+	signed := cookie.Value + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := s.crypto.sign([]byte(cookieClaimsContext + cookie.Name + "\x00" + signed))
+	cookie.Value = signed + "." + base64.RawURLEncoding.EncodeToString(mac)
+	if err := checkCookieSize(cookie); err != nil {
+		return nil, err
+	}
+	return cookie, nil
+}
+
+// parseSessionCookie splits the value of the session cookie called name into
+// the session id and its verified claims.
+func (s *RedisStore) parseSessionCookie(name, value string) (string, map[string]string, error) {
+	if s.cookieClaims == nil {
+		return value, nil, nil
+	}
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 {
+		return value, nil, nil
+	}
+	signed, encMAC := value[:i], value[i+1:]
+	id, encClaims, ok := strings.Cut(signed, ".")
+	if !ok || s.crypto.signingKey == nil {
+		return "", nil, ErrInvalidSessionData
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil {
+		return "", nil, ErrInvalidSessionData
+	}
+	if !s.crypto.verify([]byte(cookieClaimsContext+name+"\x00"+signed), mac) {
+		return "", nil, ErrSignatureInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encClaims)
+	if err != nil {
+		return "", nil, ErrInvalidSessionData
+	}
+	var claims map[string]string
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", nil, ErrInvalidSessionData
+	}
+	return id, claims, nil
+}
+
+// withCookieClaims returns r with the verified claims of its session cookie
+// called name attached to its context, if it has any.
+func (s *RedisStore) withCookieClaims(r *http.Request, name string) *http.Request {
+	if s.cookieClaims == nil {
+		return r
+	}
+	_, claims, err := s.parseSessionCookie(name, cookieValue(r, name))
+	if err != nil || claims == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), cookieClaimsContextKey{name}, claims))
+}
+
+// cookieSessionID returns the session id carried by value, a cookie called
+// name.
+func (s *RedisStore) cookieSessionID(name, value string) (string, error) {
+	id, _, err := s.parseSessionCookie(name, value)
+	return id, err
+}
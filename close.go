@@ -0,0 +1,56 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+)
+
+// WithCloseClient makes Close also close the Redis client, the read replica
+// and every shard client. Leave it off when the clients are shared with other code.
+func (s *RedisStore) WithCloseClient(enabled bool) *RedisStore {
+	s.closeClient = enabled
+	return s
+}
+
+// Close shuts the store's background work down: it stops every sweeper
+// started with StartSweeper, rejects further SaveAsync calls with
+// ErrStoreClosed and waits for queued async writes to finish, then closes the
+// Redis clients if WithCloseClient is set (a client built by WithDB is always
+// closed). If ctx is done before the queue drains, Close returns ctx's
+// error; the remaining writes still complete in the background unless the
+// clients are closed under them. Synchronous methods keep working until the
+// clients are closed. Calling Close again is a no-op.
+func (s *RedisStore) Close(ctx context.Context) error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	sweepers := s.sweepers
+	s.sweepers = nil
+	s.closeMu.Unlock()
+
+	for _, stop := range sweepers {
+		stop()
+	}
+	err := s.Flush(ctx)
+	// No SaveAsync can start the pool or send once closed is set, so the
+	// queue can be closed; workers exit after draining what is buffered.
+	s.asyncOnce.Do(func() {})
+	if s.asyncQueue != nil {
+		close(s.asyncQueue)
+	}
+	if s.ownedClient != nil && !s.closeClient {
+		err = errors.Join(err, s.ownedClient.Close())
+	}
+	if s.closeClient {
+		for _, client := range s.allClients() {
+			err = errors.Join(err, client.Close())
+		}
+		if s.replica != nil {
+			err = errors.Join(err, s.replica.Close())
+		}
+	}
+	return err
+}
@@ -0,0 +1,68 @@
+package redissession
+
+import "encoding/json"
+
+// Codec serializes session payloads before they are sealed. The default is
+// encoding/json; faster drop-in implementations live in the codec
+// subpackages so their dependencies stay opt-in.
+//
+// Every instance sharing a Redis store must be able to read what the others
+// write, so a Codec has to produce and accept standard JSON with
+// encoding/json semantics (field tags, Marshaler/Unmarshaler methods,
+// numbers decoded into interface{} as float64). A fleet can then be moved
+// to a different codec one instance at a time.
+//
+// The price is that values only come back as JSON types: a stored
+// map[int]string or struct is read as a map[string]interface{}, and an int
+// as a float64. The codec/gob package trades the interoperability for
+// faithful round trips of arbitrary registered Go types.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is the encoding/json Codec.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) { return json.Marshal(v) }
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+// WithCodec replaces the Codec used for payloads. nil restores JSONCodec.
+func (c *Crypto) WithCodec(codec Codec) *Crypto {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	c.codec = codec
+	return c
+}
+
+// WithUnixTimestamps makes session payloads store their timestamps as Unix
+// milliseconds rather than RFC 3339 strings, which is smaller and faster to
+// parse at the cost of sub-millisecond precision. Both forms are always
+// accepted when reading, so it can be switched on (or off) across a fleet
+// gradually; existing sessions are converted as they are next saved.
+func (c *Crypto) WithUnixTimestamps(enabled bool) *Crypto {
+	c.unixTimes = enabled
+	return c
+}
+
+// marshal encodes v with the codec. Sessions are encoded from their plain
+// field struct so the codec does the work instead of deferring to
+// Session.MarshalJSON, and an already encoded json.RawMessage is used as is.
+func (c *Crypto) marshal(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case json.RawMessage:
+		return v, nil
+	case *Session:
+		return v.marshalWith(c.codec.Marshal, c.unixTimes, c.transformer)
+	}
+	return c.codec.Marshal(v)
+}
+
+func (c *Crypto) unmarshal(data []byte, v interface{}) error {
+	if s, ok := v.(*Session); ok {
+		return s.unmarshalWith(data, c.codec.Unmarshal, c.transformer)
+	}
+	return c.codec.Unmarshal(data, v)
+}
@@ -0,0 +1,46 @@
+// Package gob provides a redissession.Codec backed by encoding/gob, for
+// session values JSON cannot round-trip faithfully: maps with non-string
+// keys such as map[int]string, integers that must not come back as float64,
+// and other concrete Go types.
+//
+// Unlike the other codecs its payloads are not JSON, so every instance
+// sharing a Redis store has to switch to it at once, and sessions written
+// with a different codec fail to load (the user gets a fresh session).
+// Concrete types stored in a session value, a []interface{} or a
+// map[string]interface{} must be registered with encoding/gob.Register by
+// every instance before use; an unregistered type makes Save fail.
+package gob
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/found-cake/redissession"
+)
+
+func init() {
+	// Flashes and nested JSON-style values use these.
+	gob.Register([]interface{}{})
+	gob.Register(map[string]interface{}{})
+	gob.Register(time.Time{})
+}
+
+type codec struct{}
+
+// New returns a gob Codec.
+func New() redissession.Codec {
+	return codec{}
+}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
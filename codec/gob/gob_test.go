@@ -0,0 +1,56 @@
+package gob
+
+import (
+	"crypto/rand"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/found-cake/redissession"
+)
+
+type point struct{ X, Y int }
+
+func TestCodec_NonStringMapKeys(t *testing.T) {
+	gob.Register(map[int]string{})
+	gob.Register(point{})
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	aead, err := redissession.NewAESGCM(key)
+	if err != nil {
+		t.Fatalf("NewAESGCM: %v", err)
+	}
+	crypto := redissession.NewCrypto(aead, key).WithCodec(New())
+
+	names := map[int]string{1: "one", 2: "two"}
+	sess := redissession.NewSessionWithValues("id", time.Hour, map[string]interface{}{
+		"names": names,
+		"point": point{3, 4},
+		"count": 3,
+	})
+	sess.AddFlash("saved")
+	sealed, err := crypto.EncryptAndSign(sess, []byte("sess"))
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	var got redissession.Session
+	if err := crypto.DecryptAndVerify(sealed, &got, []byte("sess")); err != nil {
+		t.Fatalf("DecryptAndVerify: %v", err)
+	}
+	if !reflect.DeepEqual(got.Get("names"), names) {
+		t.Fatalf("names = %#v, want %#v", got.Get("names"), names)
+	}
+	if got.Get("point") != (point{3, 4}) || got.Get("count") != 3 {
+		t.Fatalf("values did not keep their types: %#v %#v", got.Get("point"), got.Get("count"))
+	}
+	if f := got.Flashes(); len(f) != 1 || f[0] != "saved" {
+		t.Fatalf("flashes = %v", f)
+	}
+	if !got.ExpiresAt().Equal(sess.ExpiresAt()) || got.ID() != "id" {
+		t.Fatalf("header mismatch: %v %q", got.ExpiresAt(), got.ID())
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/found-cake/redissession/codec/jsoniter
+
+go 1.24.0
+
+replace github.com/found-cake/redissession => ../..
+
+require (
+	github.com/found-cake/redissession v0.0.0-00010101000000-000000000000
+	github.com/json-iterator/go v1.1.12
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
+	github.com/modern-go/reflect2 v1.0.2 // indirect
+	github.com/redis/go-redis/v9 v9.14.0 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+)
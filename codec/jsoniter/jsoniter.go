@@ -0,0 +1,21 @@
+// Package jsoniter provides a redissession.Codec backed by
+// github.com/json-iterator/go.
+//
+// It is a separate module, so the core redissession module does not depend
+// on github.com/json-iterator/go:
+//
+//	go get github.com/found-cake/redissession/codec/jsoniter
+package jsoniter
+
+import (
+	jsoniter "github.com/json-iterator/go"
+
+	"github.com/found-cake/redissession"
+)
+
+// New returns a Codec using jsoniter's encoding/json compatible
+// configuration, so payloads stay readable by instances on the default
+// codec.
+func New() redissession.Codec {
+	return jsoniter.ConfigCompatibleWithStandardLibrary
+}
@@ -0,0 +1,48 @@
+package jsoniter
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/found-cake/redissession"
+)
+
+func TestCodec_InteropWithDefault(t *testing.T) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	aead, err := redissession.NewAESGCM(key)
+	if err != nil {
+		t.Fatalf("NewAESGCM: %v", err)
+	}
+	fast := redissession.NewCrypto(aead, key).WithCodec(New())
+	std := redissession.NewCrypto(aead, key)
+
+	sess := redissession.NewSessionWithValues("id", time.Hour, map[string]interface{}{
+		"user":  "alice",
+		"count": 3,
+	})
+	for _, tc := range []struct {
+		name     string
+		from, to *redissession.Crypto
+	}{
+		{"jsoniter to std", fast, std},
+		{"std to jsoniter", std, fast},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sealed, err := tc.from.EncryptAndSign(sess, []byte("sess"))
+			if err != nil {
+				t.Fatalf("EncryptAndSign: %v", err)
+			}
+			var got redissession.Session
+			if err := tc.to.DecryptAndVerify(sealed, &got, []byte("sess")); err != nil {
+				t.Fatalf("DecryptAndVerify: %v", err)
+			}
+			if got.Get("user") != "alice" || got.Get("count") != float64(3) || !got.ExpiresAt().Equal(sess.ExpiresAt()) {
+				t.Fatalf("round trip mismatch: %s", got.Snapshot())
+			}
+		})
+	}
+}
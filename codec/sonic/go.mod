@@ -0,0 +1,24 @@
+module github.com/found-cake/redissession/codec/sonic
+
+go 1.24.0
+
+replace github.com/found-cake/redissession => ../..
+
+require (
+	github.com/bytedance/sonic v1.15.4
+	github.com/found-cake/redissession v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/bytedance/gopkg v0.1.3 // indirect
+	github.com/bytedance/sonic/loader v0.5.2 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/cloudwego/base64x v0.1.6 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/klauspost/cpuid/v2 v2.2.9 // indirect
+	github.com/redis/go-redis/v9 v9.14.0 // indirect
+	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
+	golang.org/x/arch v0.0.0-20210923205945-b76863e36670 // indirect
+	golang.org/x/crypto v0.42.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+)
@@ -0,0 +1,20 @@
+// Package sonic provides a redissession.Codec backed by
+// github.com/bytedance/sonic.
+//
+// It is a separate module, so the core redissession module does not depend
+// on github.com/bytedance/sonic:
+//
+//	go get github.com/found-cake/redissession/codec/sonic
+package sonic
+
+import (
+	"github.com/bytedance/sonic"
+
+	"github.com/found-cake/redissession"
+)
+
+// New returns a Codec using sonic's encoding/json compatible configuration,
+// so payloads stay readable by instances on the default codec.
+func New() redissession.Codec {
+	return sonic.ConfigStd
+}
@@ -0,0 +1,135 @@
+package redissession
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WithCompanionCookie makes Save emit a second, non-HttpOnly cookie carrying
+// the claims returned by fn so client-side code can read simple UI state such
+// as "logged in". The session id is never included. The value is
+// base64url(JSON) + "." + base64url(HMAC) and requires a signing key; use
+// CompanionClaims to read it back server-side. The JSON also carries an "exp"
+// claim with the session's expiry in Unix seconds, replacing any fn returns,
+// and the HMAC covers the cookie name, so a value cannot be replayed past
+// that or under another name. If the claims make the cookie larger than
+// MaxCookieSize, Save returns a CookieTooLargeError after saving the session,
+// without the companion cookie.
+func (s *RedisStore) WithCompanionCookie(name string, fn func(*Session) map[string]interface{}) *RedisStore {
+	s.companionName = name
+	s.companionClaims = fn
+	return s
+}
+
+// ExpiresInHeader is the response header WithExpiresInHeader sets.
+const ExpiresInHeader = "X-Session-Expires-In"
+
+// WithExpiresInHeader makes Save and SaveAsync set the ExpiresInHeader
+// response header to the session's TTLSeconds, so a single-page app can
+// schedule a silent refresh without reading the session cookie.
+func (s *RedisStore) WithExpiresInHeader(enabled bool) *RedisStore {
+	s.expiresInHeader = enabled
+	return s
+}
+
+func (s *RedisStore) CompanionClaims(r *http.Request) (map[string]interface{}, error) {
+	if s.companionName == "" {
+		return nil, ErrInvalidConfiguration
+	}
+	cookie, err := r.Cookie(s.companionName)
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	payload, err := s.crypto.verifyValue(companionContext+s.companionName, cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidSessionData
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrInvalidSessionData
+	}
+	if float64(time.Now().Unix()) > exp {
+		return nil, ErrSessionExpired
+	}
+	delete(claims, "exp")
+	return claims, nil
+}
+
+func (s *RedisStore) setCompanionCookie(w http.ResponseWriter, session *Session) error {
+	if s.companionName == "" || s.companionClaims == nil {
+		return nil
+	}
+	claims := make(map[string]interface{})
+	for k, v := range s.companionClaims(session) {
+		claims[k] = v
+	}
+	claims["exp"] = session.ExpiresAt().Unix()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	value, err := s.crypto.signValue(companionContext+s.companionName, payload)
+	if err != nil {
+		return err
+	}
+	cookie := s.options.newCookie(s.companionName, value, session.ExpiresAt())
+	cookie.HttpOnly = false
+	if err := checkCookieSize(cookie); err != nil {
+		return err
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+func (s *RedisStore) removeCompanionCookie(w http.ResponseWriter) {
+	if s.companionName == "" {
+		return
+	}
+	cookie := s.options.RemoveCookie(s.companionName)
+	cookie.HttpOnly = false
+	http.SetCookie(w, cookie)
+}
+
+// companionContext is prefixed, with the cookie name, to the companion
+// payload before signing, so no other value signed with the same key, nor a
+// companion cookie issued under another name, passes for one.
+const companionContext = "redissession companion cookie\x00"
+
+// signValue signs payload under purpose, which is covered by the HMAC but
+// not included in the value.
+func (c *Crypto) signValue(purpose string, payload []byte) (string, error) {
+	if c.signingKey == nil {
+		return "", ErrInvalidConfiguration
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(c.sign(append([]byte(purpose+"\x00"), payload...))), nil
+}
+
+func (c *Crypto) verifyValue(purpose, value string) ([]byte, error) {
+	if c.signingKey == nil {
+		return nil, ErrInvalidConfiguration
+	}
+	encPayload, encSig, ok := strings.Cut(value, ".")
+	if !ok {
+		return nil, ErrInvalidSessionData
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, ErrInvalidSessionData
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encSig)
+	if err != nil {
+		return nil, ErrInvalidSessionData
+	}
+	if !c.verify(append([]byte(purpose+"\x00"), payload...), signature) {
+		return nil, ErrSignatureInvalid
+	}
+	return payload, nil
+}
@@ -0,0 +1,86 @@
+package redissession
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Payload header bytes written in front of the serialized session when
+// compression is on. Neither can start a JSON or gob encoding, so payloads
+// without a header (written with compression off) are told apart by their
+// first byte.
+const (
+	rawPayload   byte = 0x00
+	flatePayload byte = 0x01
+)
+
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// WithCompression deflates serialized payloads before they are sealed,
+// keeping the compressed form only when it is at least minSavings (a
+// fraction of the original size, e.g. 0.1 for 10%) smaller; otherwise the
+// payload is stored as is, so small or incompressible payloads never grow by
+// more than the one header byte recording the choice. Session JSON with
+// repeated keys typically shrinks by half or more. A minSavings outside
+// [0, 1) turns compression off, the default.
+//
+// Payloads are decompressed whenever their header says so, whether or not
+// compression is on, so enable it only once every instance sharing the store
+// runs a version that reads it.
+func (c *Crypto) WithCompression(minSavings float64) *Crypto {
+	c.compress = minSavings >= 0 && minSavings < 1
+	c.minSavings = minSavings
+	return c
+}
+
+// compressPayload prefixes data with its header, deflating it if that saves
+// enough. data is returned unchanged if compression is off.
+func (c *Crypto) compressPayload(data []byte) ([]byte, error) {
+	if !c.compress {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte(flatePayload)
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if float64(buf.Len()-1) <= float64(len(data))*(1-c.minSavings) {
+		return buf.Bytes(), nil
+	}
+	return append([]byte{rawPayload}, data...), nil
+}
+
+// decompressPayload undoes compressPayload. Payloads without a header are
+// returned unchanged.
+func decompressPayload(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return data, nil
+	}
+	switch data[0] {
+	case rawPayload:
+		return data[1:], nil
+	case flatePayload:
+		r := flate.NewReader(bytes.NewReader(data[1:]))
+		defer r.Close()
+		out, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: failed to decompress data: %v", ErrInvalidSessionData, err)
+		}
+		return out, nil
+	}
+	return data, nil
+}
@@ -0,0 +1,45 @@
+package redissession
+
+import "context"
+
+type sessionIDContextKey struct{ name string }
+
+// ContextWithSessionID attaches the id of the session called name to ctx,
+// for transports that carry the id out of band instead of in a cookie.
+func ContextWithSessionID(ctx context.Context, name, sessionID string) context.Context {
+	return context.WithValue(ctx, sessionIDContextKey{name}, sessionID)
+}
+
+func sessionIDFromContext(ctx context.Context, name string) (string, bool) {
+	id, ok := ctx.Value(sessionIDContextKey{name}).(string)
+	return id, ok
+}
+
+// WithContextIDExtractor replaces how FromContext finds the session id. gRPC
+// services typically read it from incoming metadata:
+//
+//	store.WithContextIDExtractor(func(ctx context.Context, name string) (string, bool) {
+//		md, _ := metadata.FromIncomingContext(ctx)
+//		if v := md.Get("x-session-id"); len(v) > 0 {
+//			return v[0], true
+//		}
+//		return "", false
+//	})
+//
+// The default reads the value set by ContextWithSessionID.
+func (s *RedisStore) WithContextIDExtractor(fn func(ctx context.Context, name string) (string, bool)) *RedisStore {
+	s.contextID = fn
+	return s
+}
+
+// FromContext is the context-based counterpart of New: it loads the session
+// whose id ctx carries, or returns a fresh session if there is none.
+func (s *RedisStore) FromContext(ctx context.Context, name string) (*Session, error) {
+	extract := s.contextID
+	if extract == nil {
+		extract = sessionIDFromContext
+	}
+	sessionID, _ := extract(ctx, name)
+	res, err := s.open(ctx, name, sessionID)
+	return res.session, err
+}
@@ -1,10 +1,17 @@
 package redissession
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// DefaultCookieChunkSize leaves room for the cookie name and attributes
+// within the ~4KB per-cookie limit enforced by browsers.
+const DefaultCookieChunkSize = 3800
+
 type CookieOptions struct {
 	Path        string
 	Domain      string
@@ -13,16 +20,33 @@ type CookieOptions struct {
 	HttpOnly    bool
 	Partitioned bool
 	SameSite    http.SameSite
+	ChunkSize   int  // max value bytes per chunk, 0 uses DefaultCookieChunkSize
+	OmitExpires bool // send only Max-Age, without the absolute Expires attribute
+	RawDomain   bool // use Domain exactly as given instead of normalizing it
 }
 
 func (options *CookieOptions) NewCookie(session *Session) *http.Cookie {
+	cookie := options.NewCookieForID(session.Name(), session.ID(), session.ExpiresAt())
+	if mode := session.SameSite(); mode != 0 {
+		cookie.SameSite = mode
+	}
+	return cookie
+}
+
+// NewCookieForID builds the session cookie from the id alone, for callers
+// that can issue a session without holding its *Session.
+func (options *CookieOptions) NewCookieForID(name, id string, expiresAt time.Time) *http.Cookie {
+	return options.newCookie(name, id, expiresAt)
+}
+
+func (options *CookieOptions) newCookie(name, value string, expiresAt time.Time) *http.Cookie {
 	return &http.Cookie{
-		Name:        session.Name(),
-		Value:       session.ID(),
+		Name:        name,
+		Value:       value,
 		Path:        options.Path,
-		Domain:      options.Domain,
-		MaxAge:      int(time.Until(session.ExpiresAt()).Seconds()),
-		Expires:     session.ExpiresAt(),
+		Domain:      options.domain(),
+		MaxAge:      int(time.Until(expiresAt).Seconds()),
+		Expires:     options.expires(expiresAt),
 		Secure:      options.Secure,
 		HttpOnly:    options.HttpOnly,
 		Partitioned: options.Partitioned,
@@ -35,9 +59,9 @@ func (options *CookieOptions) RemoveCookie(name string) *http.Cookie {
 		Name:        name,
 		Value:       "",
 		Path:        options.Path,
-		Domain:      options.Domain,
+		Domain:      options.domain(),
 		MaxAge:      -1,
-		Expires:     time.Unix(0, 0),
+		Expires:     options.expires(time.Unix(0, 0)),
 		Secure:      options.Secure,
 		HttpOnly:    options.HttpOnly,
 		Partitioned: options.Partitioned,
@@ -45,6 +69,180 @@ func (options *CookieOptions) RemoveCookie(name string) *http.Cookie {
 	}
 }
 
+// domain returns Domain in its normal form: trimmed, lower-cased and without
+// leading or trailing dots. Browsers (RFC 6265) treat "example.com" and
+// ".example.com" alike, as the domain plus all its subdomains, and net/http
+// drops a leading dot when writing the cookie anyway, so the normal form
+// changes nothing on the wire except that every cookie the store sets or
+// removes carries the same attribute, however the config spells it. Set
+// RawDomain to pass Domain through untouched.
+func (options *CookieOptions) domain() string {
+	if options.RawDomain {
+		return options.Domain
+	}
+	return strings.ToLower(strings.Trim(strings.TrimSpace(options.Domain), "."))
+}
+
+// Validate reports Domain values that browsers would reject or that are
+// almost certainly a config mistake, such as a URL, a host with a port or
+// path, or a name containing spaces. An empty Domain, making the cookie
+// host-only, is valid.
+func (options *CookieOptions) Validate() error {
+	d := options.domain()
+	if d == "" {
+		return nil
+	}
+	if strings.Contains(d, "..") {
+		return fmt.Errorf("%w: invalid cookie domain %q", ErrInvalidConfiguration, options.Domain)
+	}
+	for _, r := range d {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '.':
+		default:
+			return fmt.Errorf("%w: invalid cookie domain %q", ErrInvalidConfiguration, options.Domain)
+		}
+	}
+	return nil
+}
+
+func (options *CookieOptions) expires(t time.Time) time.Time {
+	if options.OmitExpires {
+		return time.Time{}
+	}
+	return t
+}
+
+// NewChunkedCookies splits value across name.0, name.1, ... when it does not
+// fit in a single cookie. Values that fit are emitted as a single cookie
+// called name.
+func (options *CookieOptions) NewChunkedCookies(name, value string, expiresAt time.Time) []*http.Cookie {
+	size := options.chunkSize()
+	if len(value) <= size {
+		return []*http.Cookie{options.newCookie(name, value, expiresAt)}
+	}
+	cookies := make([]*http.Cookie, 0, (len(value)+size-1)/size)
+	for i := 0; len(value) > 0; i++ {
+		n := min(size, len(value))
+		cookies = append(cookies, options.newCookie(chunkName(name, i), value[:n], expiresAt))
+		value = value[n:]
+	}
+	return cookies
+}
+
+// SetChunkedCookies writes value as chunked cookies and clears any cookie or
+// chunk left over from a previous, larger value sent with r.
+func (options *CookieOptions) SetChunkedCookies(w http.ResponseWriter, r *http.Request, name, value string, expiresAt time.Time) {
+	cookies := options.NewChunkedCookies(name, value, expiresAt)
+	written := make(map[string]bool, len(cookies))
+	for _, c := range cookies {
+		written[c.Name] = true
+		http.SetCookie(w, c)
+	}
+	for _, c := range options.RemoveChunkedCookies(r, name) {
+		if !written[c.Name] {
+			http.SetCookie(w, c)
+		}
+	}
+}
+
+// RemoveChunkedCookies returns deletion cookies for name and every chunk of
+// it present on r.
+func (options *CookieOptions) RemoveChunkedCookies(r *http.Request, name string) []*http.Cookie {
+	var cookies []*http.Cookie
+	seen := make(map[string]bool)
+	for _, c := range r.Cookies() {
+		if seen[c.Name] {
+			continue
+		}
+		if c.Name == name || isChunkOf(c.Name, name) {
+			seen[c.Name] = true
+			cookies = append(cookies, options.RemoveCookie(c.Name))
+		}
+	}
+	return cookies
+}
+
+// ReadChunkedCookie reassembles a value written by NewChunkedCookies.
+func ReadChunkedCookie(r *http.Request, name string) (string, error) {
+	if c, err := r.Cookie(name); err == nil {
+		return c.Value, nil
+	}
+	var b strings.Builder
+	for i := 0; ; i++ {
+		c, err := r.Cookie(chunkName(name, i))
+		if err != nil {
+			if i == 0 {
+				return "", err
+			}
+			return b.String(), nil
+		}
+		b.WriteString(c.Value)
+	}
+}
+
+func (options *CookieOptions) chunkSize() int {
+	if options.ChunkSize > 0 {
+		return options.ChunkSize
+	}
+	return DefaultCookieChunkSize
+}
+
+func chunkName(name string, i int) string {
+	return name + "." + strconv.Itoa(i)
+}
+
+func isChunkOf(cookieName, name string) bool {
+	suffix, ok := strings.CutPrefix(cookieName, name+".")
+	if !ok || suffix == "" {
+		return false
+	}
+	_, err := strconv.Atoi(suffix)
+	return err == nil
+}
+
+// ValidCookieName reports whether name is an RFC 6265 cookie-name token.
+// net/http silently drops cookies with invalid names.
+func ValidCookieName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SanitizeCookieName replaces every character not allowed in a cookie name
+// with an underscore.
+func SanitizeCookieName(name string) string {
+	if name == "" {
+		return "_"
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if !isTokenChar(c) {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func isTokenChar(c byte) bool {
+	if c <= ' ' || c >= 0x7f {
+		return false
+	}
+	return !strings.ContainsRune("()<>@,;:\\\"/[]?={}", rune(c))
+}
+
+func validateCookieName(name string) error {
+	if !ValidCookieName(name) {
+		return fmt.Errorf("%w: invalid cookie name %q", ErrInvalidConfiguration, name)
+	}
+	return nil
+}
+
 func DefaultCookieOptions() *CookieOptions {
 	return &CookieOptions{
 		Path:     "/",
@@ -54,3 +252,17 @@ func DefaultCookieOptions() *CookieOptions {
 		SameSite: http.SameSiteStrictMode,
 	}
 }
+
+// DefaultCookieOptionsLax is DefaultCookieOptions with SameSite=Lax. Strict
+// cookies are withheld on the first request of any navigation that starts on
+// another site, so a user coming back from an OAuth provider or following a
+// link from email arrives without their session. Lax sends the cookie on
+// such top-level GET navigations but still not on cross-site subrequests or
+// POSTs, which keeps most of the CSRF protection. To get Strict once the
+// sensitive part begins, keep Lax here and call Session.SetSameSite with
+// http.SameSiteStrictMode after login.
+func DefaultCookieOptionsLax() *CookieOptions {
+	options := DefaultCookieOptions()
+	options.SameSite = http.SameSiteLaxMode
+	return options
+}
@@ -0,0 +1,77 @@
+package redissession
+
+import "time"
+
+// CookieBehavior controls when Save and SaveAsync send the session cookie.
+type CookieBehavior int
+
+const (
+	// CookieAlways sends the cookie on every save.
+	CookieAlways CookieBehavior = iota
+	// CookieOnChange sends the cookie only when the client does not already
+	// hold an equivalent one: the session is new, its id was rotated, it was
+	// opened from a legacy or duplicate cookie, or its expiry moved by a
+	// second or more since the cookie was last sent. In Rolling mode the
+	// slide on load counts only once it exceeds a tenth of MaxAge, so the
+	// client's cookie may expire up to that much before the session does.
+	// Responses to plain reads then carry no Set-Cookie and stay cacheable.
+	CookieOnChange
+	// CookieNever never sends the session cookie, for callers transporting
+	// the session id themselves. RotateID does not set it either.
+	CookieNever
+)
+
+// WithCookieBehavior sets when the session cookie is sent; the default is
+// CookieAlways. The companion cookie follows the session cookie, while
+// cookies being expired (legacy names, Destroy) are always sent.
+func (s *RedisStore) WithCookieBehavior(behavior CookieBehavior) *RedisStore {
+	s.cookieBehavior = behavior
+	return s
+}
+
+// cookieDue reports whether saving session should send its cookie.
+func (s *RedisStore) cookieDue(session *Session) bool {
+	switch s.cookieBehavior {
+	case CookieNever:
+		return false
+	case CookieOnChange:
+	default:
+		return true
+	}
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	if session.isNew || session.cookieID != session.id || session.duplicateCookies || session.legacyName != "" {
+		return true
+	}
+	threshold := time.Second
+	if s.mode == Rolling {
+		threshold = max(threshold, time.Duration(s.options.MaxAge)*time.Second/10)
+	}
+	drift := session.expiresAt.Sub(session.cookieExpires)
+	return drift >= threshold || -drift >= threshold
+}
+
+// cookieState is the session cookie the client was last sent.
+type cookieState struct {
+	id      string
+	expires time.Time
+}
+
+// markCookieSent records that the session's current cookie is being sent
+// and returns the previous state for restoreCookie. It runs before the
+// session is sealed so the stored copy knows what the client holds.
+func (s *Session) markCookieSent() cookieState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := cookieState{s.cookieID, s.cookieExpires}
+	s.cookieID = s.id
+	s.cookieExpires = s.expiresAt
+	return prev
+}
+
+func (s *Session) restoreCookie(prev cookieState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cookieID = prev.id
+	s.cookieExpires = prev.expires
+}
@@ -0,0 +1,37 @@
+package redissession
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// MaxCookieSize is the largest cookie, counting its name, value and
+// attributes as sent in Set-Cookie, that browsers are required to accept
+// (RFC 6265, section 6.1). Larger ones are silently dropped, taking the
+// session with them.
+const MaxCookieSize = 4096
+
+// CookieTooLargeError is returned instead of emitting a cookie a browser
+// would drop. It matches ErrCookieTooLarge. For a CookieStore whose payload
+// is over the limit set with WithMaxSize, Size and Limit are the sealed
+// payload's size and that limit; otherwise they measure the Set-Cookie
+// value against MaxCookieSize, and Name is the offending cookie (or chunk).
+type CookieTooLargeError struct {
+	Name  string
+	Size  int
+	Limit int
+}
+
+func (e *CookieTooLargeError) Error() string {
+	return fmt.Sprintf("%v: %s is %d bytes, limit %d", ErrCookieTooLarge, e.Name, e.Size, e.Limit)
+}
+
+func (e *CookieTooLargeError) Unwrap() error { return ErrCookieTooLarge }
+
+// checkCookieSize fails if c would be dropped by browsers for its size.
+func checkCookieSize(c *http.Cookie) error {
+	if size := len(c.String()); size > MaxCookieSize {
+		return &CookieTooLargeError{Name: c.Name, Size: size, Limit: MaxCookieSize}
+	}
+	return nil
+}
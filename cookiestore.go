@@ -0,0 +1,131 @@
+package redissession
+
+import (
+	"net/http"
+	"time"
+)
+
+// CookieStore keeps the whole sealed session in the cookie instead of Redis,
+// reusing Crypto and CookieOptions. It suits small sessions on deployments
+// without Redis, with the usual trade-offs: the payload travels with every
+// request, its size is bounded by browser cookie limits, and a session cannot
+// be revoked server-side before it expires — Destroy only clears the
+// client's copy, so a captured cookie remains valid until its expiry.
+type CookieStore struct {
+	crypto  *Crypto
+	options *CookieOptions
+	maxSize int
+
+	rotatePolicy RotatePolicy
+}
+
+func NewCookieStore(crypto *Crypto, options *CookieOptions) *CookieStore {
+	return &CookieStore{
+		crypto:  crypto,
+		options: options,
+		maxSize: DefaultCookieChunkSize,
+	}
+}
+
+// WithMaxSize sets the largest sealed payload Save accepts, in bytes. Values
+// above the chunk size are split across several cookies (see
+// NewChunkedCookies); keep the total well below the request header limits of
+// your servers and proxies. Save fails with a CookieTooLargeError for a
+// payload over the limit, or if a single cookie would exceed MaxCookieSize
+// (a ChunkSize set too large).
+func (s *CookieStore) WithMaxSize(n int) *CookieStore {
+	s.maxSize = n
+	return s
+}
+
+func (s *CookieStore) Get(r *http.Request, name string) (*Session, error) {
+	return s.New(r, name)
+}
+
+func (s *CookieStore) New(r *http.Request, name string) (*Session, error) {
+	if err := validateCookieName(name); err != nil {
+		return nil, err
+	}
+	if value, err := ReadChunkedCookie(r, name); err == nil {
+		if session, err := s.decode(name, value); err == nil {
+			session.setIsNew(false)
+			return session, nil
+		}
+	}
+	id, err := s.crypto.GenerateSessionID()
+	if err != nil {
+		return nil, err
+	}
+	session := NewSession(id, time.Duration(s.options.MaxAge)*time.Second)
+	session.setName(name)
+	return session, nil
+}
+
+func (s *CookieStore) Save(r *http.Request, w http.ResponseWriter, session *Session) error {
+	if headersWritten(w) {
+		return ErrHeadersAlreadySent
+	}
+	if err := validateCookieName(session.Name()); err != nil {
+		return err
+	}
+	if session.ExpiresAt().Before(time.Now()) {
+		return ErrSessionExpired
+	}
+	value, err := s.crypto.EncryptAndSign(session, []byte(session.Name()))
+	if err != nil {
+		return err
+	}
+	if len(value) > s.maxSize {
+		return &CookieTooLargeError{Name: session.Name(), Size: len(value), Limit: s.maxSize}
+	}
+	for _, c := range s.options.NewChunkedCookies(session.Name(), value, session.ExpiresAt()) {
+		if err := checkCookieSize(c); err != nil {
+			return err
+		}
+	}
+	s.options.SetChunkedCookies(w, r, session.Name(), value, session.ExpiresAt())
+	session.markClean()
+	return nil
+}
+
+func (s *CookieStore) RotateID(r *http.Request, w http.ResponseWriter, session *Session) error {
+	id, err := s.crypto.GenerateSessionID()
+	if err != nil {
+		return err
+	}
+	oldID := session.ID()
+	s.rotatePolicy.apply(session)
+	session.setID(id)
+	if err := s.Save(r, w, session); err != nil {
+		session.setID(oldID)
+		return err
+	}
+	return nil
+}
+
+func (s *CookieStore) Destroy(r *http.Request, w http.ResponseWriter, session *Session) error {
+	removed := s.options.RemoveChunkedCookies(r, session.Name())
+	cleared := false
+	for _, c := range removed {
+		cleared = cleared || c.Name == session.Name()
+		http.SetCookie(w, c)
+	}
+	if !cleared {
+		http.SetCookie(w, s.options.RemoveCookie(session.Name()))
+	}
+	return nil
+}
+
+func (s *CookieStore) decode(name, value string) (*Session, error) {
+	var session Session
+	if err := s.crypto.DecryptAndVerify(value, &session, []byte(name)); err != nil {
+		return nil, err
+	}
+	if session.Name() != name {
+		return nil, ErrInvalidSessionData
+	}
+	if time.Now().After(session.ExpiresAt()) {
+		return nil, ErrSessionExpired
+	}
+	return &session, nil
+}
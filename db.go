@@ -0,0 +1,29 @@
+package redissession
+
+import "github.com/redis/go-redis/v9"
+
+// WithDB pins the store to Redis database db. SELECT only affects the
+// connection it runs on, so it cannot be applied to a pooled client that is
+// shared with other code; when the client is not already configured for db,
+// the store builds a dedicated client from the client's options with DB
+// replaced, with its own connection pool, and Close always closes that
+// client. Apply WithDB after the client is set (NewStore does that first).
+// The read replica and shard clients are used as given and must already
+// point at the right database.
+//
+// Databases are not an isolation boundary: FLUSHDB or a pattern SCAN in one
+// wipes or walks every store sharing it, so give each store its own key
+// prefix. Redis Cluster only has database 0. A negative db is ignored.
+func (s *RedisStore) WithDB(db int) *RedisStore {
+	if db < 0 || s.client == nil || s.client.Options().DB == db {
+		return s
+	}
+	opts := *s.client.Options()
+	opts.DB = db
+	if s.ownedClient != nil {
+		s.ownedClient.Close()
+	}
+	s.client = redis.NewClient(&opts)
+	s.ownedClient = s.client
+	return s
+}
@@ -0,0 +1,79 @@
+package redissession
+
+// WithDeployTag folds tag into the AAD every session is sealed with, so a
+// session written by a deploy opens only in deploys configured with the same
+// tag. Deploys sharing Redis during a blue/green rollout can then tell their
+// sessions apart without separate databases: a cookie from the other
+// generation fails to decrypt and is treated like any invalid cookie, and
+// Sweep counts the other generation's sessions as undecryptable rather than
+// touching them. Changing the tag logs out every existing session. The
+// empty tag, the default, keeps the AAD at the bare session name.
+func (s *RedisStore) WithDeployTag(tag string) *RedisStore {
+	s.deployTag = tag
+	return s
+}
+
+// WithIDInAAD binds each sealed session to its id as well as its name, so a
+// payload copied to another session's key, by anyone able to write to
+// Redis, no longer opens there. Enabling it changes the AAD of every new
+// payload: sessions sealed before fail to open and their users start over,
+// unless WithUnboundAADFallback is also set for the migration window.
+// Disabling it again has the same effect in reverse.
+func (s *RedisStore) WithIDInAAD(enabled bool) *RedisStore {
+	s.idInAAD = enabled
+	return s
+}
+
+// WithUnboundAADFallback makes a store using WithIDInAAD still open sessions
+// sealed without the id in the AAD; they are re-sealed with it on their next
+// save. It reopens the blob swapping gap for those payloads, so remove it
+// once they have expired.
+func (s *RedisStore) WithUnboundAADFallback(accept bool) *RedisStore {
+	s.unboundAAD = accept
+	return s
+}
+
+// aad returns the additional authenticated data for the session called name
+// with the given id. The NUL separators cannot occur in a cookie name or
+// session id, so distinct name, tag and id combinations never collide.
+func (s *RedisStore) aad(name, sessionID string) []byte {
+	aad := s.nameAAD(name)
+	if s.idInAAD {
+		aad = append(aad, "\x00\x00"+sessionID...)
+	}
+	return aad
+}
+
+// nameAAD is the AAD without the session id.
+func (s *RedisStore) nameAAD(name string) []byte {
+	if s.deployTag == "" {
+		return []byte(name)
+	}
+	return []byte(name + "\x00" + s.deployTag)
+}
+
+// seal encrypts and signs payload for the session called name with the
+// given id.
+func (s *RedisStore) seal(payload interface{}, name, sessionID string) (string, PayloadStats, error) {
+	c, err := s.cryptoFor(name, sessionID)
+	if err != nil {
+		return "", PayloadStats{}, err
+	}
+	return c.EncryptAndSignWithStats(payload, s.aad(name, sessionID))
+}
+
+// unseal opens a stored payload for the session called name with the given
+// id, falling back to the id-less AAD if WithUnboundAADFallback allows it.
+func (s *RedisStore) unseal(encrypted string, dest interface{}, name, sessionID string) error {
+	c, err := s.cryptoFor(name, sessionID)
+	if err != nil {
+		return err
+	}
+	err = c.DecryptAndVerify(encrypted, dest, s.aad(name, sessionID))
+	if err != nil && s.idInAAD && s.unboundAAD {
+		if c.DecryptAndVerify(encrypted, dest, s.nameAAD(name)) == nil {
+			return nil
+		}
+	}
+	return err
+}
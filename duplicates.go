@@ -0,0 +1,120 @@
+package redissession
+
+import (
+	"context"
+	"net/http"
+)
+
+// CookieScope is a Path and Domain combination a session cookie may have
+// been issued under.
+type CookieScope struct {
+	Path   string
+	Domain string
+}
+
+// WithDuplicateCookieRecovery handles requests carrying several cookies with
+// the session's name, which browsers keep when the cookie was issued under
+// different Path or Domain attributes, e.g. after a configuration change.
+// New then tries every candidate and uses the one that loads and was updated
+// most recently instead of whichever the browser listed first. The next
+// Save expires the copies under each of the stale scopes, since the request
+// does not say which scope a cookie came from. Without scopes it targets the
+// usual leftovers of a changed config: a host-only cookie when Domain is
+// set, and one at Path "/" when Path is narrower.
+func (s *RedisStore) WithDuplicateCookieRecovery(stale ...CookieScope) *RedisStore {
+	s.dupRecovery = true
+	s.dupScopes = stale
+	return s
+}
+
+// openCookies opens the session for the cookie(s) called name carried by r.
+func (s *RedisStore) openCookies(r *http.Request, name string) (openResult, error) {
+	ctx := r.Context()
+	var values []string
+	if s.dupRecovery {
+		values = cookieValues(r, name)
+	}
+	if len(values) <= 1 {
+		id, parseErr := s.cookieSessionID(name, cookieValue(r, name))
+		if parseErr != nil {
+			return s.fresh(ctx, name, parseErr)
+		}
+		return s.open(ctx, name, id)
+	}
+	var session *Session
+	var loadErr error
+	for _, value := range values {
+		id, err := s.cookieSessionID(name, value)
+		if err != nil {
+			loadErr = err
+			continue
+		}
+		candidate, err := s.loadCandidate(ctx, name, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return openResult{loadErr: err}, err
+			}
+			loadErr = err
+			continue
+		}
+		if session == nil || candidate.UpdatedAt().After(session.UpdatedAt()) {
+			session = candidate
+		}
+	}
+	if session == nil {
+		return s.fresh(ctx, name, loadErr)
+	}
+	session.setIsNew(false)
+	session.setName(name)
+	session.mu.Lock()
+	session.duplicateCookies = true
+	session.mu.Unlock()
+	return openResult{session: session}, nil
+}
+
+func (s *RedisStore) loadCandidate(ctx context.Context, name, sessionID string) (*Session, error) {
+	if !s.crypto.ValidSessionID(sessionID) {
+		return nil, ErrInvalidSessionData
+	}
+	return s.load(ctx, name, sessionID)
+}
+
+// removeDuplicateCookies expires the stale copies of session's cookie that
+// openRequest found, so the one about to be set is the only one left.
+func (s *RedisStore) removeDuplicateCookies(w http.ResponseWriter, session *Session) {
+	session.mu.Lock()
+	found := session.duplicateCookies
+	session.duplicateCookies = false
+	session.mu.Unlock()
+	if !found {
+		return
+	}
+	scopes := s.dupScopes
+	if len(scopes) == 0 {
+		if s.options.domain() != "" {
+			scopes = append(scopes, CookieScope{Path: s.options.Path})
+		}
+		if s.options.Path != "" && s.options.Path != "/" {
+			scopes = append(scopes, CookieScope{Path: "/", Domain: s.options.domain()})
+		}
+	}
+	for _, scope := range scopes {
+		if scope.Path == s.options.Path && scope.Domain == s.options.domain() {
+			continue
+		}
+		cookie := s.options.RemoveCookie(session.Name())
+		cookie.Path = scope.Path
+		cookie.Domain = scope.Domain
+		http.SetCookie(w, cookie)
+	}
+}
+
+func cookieValues(r *http.Request, name string) []string {
+	var values []string
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == name {
+			values = append(values, cookie.Value)
+		}
+	}
+	return values
+}
@@ -13,7 +13,27 @@ var (
 
 	ErrSignatureInvalid = errors.New("signature verification failed")
 
+	ErrKeyMismatch = errors.New("signature valid but decryption failed")
+
 	ErrSessionExpired = errors.New("session expired")
 
 	ErrInvalidConfiguration = errors.New("invalid configuration")
+
+	ErrSessionRevoked = errors.New("session revoked")
+
+	ErrTooManyValues = errors.New("too many session values")
+
+	ErrSweepInProgress = errors.New("sweep already in progress")
+
+	ErrSkipSave = errors.New("skip save")
+
+	ErrCookieTooLarge = errors.New("cookie too large")
+
+	ErrHeadersAlreadySent = errors.New("response headers already sent")
+
+	ErrSessionBindingMismatch = errors.New("session binding mismatch")
+
+	ErrStoreClosed = errors.New("store closed")
+
+	ErrStoreUnavailable = errors.New("session store unavailable")
 )
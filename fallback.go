@@ -0,0 +1,76 @@
+package redissession
+
+import "strings"
+
+// WithReadFallback moves the store to its current prefix without logging
+// anyone out. Sessions are still looked up under oldPrefix when missing
+// under the current one, while every save writes under the current prefix
+// only, so active sessions migrate on their next save. Destroy and RotateID
+// delete both copies so a stale one can never resurface, and the operations
+// that walk the keyspace (Sweep, DestroyAll, ListNames, ScanFilter) cover
+// both prefixes. Once the longest
+// session lifetime has passed the old prefix is empty and the fallback can
+// be removed. Both prefixes must be on the same Redis (or shard).
+func (s *RedisStore) WithReadFallback(oldPrefix string) *RedisStore {
+	s.readFallback = true
+	s.fallbackPrefix = oldPrefix
+	return s
+}
+
+// readKeys returns the keys a session may be stored under, current first.
+func (s *RedisStore) readKeys(name, sessionID string) []string {
+	key := s.redisKey(name, sessionID)
+	if !s.readFallback {
+		return []string{key}
+	}
+	if old := s.keyUnder(s.fallbackPrefix, name, sessionID); old != key {
+		return []string{key, old}
+	}
+	return []string{key}
+}
+
+// scanPrefixes returns the prefixes scanKeys walks: the current one and,
+// with a read fallback, the old one. A prefix nested in the other is
+// dropped, since scanning the outer one already finds its keys.
+func (s *RedisStore) scanPrefixes() []string {
+	old := s.fallbackPrefix
+	switch {
+	case !s.readFallback || strings.HasPrefix(old, s.prefix):
+		return []string{s.prefix}
+	case strings.HasPrefix(s.prefix, old):
+		return []string{old}
+	}
+	return []string{s.prefix, old}
+}
+
+// keyPrefix returns the prefix a scanned key was written under, preferring
+// the longer of the two when the key matches both.
+func (s *RedisStore) keyPrefix(key string) string {
+	old := s.fallbackPrefix
+	if s.readFallback && strings.HasPrefix(key, old) &&
+		(len(old) > len(s.prefix) || !strings.HasPrefix(key, s.prefix)) {
+		return old
+	}
+	return s.prefix
+}
+
+// parseScannedKey is parseKey for keys found by scanKeys, which may sit
+// under the fallback prefix.
+func (s *RedisStore) parseScannedKey(key string) (name, sessionID string, ok bool) {
+	prefix := s.keyPrefix(key)
+	if prefix == s.prefix {
+		return s.parseKey(key)
+	}
+	if s.isIndexKeyUnder(prefix, key) {
+		return "", "", false
+	}
+	if s.keyParse == nil {
+		return defaultKeyParser(prefix, key)
+	}
+	return s.keyParse(prefix, key)
+}
+
+// isScannedIndexKey is isIndexKey for keys found by scanKeys.
+func (s *RedisStore) isScannedIndexKey(key string) bool {
+	return s.isIndexKeyUnder(s.keyPrefix(key), key)
+}
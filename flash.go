@@ -0,0 +1,72 @@
+package redissession
+
+import "time"
+
+// flashKey is the reserved value key holding flash messages without a
+// category; categorised flashes live under flashKey + ":" + category.
+const flashKey = "_flash"
+
+// Pop returns the value stored under key and removes it in one step, so two
+// requests sharing the session cannot both consume it.
+func (s *Session) Pop(key string) (interface{}, bool) {
+	s.mu.Lock()
+	val, ok := s.pop(key)
+	s.mu.Unlock()
+	if ok {
+		s.notifyChange()
+	}
+	return val, ok
+}
+
+// pop must be called with the write lock held.
+func (s *Session) pop(key string) (interface{}, bool) {
+	val, ok := s.values[key]
+	if !ok {
+		return nil, false
+	}
+	delete(s.values, key)
+	s.untrackKey(key)
+	s.updatedAt = time.Now()
+	s.dirty = true
+	return val, true
+}
+
+// AddFlash queues msg to be shown once, optionally under a category. Like
+// any value, msg must survive a JSON round trip to be read on a later
+// request.
+func (s *Session) AddFlash(msg interface{}, category ...string) {
+	key := flashKeyFor(category)
+	defer s.notifyChange()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	flashes, _ := s.values[key].([]interface{})
+	s.trackKey(key)
+	s.values[key] = append(flashes, msg)
+	s.updatedAt = time.Now()
+	s.dirty = true
+}
+
+// Flashes returns the flashes queued under the category (or without one)
+// and clears them, atomically with respect to other users of the session.
+// It returns nil when there are none.
+func (s *Session) Flashes(category ...string) []interface{} {
+	s.mu.Lock()
+	val, ok := s.pop(flashKeyFor(category))
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	s.notifyChange()
+	flashes, _ := val.([]interface{})
+	return flashes
+}
+
+func flashKeyFor(category []string) string {
+	if len(category) > 0 && category[0] != "" {
+		return flashKey + ":" + category[0]
+	}
+	return flashKey
+}
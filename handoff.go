@@ -0,0 +1,87 @@
+package redissession
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// DefaultHandoffTTL is how long a token from Export stays importable unless
+// changed with WithHandoffTTL.
+const DefaultHandoffTTL = 30 * time.Second
+
+// handoffAAD seals handoff tokens. The NUL byte cannot occur in a cookie
+// name, so a handoff token never opens as a stored session or a cookie
+// value and vice versa, whatever names and deploy tags are in use.
+var handoffAAD = []byte("\x00handoff")
+
+type handoffToken struct {
+	Session json.RawMessage `json:"session"`
+	Expires int64           `json:"exp"`
+}
+
+// WithHandoffTTL sets how long a token from Export can be imported. Keep it
+// just long enough to cover a redirect; d <= 0 restores DefaultHandoffTTL.
+func (s *RedisStore) WithHandoffTTL(d time.Duration) *RedisStore {
+	s.handoffTTL = d
+	return s
+}
+
+// Export seals session into a self-contained token for handing it to a
+// service that does not share this store's Redis, typically as a redirect
+// parameter. The receiving store must use a Crypto with the same keys and
+// calls Import. The token expires after the handoff TTL regardless of the
+// session's own expiry, but can be replayed until then, so pass it only over
+// channels the client cannot leak, such as a POST or a URL fragment.
+func (s *RedisStore) Export(session *Session) (string, error) {
+	if err := validateCookieName(session.Name()); err != nil {
+		return "", err
+	}
+	data, err := s.crypto.marshal(session)
+	if err != nil {
+		return "", ErrEncryptionFailed
+	}
+	ttl := s.handoffTTL
+	if ttl <= 0 {
+		ttl = DefaultHandoffTTL
+	}
+	token := handoffToken{
+		Session: data,
+		Expires: time.Now().Add(ttl).UnixMilli(),
+	}
+	return s.crypto.EncryptAndSign(token, handoffAAD)
+}
+
+// Import opens a token from Export and stores the session it carries in
+// this store under a freshly generated ID, keeping its name, values, labels
+// and expiry. Any binding is dropped so the next Save binds the session to
+// the request in this service. The caller issues the cookie, usually by
+// calling Save with the returned session. Import fails with
+// ErrSessionExpired once the token's handoff TTL has passed.
+func (s *RedisStore) Import(ctx context.Context, token string) (*Session, error) {
+	var handoff handoffToken
+	if err := s.crypto.DecryptAndVerify(token, &handoff, handoffAAD); err != nil {
+		return nil, err
+	}
+	if time.Now().UnixMilli() > handoff.Expires {
+		return nil, ErrSessionExpired
+	}
+	var session Session
+	if err := s.crypto.unmarshal(handoff.Session, &session); err != nil {
+		return nil, ErrInvalidSessionData
+	}
+	if err := validateCookieName(session.Name()); err != nil {
+		return nil, ErrInvalidSessionData
+	}
+	id, err := s.crypto.GenerateSessionID()
+	if err != nil {
+		return nil, err
+	}
+	session.setID(id)
+	session.setIsNew(true)
+	session.binding = ""
+	if err := s.SaveCtx(ctx, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
@@ -0,0 +1,118 @@
+package redissession
+
+import (
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math/big"
+)
+
+// IDEncoding turns the random bytes of a session id into its text form.
+// Session ids appear in cookies and Redis keys, so an encoding must only
+// produce characters valid in both, and at most two per byte. Ids whose
+// Decode fails, or does not re-Encode to the same string, are rejected.
+type IDEncoding interface {
+	Encode(b []byte) string
+	Decode(s string) ([]byte, error)
+}
+
+var (
+	// Base64URLIDs is the default: 43 characters of unpadded base64url.
+	Base64URLIDs IDEncoding = stdIDEncoding{base64.RawURLEncoding}
+	// HexIDs is 64 lower-case hexadecimal characters.
+	HexIDs IDEncoding = hexIDEncoding{}
+	// Base32IDs is 52 characters of unpadded lower-case base32 (RFC 4648),
+	// only letters and the digits 2-7, for ids users copy by hand.
+	Base32IDs IDEncoding = stdIDEncoding{base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)}
+	// Base58IDs is the Bitcoin base58 alphabet, 43 or 44 characters without
+	// 0, O, I or l.
+	Base58IDs IDEncoding = base58IDEncoding{}
+)
+
+// WithIDEncoding sets the text form of the session ids GenerateSessionID
+// creates and ValidSessionID accepts; nil restores Base64URLIDs. The ids
+// keep their 256 bits of entropy in every encoding. Changing it invalidates
+// every existing session cookie, since ValidSessionID rejects ids in the
+// old form.
+func (c *Crypto) WithIDEncoding(enc IDEncoding) *Crypto {
+	c.idEncoding = enc
+	return c
+}
+
+func (c *Crypto) ids() IDEncoding {
+	if c.idEncoding == nil {
+		return Base64URLIDs
+	}
+	return c.idEncoding
+}
+
+type stdIDEncoding struct {
+	enc interface {
+		EncodeToString(src []byte) string
+		DecodeString(s string) ([]byte, error)
+	}
+}
+
+func (e stdIDEncoding) Encode(b []byte) string { return e.enc.EncodeToString(b) }
+
+func (e stdIDEncoding) Decode(s string) ([]byte, error) { return e.enc.DecodeString(s) }
+
+type hexIDEncoding struct{}
+
+func (hexIDEncoding) Encode(b []byte) string { return hex.EncodeToString(b) }
+
+func (hexIDEncoding) Decode(s string) ([]byte, error) { return hex.DecodeString(s) }
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var errBase58 = errors.New("invalid base58")
+
+type base58IDEncoding struct{}
+
+// Encode writes b as a big-endian base58 number, with one '1' per leading
+// zero byte so the length round-trips.
+func (base58IDEncoding) Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func (base58IDEncoding) Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	for i := 0; i < len(s); i++ {
+		d := -1
+		for j := 0; j < len(base58Alphabet); j++ {
+			if base58Alphabet[j] == s[i] {
+				d = j
+				break
+			}
+		}
+		if d < 0 {
+			return nil, errBase58
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(d)))
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
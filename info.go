@@ -0,0 +1,88 @@
+package redissession
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+)
+
+// SessionInfo is the read model of a session for admin tools and
+// monitoring, shared by Inspect, ListByLabelInfo and ListUserSessionInfo.
+// Values is only filled in when the caller asks for it, so listing sessions
+// does not spread their contents by default.
+type SessionInfo struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	CreatedAt time.Time     `json:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at"`
+	ExpiresAt time.Time     `json:"expires_at"`
+	TTL       time.Duration `json:"ttl"`
+	// UserID is set when the user index is enabled and the session has a
+	// user.
+	UserID string                 `json:"user_id,omitempty"`
+	Labels []string               `json:"labels,omitempty"`
+	Values map[string]interface{} `json:"values,omitempty"`
+}
+
+// Info describes session. TTL is the time left until ExpiresAt, never
+// negative. Values holds a shallow copy of the session's values if
+// includeValues is set.
+func (s *RedisStore) Info(session *Session, includeValues bool) SessionInfo {
+	session.mu.RLock()
+	info := SessionInfo{
+		ID:        session.id,
+		Name:      session.name,
+		CreatedAt: session.createdAt,
+		UpdatedAt: session.updatedAt,
+		ExpiresAt: session.expiresAt,
+		TTL:       max(time.Until(session.expiresAt), 0),
+		Labels:    slices.Clone(session.labels),
+	}
+	if includeValues {
+		info.Values = maps.Clone(session.values)
+	}
+	session.mu.RUnlock()
+	// The user id func reads the session through its own methods.
+	if id, ok := s.sessionUserID(session); ok {
+		info.UserID = id
+	}
+	return info
+}
+
+// Inspect describes the session called name with the given id. It reads the
+// session like Peek, so looking at it never changes it.
+func (s *RedisStore) Inspect(ctx context.Context, name, sessionID string, includeValues bool) (SessionInfo, error) {
+	session, err := s.Peek(ctx, name, sessionID)
+	if err != nil {
+		return SessionInfo{}, err
+	}
+	return s.Info(session, includeValues), nil
+}
+
+// ListByLabelInfo is ListByLabel returning a SessionInfo per session.
+func (s *RedisStore) ListByLabelInfo(ctx context.Context, label string, includeValues bool) ([]SessionInfo, error) {
+	sessions, err := s.ListByLabel(ctx, label)
+	if err != nil {
+		return nil, err
+	}
+	return s.infos(sessions, includeValues), nil
+}
+
+// ListUserSessionInfo is ListUserSessions returning a SessionInfo per
+// session.
+func (s *RedisStore) ListUserSessionInfo(ctx context.Context, userID string, includeValues bool) ([]SessionInfo, error) {
+	sessions, err := s.ListUserSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.infos(sessions, includeValues), nil
+}
+
+func (s *RedisStore) infos(sessions []*Session, includeValues bool) []SessionInfo {
+	infos := make([]SessionInfo, len(sessions))
+	for i, session := range sessions {
+		infos[i] = s.Info(session, includeValues)
+	}
+	return infos
+}
@@ -0,0 +1,95 @@
+package redissession
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Default prefix lengths for IPPrefixBinding: a /24 keeps IPv4 clients
+// behind small NAT pools bound, and a /64 is the smallest network a single
+// IPv6 site is normally assigned, so privacy addresses rotating within it
+// do not break sessions.
+const (
+	DefaultIPv4PrefixBits = 24
+	DefaultIPv6PrefixBits = 64
+)
+
+// IPPrefixBinding binds sessions to the network prefix of the client
+// address, as reported by ClientIP with trustedHops. IPv4 addresses
+// (including IPv4-mapped IPv6 ones) are truncated to ipv4Bits and IPv6
+// addresses to ipv6Bits; zero or negative lengths select the defaults and
+// lengths longer than the address keep the whole address. Requests whose
+// client address cannot be determined report no factor.
+func IPPrefixBinding(ipv4Bits, ipv6Bits, trustedHops int) BindingFunc {
+	ipv4Bits = prefixBits(ipv4Bits, DefaultIPv4PrefixBits, 32)
+	ipv6Bits = prefixBits(ipv6Bits, DefaultIPv6PrefixBits, 128)
+	return func(r *http.Request) (string, bool) {
+		addr, ok := ClientIP(r, trustedHops)
+		if !ok {
+			return "", false
+		}
+		bits := ipv6Bits
+		if addr.Is4() {
+			bits = ipv4Bits
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return "", false
+		}
+		return prefix.String(), true
+	}
+}
+
+func prefixBits(bits, def, max int) int {
+	switch {
+	case bits <= 0:
+		return def
+	case bits > max:
+		return max
+	}
+	return bits
+}
+
+// ClientIP returns the address of the client that sent r, trusting
+// trustedHops reverse proxies in front of the server. With no trusted hops
+// it is the peer in r.RemoteAddr and X-Forwarded-For is ignored, as any
+// client can set it. Otherwise the hops are taken to have each appended
+// the address they received the request from, so the client is the entry
+// trustedHops from the right of the X-Forwarded-For chain followed by
+// RemoteAddr; entries further left are client-controlled and never used.
+// Addresses may carry ports, brackets or zones; IPv4-mapped IPv6 addresses
+// are reported as IPv4. ok is false when the chain is shorter than
+// trustedHops or the chosen entry is not an address.
+func ClientIP(r *http.Request, trustedHops int) (netip.Addr, bool) {
+	chain := []string{r.RemoteAddr}
+	if trustedHops > 0 {
+		var forwarded []string
+		for _, header := range r.Header.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(header, ",") {
+				forwarded = append(forwarded, strings.TrimSpace(hop))
+			}
+		}
+		chain = append(forwarded, r.RemoteAddr)
+	}
+	i := len(chain) - 1 - trustedHops
+	if i < 0 {
+		return netip.Addr{}, false
+	}
+	return parseClientAddr(chain[i])
+}
+
+// parseClientAddr parses an address as found in RemoteAddr or
+// X-Forwarded-For: bare, bracketed, or with a port.
+func parseClientAddr(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
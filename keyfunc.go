@@ -0,0 +1,117 @@
+package redissession
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+)
+
+// KeyFunc builds the Redis key for the session called name with the given
+// id. Keys should begin with prefix: SCAN based operations (Sweep,
+// DestroyAll, ListNames) only look under it.
+type KeyFunc func(prefix, name, id string) string
+
+// KeyParser recovers name and id from a key built by the matching KeyFunc,
+// reporting ok=false for keys it does not recognise.
+type KeyParser func(prefix, key string) (name, id string, ok bool)
+
+// DefaultKeyFunc is the key layout used unless WithKeyFunc replaces it:
+// prefix + name + ":" + id.
+func DefaultKeyFunc(prefix, name, id string) string {
+	return prefix + name + ":" + id
+}
+
+func defaultKeyParser(prefix, key string) (name, id string, ok bool) {
+	rest, ok := strings.CutPrefix(key, prefix)
+	if !ok {
+		return "", "", false
+	}
+	i := strings.LastIndexByte(rest, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// WithKeyFunc replaces how session keys are built, e.g. to add a schema tag,
+// hash long names or wrap the name in a {hash tag} for Redis Cluster. Every
+// operation, including the label index, uses fn. parse must invert fn for
+// the operations that work from keys alone (Sweep, ListNames, ListByLabel,
+// ListUserSessions); with a nil parse, or a fn that cannot be inverted such
+// as a hash of the name, those operations skip every key. DestroyAll needs
+// no parse and deletes them regardless.
+// Changing the layout orphans sessions written under the previous one. A nil
+// fn restores the default layout.
+func (s *RedisStore) WithKeyFunc(fn KeyFunc, parse KeyParser) *RedisStore {
+	s.keyFunc = fn
+	if fn == nil {
+		s.keyParse = nil
+		return s
+	}
+	if parse == nil {
+		parse = func(string, string) (string, string, bool) { return "", "", false }
+	}
+	s.keyParse = parse
+	return s
+}
+
+func (s *RedisStore) redisKey(name string, sessionID string) string {
+	return s.keyUnder(s.prefix, name, sessionID)
+}
+
+func (s *RedisStore) keyUnder(prefix, name, sessionID string) string {
+	if s.keyFunc == nil {
+		return DefaultKeyFunc(prefix, name, sessionID)
+	}
+	return s.keyFunc(prefix, name, sessionID)
+}
+
+// parseKey splits a session key built by redisKey back into name and id.
+// The store's own index and revocation keys are never reported as sessions.
+func (s *RedisStore) parseKey(key string) (name, sessionID string, ok bool) {
+	if s.isIndexKey(key) {
+		return "", "", false
+	}
+	if s.keyParse == nil {
+		return defaultKeyParser(s.prefix, key)
+	}
+	return s.keyParse(s.prefix, key)
+}
+
+// isIndexKey reports whether key is one of the store's own index or
+// revocation keys rather than a session.
+func (s *RedisStore) isIndexKey(key string) bool {
+	return s.isIndexKeyUnder(s.prefix, key)
+}
+
+func (s *RedisStore) isIndexKeyUnder(prefix, key string) bool {
+	return strings.HasPrefix(key, prefix+labelKeyPart) ||
+		(s.userID != nil && strings.HasPrefix(key, prefix+userKeyPart)) ||
+		key == prefix+"revoked"
+}
+
+// WithHashedKeys stores each session under prefix + base64url(HMAC-SHA256(key,
+// name + ":" + id)) instead of the readable name and id, so anyone able to
+// list or MONITOR the keyspace cannot learn session names or ids. The cookie
+// still carries the plain id. key is taken separately from the Crypto keys
+// so rotating those does not move every session; changing key does, which
+// logs everyone out. A nil key restores the default layout.
+//
+// Hashed keys cannot be mapped back to a name, so Sweep, ListNames,
+// ListByLabel and ListUserSessions skip them (see WithKeyFunc), and
+// WithMaxUserIndexSize cannot rank them and never trims the index.
+// DestroyAll, DestroyByLabel and DestroyUserSessions still remove every
+// session, since they delete the stored keys directly; with WithShards each
+// indexed key is deleted on every backend.
+func (s *RedisStore) WithHashedKeys(key []byte) *RedisStore {
+	if key == nil {
+		return s.WithKeyFunc(nil, nil)
+	}
+	key = append([]byte(nil), key...)
+	return s.WithKeyFunc(func(prefix, name, id string) string {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(name + ":" + id))
+		return prefix + base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+	}, nil)
+}
@@ -0,0 +1,295 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Labels are arbitrary tags persisted with a session and indexed in Redis
+// with one set per label (prefix + "label:" + label) holding the keys of the
+// sessions that carry it. Because of that layout, "label" cannot be used as
+// a session name. Index entries are added on Save, removed on Destroy and
+// for expired sessions by Sweep.
+const labelKeyPart = "label:"
+
+func (s *Session) AddLabel(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if slices.Contains(s.labels, label) {
+		return
+	}
+	s.labels = append(s.labels, label)
+	if i := slices.Index(s.removedLabels, label); i >= 0 {
+		s.removedLabels = slices.Delete(s.removedLabels, i, i+1)
+	}
+	s.dirty = true
+}
+
+func (s *Session) RemoveLabel(label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := slices.Index(s.labels, label)
+	if i < 0 {
+		return
+	}
+	s.labels = slices.Delete(s.labels, i, i+1)
+	s.removedLabels = append(s.removedLabels, label)
+	s.dirty = true
+}
+
+func (s *Session) HasLabel(label string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Contains(s.labels, label)
+}
+
+func (s *Session) Labels() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.labels)
+}
+
+func (s *Session) labelChanges() (current, removed []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.labels), slices.Clone(s.removedLabels)
+}
+
+func (s *Session) clearRemovedLabels() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removedLabels = nil
+}
+
+func (s *RedisStore) labelKey(label string) string {
+	return s.prefix + labelKeyPart + label
+}
+
+func (s *RedisStore) isLabelKey(key string) bool {
+	return strings.HasPrefix(key, s.prefix+labelKeyPart)
+}
+
+// indexLabels must run after the session itself has been written under key.
+func (s *RedisStore) indexLabels(ctx context.Context, key string, current, removed []string) error {
+	if len(current) == 0 && len(removed) == 0 {
+		return nil
+	}
+	pipe := s.client.Pipeline()
+	for _, label := range current {
+		pipe.SAdd(ctx, s.labelKey(label), key)
+	}
+	for _, label := range removed {
+		pipe.SRem(ctx, s.labelKey(label), key)
+	}
+	_, err := pipe.Exec(ctx)
+	return redisError(ctx, err)
+}
+
+func (s *RedisStore) unindexLabels(ctx context.Context, session *Session, key string) error {
+	current, removed := session.labelChanges()
+	labels := append(current, removed...)
+	if len(labels) == 0 {
+		return nil
+	}
+	pipe := s.client.Pipeline()
+	for _, label := range labels {
+		pipe.SRem(ctx, s.labelKey(label), key)
+	}
+	_, err := pipe.Exec(ctx)
+	return redisError(ctx, err)
+}
+
+// ListByLabel loads every live session carrying label. Entries that no longer
+// exist or cannot be decrypted are skipped. Sessions are read as by Peek, so
+// listing them neither slides a Rolling TTL nor runs the OnLoad hook.
+func (s *RedisStore) ListByLabel(ctx context.Context, label string) ([]*Session, error) {
+	return s.listIndexed(ctx, s.labelKey(label), nil)
+}
+
+// ListByLabelWithErrors is ListByLabel, but also returns why each failed
+// entry was skipped, keyed by its Redis key. Sessions that are simply gone
+// are not reported.
+func (s *RedisStore) ListByLabelWithErrors(ctx context.Context, label string) ([]*Session, map[string]error, error) {
+	failed := make(map[string]error)
+	sessions, err := s.listIndexed(ctx, s.labelKey(label), failed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sessions, failed, nil
+}
+
+// DestroyByLabel deletes every session carrying label, along with the label's
+// index set, and returns how many sessions were removed. Each session is
+// destroyed as by DestroyCtx, including revocation and its other indexes.
+func (s *RedisStore) DestroyByLabel(ctx context.Context, label string) (int, error) {
+	return s.destroyIndexed(ctx, s.labelKey(label))
+}
+
+// listIndexed peeks at the sessions whose keys are members of the index set
+// setKey, skipping entries that no longer exist or cannot be decrypted. If
+// failed is non-nil, it receives the error for every skipped entry other
+// than a missing session.
+func (s *RedisStore) listIndexed(ctx context.Context, setKey string, failed map[string]error) ([]*Session, error) {
+	keys, err := s.client.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return nil, redisError(ctx, err)
+	}
+	sessions := make([]*Session, 0, len(keys))
+	for _, key := range keys {
+		name, id, ok := s.parseKey(key)
+		if !ok {
+			if failed != nil {
+				failed[key] = ErrInvalidSessionData
+			}
+			continue
+		}
+		session, err := s.Peek(ctx, name, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if failed != nil && !errors.Is(err, ErrSessionNotFound) {
+				failed[key] = err
+			}
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// destroyIndexed deletes the sessions listed in the index set setKey and the
+// set itself. Each session that can be read is removed as by DestroyCtx, so
+// it is revoked and dropped from its other label and user sets too. Members
+// that cannot be parsed or opened, such as hashed keys, are deleted directly
+// and revoked for their remaining TTL; their entries in other indexes are
+// left for Sweep to prune.
+func (s *RedisStore) destroyIndexed(ctx context.Context, setKey string) (int, error) {
+	keys, err := s.client.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return 0, redisError(ctx, err)
+	}
+	deleted := 0
+	for _, key := range keys {
+		if name, id, ok := s.parseKey(key); ok {
+			session, err := s.Peek(ctx, name, id)
+			switch {
+			case err == nil:
+				if err := s.DestroyCtx(ctx, session); err != nil {
+					return deleted, err
+				}
+				deleted++
+				continue
+			case errors.Is(err, ErrSessionNotFound):
+				continue
+			case ctx.Err() != nil:
+				return deleted, ctx.Err()
+			}
+		}
+		n, err := s.destroyKey(ctx, key)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	if err := s.client.Del(ctx, setKey).Err(); err != nil {
+		return deleted, redisError(ctx, err)
+	}
+	return deleted, nil
+}
+
+// destroyKey deletes a session key destroyIndexed could not open, on every
+// backend clientsForKey routes it to, and with revocation enabled revokes it
+// until its TTL would have run out.
+func (s *RedisStore) destroyKey(ctx context.Context, key string) (int, error) {
+	deleted := 0
+	for _, client := range s.clientsForKey(key) {
+		pipe := client.TxPipeline()
+		pttl := pipe.PTTL(ctx, key)
+		del := pipe.Del(ctx, key)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return deleted, redisError(ctx, err)
+		}
+		if del.Val() == 0 {
+			continue
+		}
+		deleted++
+		if s.revocation {
+			ttl, _ := keptTTL(pttl.Val())
+			if ttl == 0 {
+				ttl = time.Duration(s.options.MaxAge) * time.Second
+			}
+			if err := s.revoke(ctx, key, time.Now().Add(ttl)); err != nil {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// pruneLabels drops label and user index entries whose session key is gone.
+// A member whose existence could not be checked is kept, and the first such
+// error is returned once every set has been walked.
+func (s *RedisStore) pruneLabels(ctx context.Context) (int, error) {
+	pruned := 0
+	var setKeys []string
+	err := s.scanKeys(ctx, s.client, func(keys []string) error {
+		for _, key := range keys {
+			if s.isLabelKey(key) || s.isUserKey(key) {
+				setKeys = append(setKeys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var checkErr error
+	for _, setKey := range setKeys {
+		members, err := s.client.SMembers(ctx, setKey).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return pruned, redisError(ctx, err)
+		}
+		for _, member := range members {
+			exists, err := s.indexedKeyExists(ctx, member)
+			if err != nil {
+				if ctx.Err() != nil {
+					return pruned, ctx.Err()
+				}
+				if checkErr == nil {
+					checkErr = err
+				}
+				continue
+			}
+			if exists {
+				continue
+			}
+			if err := s.client.SRem(ctx, setKey, member).Err(); err != nil {
+				return pruned, redisError(ctx, err)
+			}
+			pruned++
+		}
+	}
+	return pruned, redisError(ctx, checkErr)
+}
+
+// indexedKeyExists reports whether the session key an index member names is
+// still stored, on the backend clientsForKey routes it to, so members that
+// cannot be parsed, such as hashed keys, are checked too.
+func (s *RedisStore) indexedKeyExists(ctx context.Context, key string) (bool, error) {
+	for _, client := range s.clientsForKey(key) {
+		n, err := client.Exists(ctx, key).Result()
+		if err != nil {
+			return false, err
+		}
+		if n == 1 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
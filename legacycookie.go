@@ -0,0 +1,66 @@
+package redissession
+
+import (
+	"context"
+	"net/http"
+)
+
+// WithLegacyCookieNames lets a session cookie be renamed, e.g. from "sid" to
+// "__Host-sid", without logging everyone out. When a request has no cookie
+// under the name passed to New, New tries each of names in order and, if one
+// loads, returns that session under the new name. The next Save writes it
+// under the new name, deletes the copy stored under the legacy one and
+// expires the legacy cookie, so each user moves over on their first saved
+// request. Destroy clears both. SaveAsync writes the new copy but leaves the
+// legacy one and its cookie to expire on their own, since the write may not
+// have landed yet. Drop the legacy names once the longest session lifetime
+// has passed.
+func (s *RedisStore) WithLegacyCookieNames(names ...string) *RedisStore {
+	s.legacyNames = names
+	return s
+}
+
+// openLegacy opens the session for the first legacy cookie r carries that
+// loads, renamed to name. It returns nil if none does.
+func (s *RedisStore) openLegacy(r *http.Request, name string) *Session {
+	for _, legacy := range s.legacyNames {
+		id := cookieValue(r, legacy)
+		if legacy == name || id == "" || !s.crypto.ValidSessionID(id) {
+			continue
+		}
+		session, err := s.load(r.Context(), legacy, id)
+		if err != nil {
+			continue
+		}
+		session.setIsNew(false)
+		session.setName(name)
+		session.mu.Lock()
+		session.legacyName = legacy
+		session.dirty = true
+		session.mu.Unlock()
+		return session
+	}
+	return nil
+}
+
+// retireLegacy deletes the copy of session stored under the legacy name it
+// was opened from, and expires the legacy cookie on w. It must only run
+// once the session is saved under its new name and that cookie is set.
+func (s *RedisStore) retireLegacy(ctx context.Context, w http.ResponseWriter, session *Session) error {
+	session.mu.Lock()
+	legacy := session.legacyName
+	session.legacyName = ""
+	session.mu.Unlock()
+	if legacy == "" {
+		return nil
+	}
+	http.SetCookie(w, s.options.RemoveCookie(legacy))
+	key := s.redisKey(legacy, session.ID())
+	if err := s.clientFor(legacy, session.ID()).Del(ctx, key).Err(); err != nil {
+		return redisError(ctx, err)
+	}
+	if err := s.unindexLabels(ctx, session, key); err != nil {
+		return err
+	}
+	return s.unindexUser(ctx, session, key)
+}
@@ -0,0 +1,114 @@
+package redissession
+
+import (
+	"slices"
+	"sort"
+)
+
+// ValueLimitPolicy decides what happens when a session holds more values
+// than the store's configured maximum.
+type ValueLimitPolicy int
+
+const (
+	// RejectExtraValues keeps every Set but makes Save fail with
+	// ErrTooManyValues while the session is over the limit. A stored session
+	// that is already over the limit is treated as invalid on load.
+	RejectExtraValues ValueLimitPolicy = iota
+	// EvictOldestValues drops the least recently added key when Set adds a
+	// key beyond the limit. Insertion order is not persisted: keys present
+	// when a session is loaded count as older than any set afterwards, in
+	// key order.
+	EvictOldestValues
+)
+
+// WithMaxValues caps the number of values per session. Zero disables the
+// limit.
+func (s *RedisStore) WithMaxValues(n int, policy ValueLimitPolicy) *RedisStore {
+	s.maxValues = n
+	s.valuePolicy = policy
+	return s
+}
+
+func (s *Session) applyValueLimit(max int, policy ValueLimitPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxValues = max
+	s.evictValues = policy == EvictOldestValues
+	s.order = nil
+	if max <= 0 {
+		return nil
+	}
+	if !s.evictValues {
+		if len(s.values) > max {
+			return ErrTooManyValues
+		}
+		return nil
+	}
+	s.order = make([]string, 0, len(s.values))
+	for k := range s.values {
+		s.order = append(s.order, k)
+	}
+	sort.Strings(s.order)
+	for len(s.order) > max {
+		delete(s.values, s.order[0])
+		s.order = s.order[1:]
+	}
+	return nil
+}
+
+// trackKey must be called with the write lock held, before key is stored.
+func (s *Session) trackKey(key string) {
+	if s.maxValues <= 0 || !s.evictValues {
+		return
+	}
+	if _, exists := s.values[key]; exists {
+		return
+	}
+	for len(s.order) >= s.maxValues {
+		delete(s.values, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.order = append(s.order, key)
+}
+
+// untrackKey must be called with the write lock held.
+func (s *Session) untrackKey(key string) {
+	if i := slices.Index(s.order, key); i >= 0 {
+		s.order = slices.Delete(s.order, i, i+1)
+	}
+}
+
+// reconcileOrder brings the eviction order in line with values after they
+// were edited directly; keys that appeared count as the newest, in key order.
+// It must be called with the write lock held.
+func (s *Session) reconcileOrder() {
+	if s.maxValues <= 0 || !s.evictValues {
+		return
+	}
+	known := make(map[string]bool, len(s.order))
+	kept := s.order[:0]
+	for _, k := range s.order {
+		if _, ok := s.values[k]; ok {
+			kept = append(kept, k)
+			known[k] = true
+		}
+	}
+	var added []string
+	for k := range s.values {
+		if !known[k] {
+			added = append(added, k)
+		}
+	}
+	sort.Strings(added)
+	s.order = append(kept, added...)
+	for len(s.order) > s.maxValues {
+		delete(s.values, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+func (s *Session) overValueLimit() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxValues > 0 && len(s.values) > s.maxValues
+}
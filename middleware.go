@@ -0,0 +1,181 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// ResponseWriter tracks whether the response headers have been sent so that
+// Save can report a session cookie that would otherwise be silently dropped.
+// It also runs an optional hook right before the headers are committed,
+// which the middleware uses to write the session cookie in time.
+type ResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+	failed      bool
+	beforeWrite func() error
+}
+
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	if rw, ok := w.(*ResponseWriter); ok {
+		return rw
+	}
+	return &ResponseWriter{ResponseWriter: w}
+}
+
+func (w *ResponseWriter) HeaderWritten() bool {
+	return w.wroteHeader
+}
+
+func (w *ResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if !w.commit() {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *ResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.failed {
+		return
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *ResponseWriter) commit() bool {
+	hook := w.beforeWrite
+	w.beforeWrite = nil
+	if hook != nil {
+		if err := hook(); err != nil {
+			w.wroteHeader = true
+			w.failed = true
+			http.Error(w.ResponseWriter, http.StatusText(errorStatus(err)), errorStatus(err))
+			return false
+		}
+	}
+	w.wroteHeader = true
+	return true
+}
+
+func headersWritten(w http.ResponseWriter) bool {
+	for w != nil {
+		if hw, ok := w.(interface{ HeaderWritten() bool }); ok && hw.HeaderWritten() {
+			return true
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return false
+		}
+		w = u.Unwrap()
+	}
+	return false
+}
+
+// Middleware loads the session called name, makes it and the store available
+// through the request context, and saves it right before the response headers
+// are sent so the cookie is never lost to an early Write or Flush. If the save
+// fails the client receives a 500 (503 when the session budget ran out) and
+// the handler's output is discarded.
+func (s *RedisStore) Middleware(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r = WithStore(r, s)
+			sr := r
+			if s.budget > 0 {
+				ctx, cancel := s.WithDeadline(r.Context(), s.budget)
+				defer cancel()
+				sr = r.WithContext(ctx)
+			}
+			session, err := s.New(sr, name)
+			if err != nil {
+				http.Error(w, http.StatusText(errorStatus(err)), errorStatus(err))
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), sessionContextKey{}, session))
+			// The handler's context, not sr's, which carries the budget
+			// meant only for store calls.
+			session.SetContext(r.Context())
+
+			rw := &ResponseWriter{ResponseWriter: w}
+			rw.beforeWrite = func() error {
+				return s.Save(sr, rw, session)
+			}
+			next.ServeHTTP(rw, r)
+			if !rw.wroteHeader {
+				rw.WriteHeader(http.StatusOK)
+			}
+		})
+	}
+}
+
+// Handler wraps h in Middleware(name), for registering handler functions on
+// an http.ServeMux pattern directly:
+//
+//	mux.Handle("GET /cart/{id}", store.Handler("app_session", func(w http.ResponseWriter, r *http.Request) {
+//		sess := redissession.MustCurrent(r)
+//		sess.Set("last_cart", r.PathValue("id"))
+//		fmt.Fprintln(w, "ok")
+//	}))
+//
+// The session is saved automatically before the response is written, so
+// handlers neither pass the store around nor call Save. To cover a whole
+// mux, wrap the mux itself with Middleware instead.
+func (s *RedisStore) Handler(name string, h http.HandlerFunc) http.Handler {
+	return s.Middleware(name)(h)
+}
+
+func errorStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+type sessionContextKey struct{}
+
+func GetSession(r *http.Request) (*Session, error) {
+	if session, ok := r.Context().Value(sessionContextKey{}).(*Session); ok {
+		return session, nil
+	}
+	return nil, ErrSessionNotFound
+}
+
+// Current returns the session Middleware or Handler attached to r, or nil if
+// the request did not pass through either.
+func Current(r *http.Request) *Session {
+	session, _ := GetSession(r)
+	return session
+}
+
+// MustCurrent is like Current but panics if there is no session, which
+// indicates the handler was registered without the middleware.
+func MustCurrent(r *http.Request) *Session {
+	session := Current(r)
+	if session == nil {
+		panic("redissession: no session in request context; wrap the handler with RedisStore.Middleware or RedisStore.Handler")
+	}
+	return session
+}
@@ -0,0 +1,30 @@
+package redissession
+
+import "github.com/redis/go-redis/v9"
+
+// WithReadReplica serves session reads that do not write (load in Fixed
+// mode, Peek, Exists and TypedStore loads) from replica, so the primary only
+// takes writes. Rolling loads stay on the primary because they slide the TTL.
+// Sessions routed to a shard by WithShards always use that shard.
+//
+// Replicas lag: a session saved a moment ago may not be there yet, or only
+// in an older version. A miss on the replica is therefore retried on the
+// primary, so a session just created (say, right after login) is always
+// found, but a recent update can still be read stale until replication
+// catches up. Paths that must see their own writes, such as SetIfAbsent,
+// Reseal and the label and user indexes, always use the primary. A nil
+// replica turns this off.
+func (s *RedisStore) WithReadReplica(replica *redis.Client) *RedisStore {
+	s.replica = replica
+	return s
+}
+
+// readClients returns the clients to try, in order, for a read of the
+// session called name with the given id.
+func (s *RedisStore) readClients(name, sessionID string) []*redis.Client {
+	client := s.clientFor(name, sessionID)
+	if s.replica == nil || client != s.client {
+		return []*redis.Client{client}
+	}
+	return []*redis.Client{s.replica, client}
+}
@@ -0,0 +1,92 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WithRetry makes Save (and SaveCtx, SaveAsync) and RotateID retry their
+// Redis writes up to attempts times in total when the failure looks
+// transient: refused or reset connections, network timeouts, and servers
+// that are loading, read-only or failing over. The wait doubles from
+// baseDelay after each failure. Retries stop early once the context is done
+// or its deadline would pass during the next wait. Encryption failures,
+// redis.Nil and other command errors are never retried. attempts <= 1
+// disables retrying.
+func (s *RedisStore) WithRetry(attempts int, baseDelay time.Duration) *RedisStore {
+	s.retryAttempts = attempts
+	s.retryDelay = baseDelay
+	return s
+}
+
+// retry runs op, retrying it according to WithRetry while it fails with a
+// transient error. The last error is returned unchanged.
+func (s *RedisStore) retry(ctx context.Context, op func() error) error {
+	delay := s.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= s.retryAttempts || !retryableError(err) {
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func retryableError(err error) bool {
+	switch {
+	case errors.Is(err, redis.Nil),
+		errors.Is(err, redis.ErrClosed),
+		errors.Is(err, context.Canceled),
+		errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout()
+	}
+	msg := err.Error()
+	for _, prefix := range []string{"LOADING ", "READONLY ", "MASTERDOWN ", "CLUSTERDOWN ", "TRYAGAIN "} {
+		if strings.HasPrefix(msg, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// unavailableError reports whether err means Redis could not serve the
+// command at all, as opposed to a reply such as redis.Nil or a command error.
+func unavailableError(err error) bool {
+	switch {
+	case errors.Is(err, ErrStoreUnavailable):
+		return false
+	case errors.Is(err, redis.ErrClosed),
+		errors.Is(err, redis.ErrPoolTimeout),
+		errors.Is(err, redis.ErrPoolExhausted):
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || retryableError(err)
+}
@@ -0,0 +1,63 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WithRevocationList enables a Redis denylist (a sorted set scored by expiry)
+// that Destroy adds to and load consults before reading the session, so a
+// destroyed id is rejected immediately on every node even if a copy of its
+// payload survives elsewhere. It costs one extra round trip per load.
+func (s *RedisStore) WithRevocationList(enabled bool) *RedisStore {
+	s.revocation = enabled
+	return s
+}
+
+// WithMinCreatedAt rejects, with ErrSessionRevoked, every session created
+// before the time fn returns, e.g. to log everyone out after a breach
+// without scanning Redis. fn runs on every load, so it can read a value that
+// is changed at runtime; returning the zero time disables the check. The
+// rejected sessions are left in Redis to expire on their own.
+func (s *RedisStore) WithMinCreatedAt(fn func() time.Time) *RedisStore {
+	s.minCreatedAt = fn
+	return s
+}
+
+func (s *RedisStore) issuedTooEarly(createdAt time.Time) bool {
+	if s.minCreatedAt == nil {
+		return false
+	}
+	return createdAt.Before(s.minCreatedAt())
+}
+
+func (s *RedisStore) revokedKey() string {
+	return s.prefix + "revoked"
+}
+
+func (s *RedisStore) revoke(ctx context.Context, key string, expiresAt time.Time) error {
+	now := time.Now()
+	if !expiresAt.After(now) {
+		return nil
+	}
+	pipe := s.client.TxPipeline()
+	pipe.ZAdd(ctx, s.revokedKey(), redis.Z{Score: float64(expiresAt.UnixMilli()), Member: key})
+	pipe.ZRemRangeByScore(ctx, s.revokedKey(), "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	_, err := pipe.Exec(ctx)
+	return redisError(ctx, err)
+}
+
+func (s *RedisStore) isRevoked(ctx context.Context, key string) (bool, error) {
+	score, err := s.client.ZScore(ctx, s.revokedKey(), key).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return false, nil
+		}
+		return false, err
+	}
+	return int64(score) > time.Now().UnixMilli(), nil
+}
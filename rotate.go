@@ -0,0 +1,72 @@
+package redissession
+
+import (
+	"slices"
+	"time"
+)
+
+type rotateMode int
+
+const (
+	rotateKeepAll rotateMode = iota
+	rotateDrop
+	rotateKeepOnly
+)
+
+// RotatePolicy chooses which values a session carries across RotateID. The
+// zero value keeps all of them.
+type RotatePolicy struct {
+	mode rotateMode
+	keys []string
+}
+
+// KeepAllValues carries every value into the rotated session.
+func KeepAllValues() RotatePolicy {
+	return RotatePolicy{}
+}
+
+// DropValues removes keys, e.g. a login CSRF nonce or OAuth state, before
+// the session is written under its new id.
+func DropValues(keys ...string) RotatePolicy {
+	return RotatePolicy{mode: rotateDrop, keys: slices.Clone(keys)}
+}
+
+// KeepOnlyValues removes every value except keys.
+func KeepOnlyValues(keys ...string) RotatePolicy {
+	return RotatePolicy{mode: rotateKeepOnly, keys: slices.Clone(keys)}
+}
+
+// WithRotatePolicy makes RotateID apply policy to the session's values before
+// writing it under the new id, so pre-authentication state does not cross
+// into the authenticated session. Values removed this way stay removed even
+// if the rotation fails.
+func (s *RedisStore) WithRotatePolicy(policy RotatePolicy) *RedisStore {
+	s.rotatePolicy = policy
+	return s
+}
+
+// WithRotatePolicy is the CookieStore counterpart of RedisStore.WithRotatePolicy.
+func (s *CookieStore) WithRotatePolicy(policy RotatePolicy) *CookieStore {
+	s.rotatePolicy = policy
+	return s
+}
+
+func (p RotatePolicy) apply(session *Session) {
+	if p.mode == rotateKeepAll {
+		return
+	}
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	changed := false
+	for k := range session.values {
+		if slices.Contains(p.keys, k) == (p.mode == rotateDrop) {
+			delete(session.values, k)
+			session.untrackKey(k)
+			changed = true
+		}
+	}
+	if changed {
+		session.updatedAt = time.Now()
+		session.dirty = true
+	}
+}
@@ -1,8 +1,14 @@
 package redissession
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -16,6 +22,47 @@ type Session struct {
 	createdAt time.Time
 	updatedAt time.Time
 	expiresAt time.Time
+	sameSite  http.SameSite
+	binding   string
+	saveCount uint64
+
+	// ctx is the request context the session was opened for; it is never
+	// serialized.
+	ctx context.Context
+
+	// transient holds per-request values that are never serialized; see
+	// SetTransient.
+	transient map[string]interface{}
+
+	dirty bool
+
+	// onChange is called after a value mutation; see SetOnChange.
+	onChange func()
+
+	// duplicateCookies is set when the request carried stale copies of the
+	// session cookie for Save to remove; see WithDuplicateCookieRecovery.
+	duplicateCookies bool
+
+	// destroyed is set once DestroyCtx has removed the session, so writes
+	// SaveAsync queued before it are dropped.
+	destroyed bool
+
+	// legacyName is the old cookie name the session was opened from; see
+	// WithLegacyCookieNames.
+	legacyName string
+
+	// cookieID and cookieExpires describe the session cookie the client was
+	// last sent, for CookieOnChange. cookieExpires is serialized; cookieID
+	// is set when the session is opened from a matching request cookie.
+	cookieID      string
+	cookieExpires time.Time
+
+	labels        []string
+	removedLabels []string
+
+	maxValues   int
+	evictValues bool
+	order       []string
 }
 
 func NewSession(id string, maxAge time.Duration) *Session {
@@ -30,6 +77,16 @@ func NewSession(id string, maxAge time.Duration) *Session {
 	}
 }
 
+// NewSessionWithValues is like NewSession but seeds the values in one step.
+// values is copied, so later changes to it do not affect the session.
+func NewSessionWithValues(id string, maxAge time.Duration, values map[string]interface{}) *Session {
+	s := NewSession(id, maxAge)
+	for k, v := range values {
+		s.values[k] = v
+	}
+	return s
+}
+
 func (s *Session) ID() string {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -66,14 +123,29 @@ func (s *Session) ExpiresAt() time.Time {
 	return s.expiresAt
 }
 
+// TTLSeconds returns the whole seconds left until the session expires, or 0
+// once it has, for clients that schedule a refresh ahead of expiry. It is
+// derived from ExpiresAt alone and never touches Redis. WithExpiresInHeader
+// sends it on every save; a companion cookie claim is another option.
+func (s *Session) TTLSeconds() int {
+	left := time.Until(s.ExpiresAt())
+	if left <= 0 {
+		return 0
+	}
+	return int(left.Seconds())
+}
+
 func (s *Session) Set(key string, val interface{}) {
+	defer s.notifyChange()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.values == nil {
 		s.values = make(map[string]interface{})
 	}
+	s.trackKey(key)
 	s.values[key] = val
 	s.updatedAt = time.Now()
+	s.dirty = true
 }
 
 func (s *Session) Get(key string) interface{} {
@@ -82,11 +154,163 @@ func (s *Session) Get(key string) interface{} {
 	return s.values[key]
 }
 
+// GetBytes returns a []byte value. Values that went through a save/load cycle
+// come back as the base64 string encoding/json produced, which is decoded here.
+func (s *Session) GetBytes(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	switch v := s.values[key].(type) {
+	case []byte:
+		return v, true
+	case string:
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return nil, false
+		}
+		return b, true
+	}
+	return nil, false
+}
+
+// GetDefault returns the value stored under key, or fallback if there is
+// none.
+func (s *Session) GetDefault(key string, fallback interface{}) interface{} {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	return fallback
+}
+
+// GetStringDefault returns the string stored under key, or def if the key
+// is missing or holds another type.
+func (s *Session) GetStringDefault(key, def string) string {
+	if v, ok := s.GetDefault(key, nil).(string); ok {
+		return v
+	}
+	return def
+}
+
+// GetBoolDefault returns the bool stored under key, or def if the key is
+// missing or holds another type.
+func (s *Session) GetBoolDefault(key string, def bool) bool {
+	if v, ok := s.GetDefault(key, nil).(bool); ok {
+		return v
+	}
+	return def
+}
+
+// GetIntDefault returns the integer stored under key, or def if the key is
+// missing or does not hold a whole number that fits an int. Numbers that
+// went through a save/load cycle come back as float64 and are converted.
+func (s *Session) GetIntDefault(key string, def int) int {
+	if v, ok := toInt64(s.GetDefault(key, nil)); ok && int64(int(v)) == v {
+		return int(v)
+	}
+	return def
+}
+
+// GetInt64Default is GetIntDefault for int64.
+func (s *Session) GetInt64Default(key string, def int64) int64 {
+	if v, ok := toInt64(s.GetDefault(key, nil)); ok {
+		return v
+	}
+	return def
+}
+
+// GetFloat64Default returns the number stored under key as a float64, or
+// def if the key is missing or does not hold a number.
+func (s *Session) GetFloat64Default(key string, def float64) float64 {
+	switch v := s.GetDefault(key, nil).(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			return int64(v), true
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// Update runs fn with direct access to the values map under a single write
+// lock, so multi-key read-modify-write sequences are atomic with respect to
+// other users of the session. fn must not retain the map or call other
+// Session methods.
+func (s *Session) Update(fn func(values map[string]interface{})) {
+	defer s.notifyChange()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	fn(s.values)
+	s.reconcileOrder()
+	s.updatedAt = time.Now()
+	s.dirty = true
+}
+
 func (s *Session) Delete(key string) {
+	defer s.notifyChange()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	delete(s.values, key)
+	s.untrackKey(key)
 	s.updatedAt = time.Now()
+	s.dirty = true
+}
+
+// RenameKey moves the value stored under old to newKey, for renaming a key
+// across the app without reading both names everywhere. A value already
+// under newKey is overwritten. It reports whether a value moved; if old is
+// absent, or equal to newKey, the session is left untouched.
+func (s *Session) RenameKey(old, newKey string) (moved bool) {
+	defer func() {
+		if moved {
+			s.notifyChange()
+		}
+	}()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	val, ok := s.values[old]
+	if !ok || old == newKey {
+		return false
+	}
+	delete(s.values, old)
+	s.untrackKey(old)
+	delete(s.values, newKey)
+	s.untrackKey(newKey)
+	s.trackKey(newKey)
+	s.values[newKey] = val
+	s.updatedAt = time.Now()
+	s.dirty = true
+	return true
 }
 
 func (s *Session) Refresh(maxAge time.Duration) {
@@ -95,6 +319,7 @@ func (s *Session) Refresh(maxAge time.Duration) {
 	now := time.Now()
 	s.expiresAt = now.Add(maxAge)
 	s.updatedAt = now
+	s.dirty = true
 }
 
 func (s *Session) Extend(delta time.Duration) {
@@ -102,18 +327,182 @@ func (s *Session) Extend(delta time.Duration) {
 	defer s.mu.Unlock()
 	s.expiresAt = s.expiresAt.Add(delta)
 	s.updatedAt = time.Now()
+	s.dirty = true
+}
+
+// Snapshot returns a stable serialization of the session's values and expiry
+// for change detection: take one before the handler runs and compare it with
+// one taken afterwards using SnapshotChanged. Unlike a dirty flag this also
+// ignores writes that store a value equal to the existing one, at the cost of
+// marshaling the values twice per request. It returns nil if the values cannot
+// be marshaled.
+func (s *Session) Snapshot() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b, err := json.Marshal(struct {
+		Values    map[string]interface{} `json:"values"`
+		ExpiresAt time.Time              `json:"expires_at"`
+	}{s.values, s.expiresAt})
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// SnapshotChanged reports whether two snapshots differ. A nil snapshot is
+// always treated as changed.
+func SnapshotChanged(before, after []byte) bool {
+	if before == nil || after == nil {
+		return true
+	}
+	return !bytes.Equal(before, after)
+}
+
+// SetExpiresAt pins the expiry to an exact time, e.g. to line it up with an
+// external token. Save derives the Redis TTL from it and rejects times in the
+// past with ErrSessionExpired.
+func (s *Session) SetExpiresAt(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiresAt = t
+	s.updatedAt = time.Now()
+	s.dirty = true
+}
+
+// SetSameSite overrides the cookie options' SameSite mode for this session's
+// cookie. The choice is stored with the session and the cookie is re-issued
+// with it on the next Save, so a session can start out Lax, to survive the
+// cross-site redirect back from an OAuth provider, and be upgraded to Strict
+// once login completes. Zero falls back to the store's CookieOptions.
+func (s *Session) SetSameSite(mode http.SameSite) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sameSite = mode
+	s.dirty = true
+}
+
+// SameSite returns the mode set by SetSameSite, or zero if the session uses
+// the store default.
+func (s *Session) SameSite() http.SameSite {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sameSite
+}
+
+// IsDirty reports whether the session was modified since it was created,
+// loaded or last saved.
+func (s *Session) IsDirty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dirty
+}
+
+// Context returns the context attached with SetContext, normally the
+// request the session was opened for, so value loaders and hooks can honour
+// its cancellation and deadline. It is context.Background() if none is set.
+func (s *Session) Context() context.Context {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// SetContext attaches ctx to the session for Context. New and the
+// middleware set it to the request's context.
+func (s *Session) SetContext(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+}
+
+// SetTransient attaches val to the session under key for the rest of the
+// request only, for derived data such as the loaded user or computed
+// permissions. Transient values live apart from the session's values: they
+// are never serialized or saved, do not mark the session dirty and are gone
+// once the session is loaded again. A nil val removes key.
+func (s *Session) SetTransient(key string, val interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if val == nil {
+		delete(s.transient, key)
+		return
+	}
+	if s.transient == nil {
+		s.transient = make(map[string]interface{})
+	}
+	s.transient[key] = val
+}
+
+// GetTransient returns the value SetTransient attached under key.
+func (s *Session) GetTransient(key string) (interface{}, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.transient[key]
+	return val, ok
+}
+
+// SetOnChange registers fn to be called after every mutation of the
+// session's values (Set, Delete, Update, RenameKey, Pop and the flash
+// helpers), e.g. to schedule a save. fn runs synchronously on the mutating
+// goroutine once the session lock has been released, so it may read the
+// session or call Save; mutating the session from fn calls it again, so guard
+// against unbounded recursion. Expiry changes and saves do not trigger it.
+// Passing nil removes the callback. It is not serialized.
+func (s *Session) SetOnChange(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+}
+
+// notifyChange must be called without the lock held.
+func (s *Session) notifyChange() {
+	s.mu.RLock()
+	fn := s.onChange
+	s.mu.RUnlock()
+	if fn != nil {
+		fn()
+	}
+}
+
+// SaveCount reports how many times the session has been written to the
+// store, including the write that stored the copy it was loaded from. It is a
+// debugging aid: comparing it against the saves a request is expected to
+// make exposes double saves and lost updates.
+func (s *Session) SaveCount() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.saveCount
+}
+
+// isEmpty reports whether the session holds no values and no label state.
+func (s *Session) isEmpty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.values) == 0 && len(s.labels) == 0 && len(s.removedLabels) == 0
 }
 
 func (s *Session) Save(r *http.Request, w http.ResponseWriter) error {
-	store, err := GetStore(r)
+	store, err := GetSessionStore(r)
 	if err != nil {
 		return err
 	}
 	return store.Save(r, w, s)
 }
 
+// PersistCtx saves the session to Redis using the store attached to ctx with
+// ContextWithStore. No cookie is written.
+func (s *Session) PersistCtx(ctx context.Context) error {
+	store, err := StoreFromContext(ctx)
+	if err != nil {
+		return err
+	}
+	return store.SaveCtx(ctx, s)
+}
+
 func (s *Session) RotateID(r *http.Request, w http.ResponseWriter) error {
-	store, err := GetStore(r)
+	store, err := GetSessionStore(r)
 	if err != nil {
 		return err
 	}
@@ -121,7 +510,7 @@ func (s *Session) RotateID(r *http.Request, w http.ResponseWriter) error {
 }
 
 func (s *Session) Destroy(r *http.Request, w http.ResponseWriter) error {
-	store, err := GetStore(r)
+	store, err := GetSessionStore(r)
 	if err != nil {
 		return err
 	}
@@ -140,19 +529,85 @@ func (s *Session) setIsNew(v bool) {
 	s.isNew = v
 }
 
+func (s *Session) markClean() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty = false
+}
+
+func (s *Session) markDestroyed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.destroyed = true
+}
+
+func (s *Session) isDestroyed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.destroyed
+}
+
+func (s *Session) setExpiresAt(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expiresAt = t
+}
+
 func (s *Session) setID(id string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.id = id
 }
 
+func (s *Session) setSaveCount(n uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saveCount = n
+}
+
 type sessionDTO struct {
 	ID        string                 `json:"id"`
 	Name      string                 `json:"name"`
 	Values    map[string]interface{} `json:"values"`
-	CreatedAt time.Time              `json:"created_at"`
-	UpdatedAt time.Time              `json:"updated_at"`
-	ExpiresAt time.Time              `json:"expires_at"`
+	CreatedAt dtoTime                `json:"created_at"`
+	UpdatedAt dtoTime                `json:"updated_at"`
+	ExpiresAt dtoTime                `json:"expires_at"`
+	Labels    []string               `json:"labels,omitempty"`
+	SameSite  http.SameSite          `json:"same_site,omitempty"`
+	Binding   string                 `json:"binding,omitempty"`
+	SaveCount uint64                 `json:"save_count,omitempty"`
+	// CookieExpires is in Unix milliseconds.
+	CookieExpires int64 `json:"cookie_expires,omitempty"`
+}
+
+// dtoTime is a timestamp in a session payload. It is written as an RFC 3339
+// string, or as Unix milliseconds when unix is set, and either form is
+// accepted when reading.
+type dtoTime struct {
+	time.Time
+	unix bool
+}
+
+func (t dtoTime) MarshalJSON() ([]byte, error) {
+	if t.unix {
+		return strconv.AppendInt(nil, t.UnixMilli(), 10), nil
+	}
+	return t.Time.MarshalJSON()
+}
+
+func (t *dtoTime) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return t.Time.UnmarshalJSON(b)
+	}
+	if string(b) == "null" {
+		return nil
+	}
+	ms, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %s: %w", b, err)
+	}
+	t.Time = time.UnixMilli(ms)
+	return nil
 }
 
 var (
@@ -161,25 +616,57 @@ var (
 )
 
 func (s *Session) MarshalJSON() ([]byte, error) {
+	return s.marshalWith(json.Marshal, false, nil)
+}
+
+func (s *Session) UnmarshalJSON(b []byte) error {
+	return s.unmarshalWith(b, json.Unmarshal, nil)
+}
+
+// marshalWith encodes the session with marshal, writing timestamps as Unix
+// milliseconds instead of RFC 3339 strings if unixTimes is set and passing
+// each value through transformer's Encode if it is non-nil.
+func (s *Session) marshalWith(marshal func(v interface{}) ([]byte, error), unixTimes bool, transformer ValueTransformer) ([]byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	values := s.values
+	if transformer != nil {
+		var err error
+		if values, err = transformValues(values, transformer.Encode); err != nil {
+			return nil, err
+		}
+	}
 	dto := sessionDTO{
 		ID:        s.id,
 		Name:      s.name,
-		Values:    s.values,
-		CreatedAt: s.createdAt,
-		UpdatedAt: s.updatedAt,
-		ExpiresAt: s.expiresAt,
+		Values:    values,
+		CreatedAt: dtoTime{s.createdAt, unixTimes},
+		UpdatedAt: dtoTime{s.updatedAt, unixTimes},
+		ExpiresAt: dtoTime{s.expiresAt, unixTimes},
+		Labels:    s.labels,
+		SameSite:  s.sameSite,
+		Binding:   s.binding,
+		SaveCount: s.saveCount,
+	}
+	if !s.cookieExpires.IsZero() {
+		dto.CookieExpires = s.cookieExpires.UnixMilli()
 	}
-	return json.Marshal(&dto)
+	return marshal(&dto)
 }
 
-func (s *Session) UnmarshalJSON(b []byte) error {
+func (s *Session) unmarshalWith(b []byte, unmarshal func(data []byte, v interface{}) error, transformer ValueTransformer) error {
 	var dto sessionDTO
-	if err := json.Unmarshal(b, &dto); err != nil {
+	if err := unmarshal(b, &dto); err != nil {
 		return err
 	}
+	if transformer != nil && dto.Values != nil {
+		values, err := transformValues(dto.Values, transformer.Decode)
+		if err != nil {
+			return err
+		}
+		dto.Values = values
+	}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -192,9 +679,19 @@ func (s *Session) UnmarshalJSON(b []byte) error {
 	} else {
 		s.values = dto.Values
 	}
-	s.createdAt = dto.CreatedAt
-	s.updatedAt = dto.UpdatedAt
-	s.expiresAt = dto.ExpiresAt
+	s.createdAt = dto.CreatedAt.Time
+	s.updatedAt = dto.UpdatedAt.Time
+	s.expiresAt = dto.ExpiresAt.Time
+	s.labels = dto.Labels
+	s.sameSite = dto.SameSite
+	s.binding = dto.Binding
+	s.saveCount = dto.SaveCount
+	// Payloads written before the field existed were saved along with a
+	// cookie carrying their expiry.
+	s.cookieExpires = s.expiresAt
+	if dto.CookieExpires != 0 {
+		s.cookieExpires = time.UnixMilli(dto.CookieExpires)
+	}
 
 	s.isNew = false
 	return nil
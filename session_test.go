@@ -1,17 +1,34 @@
 package redissession
 
 import (
+	"bytes"
 	"context"
+	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
-func setupTestRedis(t *testing.T) *redis.Client {
+func setupTestRedis(t testing.TB) *redis.Client {
 	client := redis.NewClient(&redis.Options{
 		Addr: "localhost:6379",
 		DB:   1,
@@ -28,7 +45,7 @@ func setupTestRedis(t *testing.T) *redis.Client {
 	return client
 }
 
-func setupTestCrypto(t *testing.T) *Crypto {
+func setupTestCrypto(t testing.TB) *Crypto {
 	encKey := make([]byte, 32)
 	signKey := make([]byte, 32)
 	if _, err := rand.Read(encKey); err != nil {
@@ -44,6 +61,16 @@ func setupTestCrypto(t *testing.T) *Crypto {
 	return NewCrypto(aead, signKey)
 }
 
+func setupTestStore(t testing.TB) *RedisStore {
+	client := setupTestRedis(t)
+	crypto := setupTestCrypto(t)
+	options := DefaultCookieOptions()
+	options.MaxAge = 10
+	options.Secure = false
+	options.SameSite = http.SameSiteDefaultMode
+	return NewRedisStore(client, "test:", crypto, options)
+}
+
 func TestSession_ConcurrentAccess(t *testing.T) {
 	session := NewSession("test-id", time.Hour)
 	done := make(chan bool, 20)
@@ -120,6 +147,63 @@ func TestCrypto_SignatureTamper(t *testing.T) {
 	}
 }
 
+func TestCrypto_DecryptFailureModes(t *testing.T) {
+	newKey := func() []byte {
+		k := make([]byte, 32)
+		rand.Read(k)
+		return k
+	}
+	newAEAD := func() cipher.AEAD {
+		aead, err := NewAESGCM(newKey())
+		if err != nil {
+			t.Fatalf("NewAESGCM: %v", err)
+		}
+		return aead
+	}
+	signKey := newKey()
+	sealer := NewCrypto(newAEAD(), signKey)
+	enc, err := sealer.EncryptAndSign(map[string]string{"msg": "hello"}, []byte("aad"))
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	var out map[string]string
+
+	// A forged signature is tampering, not a key problem.
+	decoded, _ := base64.RawStdEncoding.DecodeString(enc)
+	decoded[0] ^= 0xff
+	err = sealer.DecryptAndVerify(base64.RawStdEncoding.EncodeToString(decoded), &out, []byte("aad"))
+	if !errors.Is(err, ErrSignatureInvalid) || errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("tampered payload: %v", err)
+	}
+
+	// Right signing key, wrong encryption key.
+	mismatched := NewCrypto(newAEAD(), signKey)
+	err = mismatched.DecryptAndVerify(enc, &out, []byte("aad"))
+	if !errors.Is(err, ErrKeyMismatch) || !errors.Is(err, ErrEncryptionFailed) {
+		t.Fatalf("key mismatch: %v", err)
+	}
+
+	// Mid-rotation: the primary does not recognize the payload, but a legacy
+	// key does and fails to decrypt it.
+	rotated := NewCrypto(newAEAD(), signKey).WithNewPrimary(newAEAD(), newKey())
+	if err := rotated.DecryptAndVerify(enc, &out, []byte("aad")); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("legacy key mismatch: %v", err)
+	}
+
+	// No signing key anywhere matches.
+	stranger := NewCrypto(newAEAD(), newKey())
+	if err := stranger.DecryptAndVerify(enc, &out, []byte("aad")); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("unknown signer: %v", err)
+	}
+
+	// Unsigned payloads cannot tell tampering from a wrong key.
+	unsigned, _ := NewCrypto(newAEAD(), nil).EncryptAndSign("x", []byte("aad"))
+	err = NewCrypto(newAEAD(), nil).DecryptAndVerify(unsigned, &out, []byte("aad"))
+	if !errors.Is(err, ErrEncryptionFailed) || errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("unsigned payload: %v", err)
+	}
+}
+
 func TestRedisStore_SessionLifecycle(t *testing.T) {
 	client := setupTestRedis(t)
 	crypto := setupTestCrypto(t)
@@ -288,3 +372,4632 @@ func TestRedisStore_Destroy(t *testing.T) {
 		t.Fatalf("expected brand new session after destroy")
 	}
 }
+
+func TestRedisStore_PoolStats(t *testing.T) {
+	client := setupTestRedis(t)
+	crypto := setupTestCrypto(t)
+	store := NewRedisStore(client, "test:", crypto, DefaultCookieOptions())
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "sess-pool")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	stats := store.PoolStats()
+	if stats == nil || stats.TotalConns == 0 {
+		t.Fatalf("expected pool stats with open connections, got %+v", stats)
+	}
+}
+
+func TestRedisStore_SaveAfterHeadersSent(t *testing.T) {
+	store := setupTestStore(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rec := httptest.NewRecorder()
+	w := NewResponseWriter(rec)
+	sess, err := store.New(req, "sess-hdr")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	w.Write([]byte("streamed"))
+	if err := store.Save(req, w, sess); !errors.Is(err, ErrHeadersAlreadySent) {
+		t.Fatalf("expected ErrHeadersAlreadySent, got %v", err)
+	}
+}
+
+func TestRedisStore_MiddlewareWritesCookieBeforeFlush(t *testing.T) {
+	store := setupTestStore(t)
+
+	handler := store.Middleware("sess-mw")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sess, err := GetSession(r)
+		if err != nil {
+			t.Errorf("GetSession: %v", err)
+			return
+		}
+		sess.Set("user", "alice")
+		w.(http.Flusher).Flush()
+		w.Write([]byte("body"))
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "sess-mw" {
+		t.Fatalf("expected session cookie, got %v", cookies)
+	}
+	if rec.Body.String() != "body" {
+		t.Fatalf("unexpected body %q", rec.Body.String())
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookies[0])
+	sess, err := store.New(req, "sess-mw")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if sess.Get("user") != "alice" {
+		t.Fatalf("session written by middleware was not persisted")
+	}
+}
+
+func TestRedisStore_BytesRoundTrip(t *testing.T) {
+	store := setupTestStore(t)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "sess-bytes")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	raw := []byte{0x00, 0xff, 0x10, 0x80, 'a'}
+	sess.Set("avatar", raw)
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(w.Result().Cookies()[0])
+	loaded, err := store.New(req2, "sess-bytes")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	got, ok := loaded.GetBytes("avatar")
+	if !ok || !bytes.Equal(got, raw) {
+		t.Fatalf("GetBytes: want %v, got %v (ok=%v)", raw, got, ok)
+	}
+	if _, ok := loaded.GetBytes("missing"); ok {
+		t.Fatalf("expected missing key to report false")
+	}
+}
+
+func TestCookieOptions_Chunking(t *testing.T) {
+	options := DefaultCookieOptions()
+	options.ChunkSize = 10
+	value := strings.Repeat("abcdefghij", 3) + "xyz"
+	expires := time.Now().Add(time.Hour)
+
+	cookies := options.NewChunkedCookies("big", value, expires)
+	if len(cookies) != 4 || cookies[0].Name != "big.0" || cookies[3].Name != "big.3" {
+		t.Fatalf("unexpected chunks: %v", cookies)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	got, err := ReadChunkedCookie(req, "big")
+	if err != nil || got != value {
+		t.Fatalf("ReadChunkedCookie: want %q, got %q (%v)", value, got, err)
+	}
+
+	removed := options.RemoveChunkedCookies(req, "big")
+	if len(removed) != 4 {
+		t.Fatalf("expected all chunks to be removed, got %d", len(removed))
+	}
+	for _, c := range removed {
+		if c.MaxAge != -1 {
+			t.Fatalf("chunk %s not expired", c.Name)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	options.SetChunkedCookies(w, req, "big", "short", expires)
+	set := w.Result().Cookies()
+	if len(set) != 5 || set[0].Name != "big" || set[0].Value != "short" {
+		t.Fatalf("expected new cookie plus stale chunk deletions, got %v", set)
+	}
+}
+
+func TestNewRedisStoreChecked(t *testing.T) {
+	client := setupTestRedis(t)
+	crypto := setupTestCrypto(t)
+	ctx := context.Background()
+
+	if _, err := NewRedisStoreChecked(ctx, client, "test:", crypto, DefaultCookieOptions()); err != nil {
+		t.Fatalf("expected valid configuration to pass, got %v", err)
+	}
+	if _, err := NewRedisStoreChecked(ctx, client, "test:", NewCrypto(nil, nil), DefaultCookieOptions()); !errors.Is(err, ErrInvalidConfiguration) {
+		t.Fatalf("expected ErrInvalidConfiguration for missing AEAD, got %v", err)
+	}
+
+	unreachable := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	defer unreachable.Close()
+	if _, err := NewRedisStoreChecked(ctx, unreachable, "test:", crypto, DefaultCookieOptions()); err == nil {
+		t.Fatalf("expected ping failure for unreachable Redis")
+	}
+}
+
+func TestRedisStore_RotateIDCookiesAndRevocation(t *testing.T) {
+	store := setupTestStore(t).
+		WithCompanionCookie("sess-ui", func(s *Session) map[string]interface{} {
+			return map[string]interface{}{"logged_in": true}
+		}).
+		WithExpiresInHeader(true).
+		WithRevocationList(true)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-main")
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	oldID := sess.ID()
+	w := httptest.NewRecorder()
+	if err := store.RotateID(req, w, sess); err != nil {
+		t.Fatalf("RotateID: %v", err)
+	}
+
+	names := map[string]string{}
+	for _, c := range w.Result().Cookies() {
+		names[c.Name] = c.Value
+	}
+	if names["sess-main"] != sess.ID() {
+		t.Fatalf("rotated session cookie not sent: %v", names)
+	}
+	if _, ok := names["sess-ui"]; !ok {
+		t.Fatalf("companion cookie not sent on RotateID: %v", names)
+	}
+	if w.Header().Get(ExpiresInHeader) == "" {
+		t.Fatal("expires-in header not sent on RotateID")
+	}
+	if _, err := store.LoadByID(ctx, "sess-main", oldID); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("old id after RotateID = %v, want ErrSessionRevoked", err)
+	}
+}
+
+func TestRedisStore_CompanionCookie(t *testing.T) {
+	store := setupTestStore(t).WithCompanionCookie("sess-ui", func(s *Session) map[string]interface{} {
+		return map[string]interface{}{"logged_in": s.Get("user") != nil}
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "sess-main")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	sess.Set("user", "alice")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	var companion *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "sess-ui" {
+			companion = c
+		}
+	}
+	if companion == nil || companion.HttpOnly || strings.Contains(companion.Value, sess.ID()) {
+		t.Fatalf("expected readable companion cookie without the session id, got %v", companion)
+	}
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(companion)
+	claims, err := store.CompanionClaims(req2)
+	if err != nil || claims["logged_in"] != true || claims["exp"] != nil {
+		t.Fatalf("CompanionClaims: %v %v", claims, err)
+	}
+	next := setupTestCrypto(t)
+	store.crypto = store.crypto.WithNewPrimary(next.aead, next.signingKey)
+	if claims, err := store.CompanionClaims(req2); err != nil || claims["logged_in"] != true {
+		t.Fatalf("CompanionClaims after key rotation: %v %v", claims, err)
+	}
+
+	forged := *companion
+	forged.Value = base64.RawURLEncoding.EncodeToString([]byte(`{"logged_in":true,"admin":true}`)) + companion.Value[strings.Index(companion.Value, "."):]
+	req3 := httptest.NewRequest("GET", "/", nil)
+	req3.AddCookie(&forged)
+	if _, err := store.CompanionClaims(req3); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("expected forged claims to be rejected, got %v", err)
+	}
+
+	replay := func(purpose, payload string) error {
+		value, err := store.crypto.signValue(purpose, []byte(payload))
+		if err != nil {
+			t.Fatalf("signValue: %v", err)
+		}
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "sess-ui", Value: value})
+		_, err = store.CompanionClaims(req)
+		return err
+	}
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	if err := replay(companionContext+"sess-ui", `{"admin":true,"exp":`+past+`}`); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected an expired companion value to be rejected, got %v", err)
+	}
+	if err := replay(companionContext+"other-ui", `{"admin":true,"exp":`+future+`}`); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("expected a value signed for another cookie to be rejected, got %v", err)
+	}
+	if err := replay(companionContext+"sess-ui", `{"admin":true}`); !errors.Is(err, ErrInvalidSessionData) {
+		t.Fatalf("expected a value without exp to be rejected, got %v", err)
+	}
+
+	w2 := httptest.NewRecorder()
+	if err := store.Destroy(req, w2, sess); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	cleared := false
+	for _, c := range w2.Result().Cookies() {
+		if c.Name == "sess-ui" && c.MaxAge == -1 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Fatalf("expected companion cookie to be cleared on Destroy")
+	}
+}
+
+func TestRedisStore_SessionModes(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mode    SessionMode
+		sliding bool
+	}{
+		{"fixed", Fixed, false},
+		{"rolling", Rolling, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := setupTestStore(t).WithMode(tc.mode)
+			ctx := context.Background()
+
+			req := httptest.NewRequest("GET", "/", nil)
+			w := httptest.NewRecorder()
+			sess, err := store.New(req, "sess-mode")
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			if err := store.Save(req, w, sess); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			key := store.redisKey("sess-mode", sess.ID())
+			store.client.Expire(ctx, key, 2*time.Second)
+
+			req2 := httptest.NewRequest("GET", "/", nil)
+			req2.AddCookie(w.Result().Cookies()[0])
+			loaded, err := store.New(req2, "sess-mode")
+			if err != nil || loaded.IsNew() {
+				t.Fatalf("expected existing session, err=%v", err)
+			}
+			ttl := store.client.PTTL(ctx, key).Val()
+			if slid := ttl > 5*time.Second; slid != tc.sliding {
+				t.Fatalf("ttl after load = %v, sliding expected %v", ttl, tc.sliding)
+			}
+			if slid := loaded.ExpiresAt().After(sess.ExpiresAt()); slid != tc.sliding {
+				t.Fatalf("expiresAt after load = %v, sliding expected %v", loaded.ExpiresAt(), tc.sliding)
+			}
+		})
+	}
+}
+
+func TestCrypto_ValidSessionID(t *testing.T) {
+	crypto := setupTestCrypto(t)
+	id, err := crypto.GenerateSessionID()
+	if err != nil {
+		t.Fatalf("GenerateSessionID: %v", err)
+	}
+	if !crypto.ValidSessionID(id) {
+		t.Fatalf("generated id %q rejected", id)
+	}
+	for _, bad := range []string{"", "short", id[:len(id)-1], id + "A", strings.Repeat("!", len(id)), id[:len(id)-1] + "+"} {
+		if crypto.ValidSessionID(bad) {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestRedisStore_OnLoad(t *testing.T) {
+	var notBefore time.Time
+	store := setupTestStore(t).WithOnLoad(func(ctx context.Context, s *Session) error {
+		if s.CreatedAt().Before(notBefore) {
+			return ErrSessionExpired
+		}
+		s.Set("roles", "fresh")
+		return nil
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "sess-onload")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(cookie)
+	loaded, err := store.New(req2, "sess-onload")
+	if err != nil || loaded.IsNew() || loaded.Get("roles") != "fresh" {
+		t.Fatalf("expected enriched existing session, err=%v", err)
+	}
+
+	notBefore = time.Now()
+	req3 := httptest.NewRequest("GET", "/", nil)
+	req3.AddCookie(cookie)
+	rejected, err := store.New(req3, "sess-onload")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !rejected.IsNew() || rejected.ID() == sess.ID() {
+		t.Fatalf("expected OnLoad error to yield a fresh session")
+	}
+}
+
+func TestCrypto_PaddedLegacyPayload(t *testing.T) {
+	crypto := setupTestCrypto(t)
+	sawPadding := false
+	for _, msg := range []string{"a", "ab", "abc", "abcd"} {
+		enc, err := crypto.EncryptAndSign(map[string]string{"msg": msg}, []byte("aad"))
+		if err != nil {
+			t.Fatalf("EncryptAndSign: %v", err)
+		}
+		if strings.HasSuffix(enc, "=") {
+			t.Fatalf("expected unpadded payload, got %q", enc)
+		}
+		raw, err := base64.RawStdEncoding.DecodeString(enc)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		legacy := base64.StdEncoding.EncodeToString(raw)
+		sawPadding = sawPadding || strings.HasSuffix(legacy, "=")
+
+		for _, in := range []string{enc, legacy} {
+			var out map[string]string
+			if err := crypto.DecryptAndVerify(in, &out, []byte("aad")); err != nil || out["msg"] != msg {
+				t.Fatalf("DecryptAndVerify(%q): %v %v", in, out, err)
+			}
+		}
+	}
+	if !sawPadding {
+		t.Fatalf("test inputs never produced a padded legacy payload")
+	}
+}
+
+func TestRedisStore_RevocationList(t *testing.T) {
+	store := setupTestStore(t).WithRevocationList(true)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "sess-revoke")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	key := store.redisKey("sess-revoke", sess.ID())
+	payload := store.client.Get(ctx, key).Val()
+
+	if err := store.Destroy(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	// Simulate a stale copy of the payload still being reachable.
+	store.client.Set(ctx, key, payload, time.Minute)
+
+	if _, err := store.load(ctx, "sess-revoke", sess.ID()); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("expected ErrSessionRevoked, got %v", err)
+	}
+	if ttl := store.client.ZScore(ctx, store.revokedKey(), key).Val(); int64(ttl) < time.Now().UnixMilli() {
+		t.Fatalf("revocation entry should live until the session expiry")
+	}
+}
+
+func TestRedisStore_MinCreatedAt(t *testing.T) {
+	var epoch time.Time
+	store := setupTestStore(t).WithMinCreatedAt(func() time.Time { return epoch })
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	old, _ := store.New(req, "sess-epoch")
+	if err := store.Save(req, httptest.NewRecorder(), old); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := store.LoadByID(ctx, "sess-epoch", old.ID()); err != nil {
+		t.Fatalf("LoadByID before the epoch moved: %v", err)
+	}
+
+	epoch = time.Now()
+	fresh, _ := store.New(req, "sess-epoch")
+	if err := store.Save(req, httptest.NewRecorder(), fresh); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := store.LoadByID(ctx, "sess-epoch", old.ID()); !errors.Is(err, ErrSessionRevoked) {
+		t.Fatalf("expected ErrSessionRevoked for a session older than the epoch, got %v", err)
+	}
+	if _, err := store.LoadByID(ctx, "sess-epoch", fresh.ID()); err != nil {
+		t.Fatalf("session created after the epoch: %v", err)
+	}
+
+	oldReq := httptest.NewRequest("GET", "/", nil)
+	oldReq.AddCookie(&http.Cookie{Name: "sess-epoch", Value: old.ID()})
+	sess, _ := store.New(oldReq, "sess-epoch")
+	if !sess.IsNew() || sess.ID() == old.ID() {
+		t.Fatalf("request carrying a pre-epoch cookie should get a fresh session")
+	}
+}
+
+func TestSession_OnChange(t *testing.T) {
+	sess := NewSession("change", time.Hour)
+	calls := 0
+	sess.SetOnChange(func() {
+		calls++
+		// The lock is released by now, so reading back must not deadlock.
+		_ = sess.Get("a")
+	})
+
+	sess.Set("a", 1)
+	sess.Delete("a")
+	sess.Update(func(values map[string]interface{}) { values["b"] = 2 })
+	sess.RenameKey("b", "c")
+	sess.RenameKey("missing", "d")
+	sess.AddFlash("hi")
+	sess.Flashes()
+	sess.Flashes()
+	sess.Extend(time.Minute)
+	if calls != 6 {
+		t.Fatalf("expected 6 change callbacks, got %d", calls)
+	}
+
+	sess.SetOnChange(nil)
+	sess.Set("a", 1)
+	if calls != 6 {
+		t.Fatalf("callback still ran after being removed")
+	}
+}
+
+func TestRedisStore_WithDB(t *testing.T) {
+	client := setupTestRedis(t)
+	other := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 2})
+	defer other.Close()
+	ctx := context.Background()
+	other.FlushDB(ctx)
+	defer other.FlushDB(ctx)
+
+	store := NewRedisStore(client, "test:", setupTestCrypto(t), DefaultCookieOptions()).WithDB(2)
+	if store.client == client || store.client.Options().DB != 2 {
+		t.Fatalf("expected a dedicated client on DB 2")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-db")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	key := store.redisKey("sess-db", sess.ID())
+	if other.Exists(ctx, key).Val() != 1 || client.Exists(ctx, key).Val() != 0 {
+		t.Fatalf("session should be stored in DB 2 only")
+	}
+
+	if err := store.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatalf("the caller's client must stay open: %v", err)
+	}
+	if same := NewRedisStore(client, "test:", setupTestCrypto(t), DefaultCookieOptions()).WithDB(1); same.client != client {
+		t.Fatalf("a client already on the DB should be used as is")
+	}
+}
+
+func TestRedisStore_CookieOnChange(t *testing.T) {
+	store := setupTestStore(t).WithCookieBehavior(CookieOnChange)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-oc")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Fatalf("a new session must get its cookie")
+	}
+	cookie := w.Result().Cookies()[0]
+
+	reload := func() *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookie)
+		loaded, err := store.New(r, "sess-oc")
+		if err != nil || loaded.IsNew() {
+			t.Fatalf("New: %v", err)
+		}
+		sess = loaded
+		return httptest.NewRecorder()
+	}
+
+	w = reload()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Header().Get("Set-Cookie"); got != "" {
+		t.Fatalf("unchanged read should not set a cookie, got %q", got)
+	}
+
+	w = reload()
+	sess.Set("k", "v")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Header().Get("Set-Cookie"); got != "" {
+		t.Fatalf("a value change leaves the cookie as is, got %q", got)
+	}
+
+	w = reload()
+	sess.Extend(time.Minute)
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Fatalf("an expiry change must resend the cookie")
+	}
+	w = reload()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Header().Get("Set-Cookie"); got != "" {
+		t.Fatalf("the resent cookie should be remembered, got %q", got)
+	}
+
+	w = reload()
+	if err := store.RotateID(req, w, sess); err != nil {
+		t.Fatalf("RotateID: %v", err)
+	}
+	cookie = w.Result().Cookies()[0]
+	if cookie.Value != sess.ID() {
+		t.Fatalf("RotateID must send the new id")
+	}
+	w = reload()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Header().Get("Set-Cookie"); got != "" {
+		t.Fatalf("save after a rotation already sent should not set a cookie, got %q", got)
+	}
+
+	never := setupTestStore(t).WithCookieBehavior(CookieNever)
+	fresh, _ := never.New(req, "sess-oc")
+	w = httptest.NewRecorder()
+	if err := never.Save(req, w, fresh); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Header().Get("Set-Cookie"); got != "" {
+		t.Fatalf("CookieNever set %q", got)
+	}
+	if _, err := never.LoadByID(ctx, "sess-oc", fresh.ID()); err != nil {
+		t.Fatalf("CookieNever must still persist the session: %v", err)
+	}
+}
+
+func TestRedisStore_CookieOnChangeRolling(t *testing.T) {
+	store := setupTestStore(t).WithMode(Rolling).WithCookieBehavior(CookieOnChange)
+	store.options.MaxAge = 100
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-ocr")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	sess, _ = store.New(r, "sess-ocr")
+	w = httptest.NewRecorder()
+	if err := store.Save(r, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Header().Get("Set-Cookie"); got != "" {
+		t.Fatalf("a small rolling slide should not resend the cookie, got %q", got)
+	}
+
+	// Pretend the cookie was sent long ago.
+	sess, _ = store.New(r, "sess-ocr")
+	sess.cookieExpires = sess.ExpiresAt().Add(-20 * time.Second)
+	w = httptest.NewRecorder()
+	if err := store.Save(r, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if w.Header().Get("Set-Cookie") == "" {
+		t.Fatalf("a slide past a tenth of MaxAge must resend the cookie")
+	}
+}
+
+func TestRedisStore_SessionInfo(t *testing.T) {
+	store := setupTestStore(t).WithUserIndex("")
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-info")
+	sess.Set(DefaultUserIDKey, "u1")
+	sess.Set("secret", "x")
+	sess.AddLabel("admin")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	info, err := store.Inspect(ctx, "sess-info", sess.ID(), false)
+	if err != nil {
+		t.Fatalf("Inspect: %v", err)
+	}
+	if info.ID != sess.ID() || info.Name != "sess-info" || info.UserID != "u1" ||
+		!slices.Equal(info.Labels, []string{"admin"}) || !info.ExpiresAt.Equal(sess.ExpiresAt()) {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+	if info.TTL <= 0 || info.TTL > 10*time.Second {
+		t.Fatalf("TTL = %v", info.TTL)
+	}
+	if info.Values != nil {
+		t.Fatalf("values must be left out unless asked for")
+	}
+
+	byLabel, err := store.ListByLabelInfo(ctx, "admin", true)
+	if err != nil || len(byLabel) != 1 || byLabel[0].Values["secret"] != "x" {
+		t.Fatalf("ListByLabelInfo: %+v, %v", byLabel, err)
+	}
+	byUser, err := store.ListUserSessionInfo(ctx, "u1", false)
+	if err != nil || len(byUser) != 1 || byUser[0].ID != sess.ID() || byUser[0].Values != nil {
+		t.Fatalf("ListUserSessionInfo: %+v, %v", byUser, err)
+	}
+	if _, err := store.Inspect(ctx, "sess-info", "missing", false); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestRedisStore_OriginGuard(t *testing.T) {
+	store := setupTestStore(t)
+	h := store.OriginGuard("sess-origin", "https://app.example.com")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tc := range []struct {
+		name    string
+		method  string
+		cookie  bool
+		headers map[string]string
+		want    int
+	}{
+		{"allowed origin", "POST", true, map[string]string{"Origin": "https://APP.example.com"}, http.StatusNoContent},
+		{"disallowed origin", "POST", true, map[string]string{"Origin": "https://evil.example"}, http.StatusForbidden},
+		{"null origin", "POST", true, map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{"allowed referer", "DELETE", true, map[string]string{"Referer": "https://app.example.com/page?x=1"}, http.StatusNoContent},
+		{"disallowed referer", "PUT", true, map[string]string{"Referer": "https://evil.example/"}, http.StatusForbidden},
+		{"missing origin and referer", "POST", true, nil, http.StatusNoContent},
+		{"safe method", "GET", true, map[string]string{"Origin": "https://evil.example"}, http.StatusNoContent},
+		{"no session cookie", "POST", false, map[string]string{"Origin": "https://evil.example"}, http.StatusNoContent},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/", nil)
+			if tc.cookie {
+				req.AddCookie(&http.Cookie{Name: "sess-origin", Value: "x"})
+			}
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != tc.want {
+				t.Fatalf("status = %d, want %d", w.Code, tc.want)
+			}
+		})
+	}
+}
+
+func TestSession_Transient(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-transient")
+	sess.Set("user_id", "u1")
+	user := &struct{ Name string }{"alice"}
+	sess.SetTransient("user", user)
+	if got, ok := sess.GetTransient("user"); !ok || got != user {
+		t.Fatalf("GetTransient = %v, %v", got, ok)
+	}
+	if strings.Contains(string(sess.Snapshot()), "alice") {
+		t.Fatalf("transient value leaked into the snapshot")
+	}
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if b, _ := sess.MarshalJSON(); strings.Contains(string(b), "alice") {
+		t.Fatalf("transient value serialized: %s", b)
+	}
+
+	loaded, err := store.LoadByID(ctx, "sess-transient", sess.ID())
+	if err != nil {
+		t.Fatalf("LoadByID: %v", err)
+	}
+	if _, ok := loaded.GetTransient("user"); ok {
+		t.Fatalf("transient value survived a reload")
+	}
+	if loaded.Get("user_id") != "u1" {
+		t.Fatalf("persisted value lost")
+	}
+
+	sess.SetTransient("user", nil)
+	if _, ok := sess.GetTransient("user"); ok {
+		t.Fatalf("SetTransient(nil) should remove the key")
+	}
+}
+
+func TestRedisStore_MaxUserIndexSize(t *testing.T) {
+	for _, policy := range []UserIndexPolicy{UnlinkOldestSessions, DestroyOldestSessions} {
+		t.Run(strconv.Itoa(int(policy)), func(t *testing.T) {
+			store := setupTestStore(t).WithUserIndex("").WithMaxUserIndexSize(2, policy)
+			ctx := context.Background()
+			req := httptest.NewRequest("GET", "/", nil)
+
+			var ids []string
+			for i := 0; i < 3; i++ {
+				sess, _ := store.New(req, "sess-cap")
+				sess.Set(DefaultUserIDKey, "u1")
+				if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+					t.Fatalf("Save: %v", err)
+				}
+				ids = append(ids, sess.ID())
+				time.Sleep(2 * time.Millisecond)
+			}
+			// A dangling entry is dropped before any live session.
+			store.client.SAdd(ctx, store.userKey("u1"), store.redisKey("sess-cap", "gone"))
+
+			sessions, err := store.ListUserSessions(ctx, "u1")
+			if err != nil {
+				t.Fatalf("ListUserSessions: %v", err)
+			}
+			var got []string
+			for _, sess := range sessions {
+				got = append(got, sess.ID())
+			}
+			slices.Sort(got)
+			want := slices.Clone(ids[1:])
+			slices.Sort(want)
+			if !slices.Equal(got, want) {
+				t.Fatalf("indexed %v, want the two newest %v", got, want)
+			}
+
+			_, err = store.Peek(ctx, "sess-cap", ids[0])
+			if policy == DestroyOldestSessions && !errors.Is(err, ErrSessionNotFound) {
+				t.Fatalf("trimmed session should be destroyed, got %v", err)
+			}
+			if policy == UnlinkOldestSessions && err != nil {
+				t.Fatalf("trimmed session should stay usable: %v", err)
+			}
+
+			sess, _ := store.New(req, "sess-cap")
+			sess.Set(DefaultUserIDKey, "u1")
+			if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			members := store.client.SMembers(ctx, store.userKey("u1")).Val()
+			if len(members) != 2 || !slices.Contains(members, store.redisKey("sess-cap", sess.ID())) {
+				t.Fatalf("index after next save: %v", members)
+			}
+		})
+	}
+}
+
+func TestCrypto_Compression(t *testing.T) {
+	plain := setupTestCrypto(t)
+	crypto := *plain
+	compressing := crypto.WithCompression(0.5)
+
+	compressible := NewSession("zip", time.Hour)
+	for i := 0; i < 50; i++ {
+		compressible.Set("key_"+strconv.Itoa(i), strings.Repeat("value ", 10))
+	}
+	random := make([]byte, 512)
+	rand.Read(random)
+	incompressible := NewSession("rnd", time.Hour)
+	incompressible.Set("blob", random)
+
+	for _, tc := range []struct {
+		name   string
+		sess   *Session
+		header byte
+	}{
+		{"compressible", compressible, flatePayload},
+		{"incompressible", incompressible, rawPayload},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sealed, stats, err := compressing.EncryptAndSignWithStats(tc.sess, []byte("aad"))
+			if err != nil {
+				t.Fatalf("EncryptAndSign: %v", err)
+			}
+			decoded, _ := base64.RawStdEncoding.DecodeString(sealed)
+			plaintext, err := compressing.open(compressing.primary(), decoded, []byte("aad"))
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			if plaintext[0] != tc.header {
+				t.Fatalf("header = %#x, want %#x", plaintext[0], tc.header)
+			}
+			if tc.header == rawPayload && len(plaintext) != stats.PlaintextSize+1 {
+				t.Fatalf("uncompressed payload grew by more than the header")
+			}
+			if tc.header == flatePayload && len(plaintext) >= stats.PlaintextSize/2 {
+				t.Fatalf("compressible payload barely shrank: %d -> %d", stats.PlaintextSize, len(plaintext))
+			}
+			// Reading does not depend on the option being set.
+			var got Session
+			if err := plain.DecryptAndVerify(sealed, &got, []byte("aad")); err != nil {
+				t.Fatalf("DecryptAndVerify: %v", err)
+			}
+			if !bytes.Equal(got.Snapshot(), tc.sess.Snapshot()) {
+				t.Fatalf("round trip mismatch")
+			}
+		})
+	}
+
+	// Deflating a tiny payload makes it larger, so it is stored as is even
+	// without a margin.
+	anySavings := crypto
+	anySavings.WithCompression(0)
+	sealed, stats, err := anySavings.EncryptAndSignWithStats(json.RawMessage("42"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	if stats.SealedSize != stats.PlaintextSize+anySavings.Overhead() {
+		t.Fatalf("tiny payload should only gain the header byte: %+v", stats)
+	}
+	var n int
+	if err := anySavings.DecryptAndVerify(sealed, &n, []byte("aad")); err != nil || n != 42 {
+		t.Fatalf("DecryptAndVerify: %d, %v", n, err)
+	}
+
+	// Payloads sealed before compression was enabled still load.
+	sealed, _ = plain.EncryptAndSign(compressible, []byte("aad"))
+	var got Session
+	if err := compressing.DecryptAndVerify(sealed, &got, []byte("aad")); err != nil {
+		t.Fatalf("DecryptAndVerify of a headerless payload: %v", err)
+	}
+}
+
+func TestRedisStore_BearerTokens(t *testing.T) {
+	errBadToken := errors.New("bad token")
+	store := setupTestStore(t).WithBearerTokens(func(token string) (string, error) {
+		id, ok := strings.CutPrefix(token, "jwt.")
+		if !ok {
+			return "", errBadToken
+		}
+		return id, nil
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-bearer")
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer jwt."+sess.ID())
+	r.AddCookie(&http.Cookie{Name: "sess-bearer", Value: "ignored"})
+	loaded, err := store.NewWithResult(r, "sess-bearer")
+	if err != nil || loaded.IsNew() || loaded.Get("user") != "alice" {
+		t.Fatalf("bearer load: new=%v err=%v", loaded.IsNew(), err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer forged")
+	loaded, err = store.NewWithResult(r, "sess-bearer")
+	if !errors.Is(err, errBadToken) || !loaded.IsNew() {
+		t.Fatalf("rejected token: new=%v err=%v", loaded.IsNew(), err)
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	r.AddCookie(&http.Cookie{Name: "sess-bearer", Value: sess.ID()})
+	if loaded, _ := store.New(r, "sess-bearer"); loaded.ID() != sess.ID() {
+		t.Fatalf("non-bearer requests should keep using the cookie")
+	}
+}
+
+func TestCookieSizeGuard(t *testing.T) {
+	fits := &http.Cookie{Name: "c", Value: strings.Repeat("v", MaxCookieSize-2)}
+	if err := checkCookieSize(fits); err != nil {
+		t.Fatalf("a %d byte cookie should fit: %v", len(fits.String()), err)
+	}
+	fits.Value += "v"
+	err := checkCookieSize(fits)
+	var tooLarge *CookieTooLargeError
+	if !errors.As(err, &tooLarge) || !errors.Is(err, ErrCookieTooLarge) {
+		t.Fatalf("expected CookieTooLargeError, got %v", err)
+	}
+	if tooLarge.Name != "c" || tooLarge.Size != MaxCookieSize+1 || tooLarge.Limit != MaxCookieSize {
+		t.Fatalf("unexpected sizes: %+v", tooLarge)
+	}
+
+	// A chunk size beyond what browsers accept is caught before any cookie
+	// is written.
+	options := DefaultCookieOptions()
+	options.ChunkSize = 8000
+	store := NewCookieStore(setupTestCrypto(t), options).WithMaxSize(16000)
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "cs")
+	sess.Set("padding", strings.Repeat("p", 4000))
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, sess); !errors.As(err, &tooLarge) || tooLarge.Limit != MaxCookieSize {
+		t.Fatalf("expected a per-cookie CookieTooLargeError, got %v", err)
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatalf("no cookie should be written")
+	}
+
+	value, _ := store.crypto.EncryptAndSign(sess, []byte("cs"))
+	store.WithMaxSize(len(value) - 1)
+	if err := store.Save(req, httptest.NewRecorder(), sess); !errors.As(err, &tooLarge) || tooLarge.Size <= tooLarge.Limit || tooLarge.Limit != len(value)-1 {
+		t.Fatalf("expected the payload limit to be reported, got %v", err)
+	}
+
+	redisStore := setupTestStore(t).WithCompanionCookie("ui", func(*Session) map[string]interface{} {
+		return map[string]interface{}{"blob": strings.Repeat("x", MaxCookieSize)}
+	})
+	rs, _ := redisStore.New(req, "sess-big")
+	if err := redisStore.Save(req, httptest.NewRecorder(), rs); !errors.Is(err, ErrCookieTooLarge) {
+		t.Fatalf("oversized companion cookie: %v", err)
+	}
+}
+
+func TestRedisStore_ScanFilter(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	var admins []string
+	for i, role := range []string{"admin", "user", "admin", "user"} {
+		sess, _ := store.New(req, "sess-scan")
+		sess.Set("role", role)
+		sess.Set("n", i)
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if role == "admin" {
+			admins = append(admins, sess.ID())
+		}
+	}
+	store.client.Set(ctx, store.redisKey("sess-scan", "garbage"), "not a payload", time.Minute)
+
+	isAdmin := func(s *Session) bool { return s.Get("role") == "admin" }
+	var destroyed []string
+	err := store.ScanFilter(ctx, isAdmin, func(s *Session) error {
+		destroyed = append(destroyed, s.ID())
+		return store.DestroyCtx(ctx, s)
+	})
+	if err != nil {
+		t.Fatalf("ScanFilter: %v", err)
+	}
+	slices.Sort(destroyed)
+	slices.Sort(admins)
+	if !slices.Equal(destroyed, admins) {
+		t.Fatalf("matched %v, want %v", destroyed, admins)
+	}
+	for _, id := range admins {
+		if _, err := store.Peek(ctx, "sess-scan", id); !errors.Is(err, ErrSessionNotFound) {
+			t.Fatalf("admin session %s survived: %v", id, err)
+		}
+	}
+
+	remaining := 0
+	stop := errors.New("stop")
+	err = store.ScanFilter(ctx, func(*Session) bool { return true }, func(*Session) error {
+		remaining++
+		return stop
+	})
+	if !errors.Is(err, stop) || remaining != 1 {
+		t.Fatalf("an error from fn should stop the walk: %v after %d", err, remaining)
+	}
+}
+
+// base64Token encodes the "token" value and passes everything else through.
+type base64Token struct{}
+
+func (base64Token) Encode(key string, val interface{}) (interface{}, error) {
+	if str, ok := val.(string); ok && key == "token" {
+		return base64.StdEncoding.EncodeToString([]byte(str)), nil
+	}
+	return val, nil
+}
+
+func (base64Token) Decode(key string, val interface{}) (interface{}, error) {
+	str, ok := val.(string)
+	if !ok || key != "token" {
+		return val, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(str)
+	return string(b), err
+}
+
+func TestCrypto_ValueTransformer(t *testing.T) {
+	plain := setupTestCrypto(t)
+	withT := *plain
+	transforming := withT.WithValueTransformer(base64Token{})
+
+	sess := NewSessionWithValues("id", time.Hour, map[string]interface{}{"token": "s3cret", "user": "alice"})
+	sealed, err := transforming.EncryptAndSign(sess, []byte("aad"))
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	if sess.Get("token") != "s3cret" {
+		t.Fatalf("sealing must not modify the session")
+	}
+
+	var raw Session
+	if err := plain.DecryptAndVerify(sealed, &raw, []byte("aad")); err != nil {
+		t.Fatalf("DecryptAndVerify: %v", err)
+	}
+	if raw.Get("token") != base64.StdEncoding.EncodeToString([]byte("s3cret")) || raw.Get("user") != "alice" {
+		t.Fatalf("stored values: token=%v user=%v", raw.Get("token"), raw.Get("user"))
+	}
+
+	var got Session
+	if err := transforming.DecryptAndVerify(sealed, &got, []byte("aad")); err != nil {
+		t.Fatalf("DecryptAndVerify: %v", err)
+	}
+	if got.Get("token") != "s3cret" || got.Get("user") != "alice" {
+		t.Fatalf("decoded values: token=%v user=%v", got.Get("token"), got.Get("user"))
+	}
+
+	bad := NewSessionWithValues("id", time.Hour, map[string]interface{}{"token": "not base64!"})
+	sealed, _ = plain.EncryptAndSign(bad, []byte("aad"))
+	if err := transforming.DecryptAndVerify(sealed, &got, []byte("aad")); !errors.Is(err, ErrInvalidSessionData) {
+		t.Fatalf("a failing Decode should make the payload invalid, got %v", err)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tc := range []struct {
+		remote string
+		xff    []string
+		hops   int
+		want   string
+	}{
+		{remote: "192.0.2.10:5555", want: "192.0.2.10"},
+		{remote: "[2001:db8::1]:443", want: "2001:db8::1"},
+		{remote: "[fe80::1%eth0]:443", want: "fe80::1"},
+		{remote: "[::ffff:192.0.2.10]:80", want: "192.0.2.10"},
+		{remote: "192.0.2.10:5555", xff: []string{"203.0.113.7"}, want: "192.0.2.10"},
+		{remote: "10.0.0.1:80", xff: []string{"203.0.113.7"}, hops: 1, want: "203.0.113.7"},
+		{remote: "10.0.0.1:80", xff: []string{"6.6.6.6, 2001:db8:1:2::9, 10.0.0.2"}, hops: 2, want: "2001:db8:1:2::9"},
+		{remote: "10.0.0.1:80", xff: []string{"6.6.6.6", "[2001:db8::5]:1234", "10.0.0.2"}, hops: 2, want: "2001:db8::5"},
+		{remote: "10.0.0.1:80", xff: []string{"203.0.113.7:8080"}, hops: 1, want: "203.0.113.7"},
+		{remote: "10.0.0.1:80", xff: []string{"203.0.113.7"}, hops: 2, want: ""},
+		{remote: "10.0.0.1:80", xff: []string{"unknown"}, hops: 1, want: ""},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tc.remote
+		for _, v := range tc.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		addr, ok := ClientIP(req, tc.hops)
+		if got := addr.String(); ok != (tc.want != "") || ok && got != tc.want {
+			t.Errorf("ClientIP(%q, %q, %d) = %s, %v; want %q", tc.remote, tc.xff, tc.hops, got, ok, tc.want)
+		}
+	}
+}
+
+func TestRedisStore_IPPrefixBinding(t *testing.T) {
+	fn := IPPrefixBinding(0, 0, 1)
+	factor := func(remote, xff string) string {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Forwarded-For", xff)
+		f, _ := fn(req)
+		return f
+	}
+	if got := factor("10.0.0.1:80", "198.51.100.23"); got != "198.51.100.0/24" {
+		t.Fatalf("IPv4 factor = %q", got)
+	}
+	if got := factor("10.0.0.1:80", "2001:db8:a:b:1:2:3:4"); got != "2001:db8:a:b::/64" {
+		t.Fatalf("IPv6 factor = %q", got)
+	}
+	if got := factor("10.0.0.1:80", "::ffff:198.51.100.23"); got != "198.51.100.0/24" {
+		t.Fatalf("IPv4-mapped factor = %q", got)
+	}
+	if got, _ := IPPrefixBinding(16, 48, 0)(&http.Request{RemoteAddr: "[2001:db8:a:b::1]:443"}); got != "2001:db8:a::/48" {
+		t.Fatalf("custom IPv6 factor = %q", got)
+	}
+
+	store := setupTestStore(t).WithBinding(fn)
+	request := func(xff string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "10.0.0.1:80"
+		req.Header.Set("X-Forwarded-For", xff)
+		return req
+	}
+	req := request("2001:db8:a:b::1")
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-ip")
+	sess.Set("user", "alice")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	req = request("2001:db8:a:b:ffff::2")
+	req.AddCookie(cookie)
+	if loaded, err := store.NewWithResult(req, "sess-ip"); err != nil || loaded.IsNew() {
+		t.Fatalf("address in the same /64 failed to load the session: %v", err)
+	}
+	req = request("2001:db8:a:c::1")
+	req.AddCookie(cookie)
+	if _, err := store.NewWithResult(req, "sess-ip"); !errors.Is(err, ErrSessionBindingMismatch) {
+		t.Fatalf("address in another /64: expected ErrSessionBindingMismatch, got %v", err)
+	}
+}
+
+func TestRedisStore_Transition(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-step")
+	sess.Set("user", "alice")
+	sess.Set("pending_mfa", true)
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	oldID := sess.ID()
+	oldKey := store.redisKey("sess-step", oldID)
+
+	w = httptest.NewRecorder()
+	newValues := map[string]interface{}{"user": "alice", "mfa": "totp"}
+	if err := store.Transition(req, w, sess, newValues, time.Hour); err != nil {
+		t.Fatalf("Transition: %v", err)
+	}
+	newValues["user"] = "mallory"
+	if sess.ID() == oldID || sess.Get("pending_mfa") != nil || sess.Get("user") != "alice" || sess.IsDirty() {
+		t.Fatalf("session after Transition: id=%s values=%v dirty=%v", sess.ID(), sess.Get("pending_mfa"), sess.IsDirty())
+	}
+	if n, _ := store.client.Exists(ctx, oldKey).Result(); n != 0 {
+		t.Fatalf("old key still exists")
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.Value != sess.ID() {
+		t.Fatalf("cookie = %q, want the new id", cookie.Value)
+	}
+	if ttl := store.client.TTL(ctx, store.redisKey("sess-step", sess.ID())).Val(); ttl < 59*time.Minute {
+		t.Fatalf("new key TTL = %v, want the transition's max age", ttl)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	loaded, err := store.New(req, "sess-step")
+	if err != nil || loaded.IsNew() {
+		t.Fatalf("New after Transition: %v", err)
+	}
+	if loaded.Get("user") != "alice" || loaded.Get("mfa") != "totp" || loaded.Get("pending_mfa") != nil {
+		t.Fatalf("loaded values: user=%v mfa=%v pending_mfa=%v", loaded.Get("user"), loaded.Get("mfa"), loaded.Get("pending_mfa"))
+	}
+	if time.Until(loaded.ExpiresAt()) < 59*time.Minute {
+		t.Fatalf("expiry not reset: %v", loaded.ExpiresAt())
+	}
+
+	// A failed transition leaves the session as it was.
+	boom := errors.New("boom")
+	store.WithBeforeSave(func(*Session) error { return boom })
+	id, expires := loaded.ID(), loaded.ExpiresAt()
+	w = httptest.NewRecorder()
+	if err := store.Transition(req, w, loaded, map[string]interface{}{"x": 1}, 0); !errors.Is(err, boom) {
+		t.Fatalf("Transition with failing hook: %v", err)
+	}
+	if loaded.ID() != id || !loaded.ExpiresAt().Equal(expires) || loaded.Get("mfa") != "totp" || loaded.Get("x") != nil {
+		t.Fatalf("failed Transition modified the session")
+	}
+	if len(w.Result().Cookies()) != 0 {
+		t.Fatalf("failed Transition sent a cookie")
+	}
+}
+
+func TestRedisStore_CookieClaims(t *testing.T) {
+	var loadClaims map[string]string
+	store := setupTestStore(t).
+		WithCookieClaims(func(s *Session) map[string]string {
+			if tenant, ok := s.Get("tenant").(string); ok {
+				return map[string]string{"tenant": tenant}
+			}
+			return nil
+		}).
+		WithOnLoad(func(ctx context.Context, _ *Session) error {
+			loadClaims, _ = CookieClaimsFromContext(ctx, "sess-claims")
+			return nil
+		})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-claims")
+	sess.Set("tenant", "acme")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+	if !strings.HasPrefix(cookie.Value, sess.ID()+".") {
+		t.Fatalf("cookie value %q does not carry the id", cookie.Value)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	if claims, err := store.CookieClaims(req, "sess-claims"); err != nil || claims["tenant"] != "acme" {
+		t.Fatalf("CookieClaims = %v, %v", claims, err)
+	}
+	loaded, err := store.NewWithResult(req, "sess-claims")
+	if err != nil || loaded.IsNew() || loaded.ID() != sess.ID() {
+		t.Fatalf("New with claims cookie: %v", err)
+	}
+	if loadClaims["tenant"] != "acme" {
+		t.Fatalf("claims not in the load context: %v", loadClaims)
+	}
+	if claims, _ := CookieClaimsFromContext(loaded.Context(), "sess-claims"); claims["tenant"] != "acme" {
+		t.Fatalf("claims not in the session context: %v", claims)
+	}
+
+	// Cookies signed before a key rotation keep their session.
+	crypto := store.crypto
+	next := setupTestCrypto(t)
+	store.crypto = crypto.WithNewPrimary(next.aead, next.signingKey)
+	if loaded, err := store.NewWithResult(req, "sess-claims"); err != nil || loaded.IsNew() || loaded.Get("tenant") != "acme" {
+		t.Fatalf("New after key rotation: %v", err)
+	}
+	store.crypto = crypto
+
+	id, encClaims, _ := strings.Cut(cookie.Value, ".")
+	encClaims, mac, _ := strings.Cut(encClaims, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"tenant":"evil"}`))
+	otherID, _ := store.crypto.GenerateSessionID()
+	for label, value := range map[string]string{
+		"claims": id + "." + forged + "." + mac,
+		"id":     otherID + "." + encClaims + "." + mac,
+		"mac":    id + "." + encClaims + "." + base64.RawURLEncoding.EncodeToString([]byte("nope")),
+	} {
+		req = httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "sess-claims", Value: value})
+		if _, err := store.CookieClaims(req, "sess-claims"); !errors.Is(err, ErrSignatureInvalid) {
+			t.Errorf("tampered %s: CookieClaims error = %v", label, err)
+		}
+		loaded, err := store.NewWithResult(req, "sess-claims")
+		if !errors.Is(err, ErrSignatureInvalid) || !loaded.IsNew() {
+			t.Errorf("tampered %s: New error = %v, new = %v", label, err, loaded.IsNew())
+		}
+		if _, ok := CookieClaimsFromContext(loaded.Context(), "sess-claims"); ok {
+			t.Errorf("tampered %s: claims reached the context", label)
+		}
+	}
+
+	// Sessions without claims, and cookies issued before claims were
+	// enabled, keep a bare id.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "sess-claims", Value: sess.ID()})
+	if loaded, err := store.NewWithResult(req, "sess-claims"); err != nil || loaded.IsNew() {
+		t.Fatalf("bare id cookie: %v", err)
+	}
+	w = httptest.NewRecorder()
+	plain, _ := store.New(httptest.NewRequest("GET", "/", nil), "sess-claims")
+	plain.Set("user", "bob")
+	if err := store.Save(req, w, plain); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if v := w.Result().Cookies()[0].Value; v != plain.ID() {
+		t.Fatalf("claimless cookie = %q", v)
+	}
+}
+
+func TestSession_Snapshot(t *testing.T) {
+	sess := NewSession("snap", time.Hour)
+	sess.Set("a", 1)
+	sess.Set("b", "x")
+	before := sess.Snapshot()
+
+	sess.Set("a", 1)
+	if SnapshotChanged(before, sess.Snapshot()) {
+		t.Fatalf("rewriting an identical value should not count as a change")
+	}
+	sess.Set("b", "y")
+	if !SnapshotChanged(before, sess.Snapshot()) {
+		t.Fatalf("expected changed value to be detected")
+	}
+	sess.Set("bad", func() {})
+	if sess.Snapshot() != nil || !SnapshotChanged(before, sess.Snapshot()) {
+		t.Fatalf("unmarshalable values should yield a nil snapshot treated as changed")
+	}
+}
+
+func TestRedisStore_Shards(t *testing.T) {
+	store := setupTestStore(t)
+	admin := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 2})
+	ctx := context.Background()
+	admin.FlushDB(ctx)
+	t.Cleanup(func() {
+		admin.FlushDB(ctx)
+		admin.Close()
+	})
+	store.WithShards(map[string]*redis.Client{"admin": admin}, func(s *Session) string {
+		if s.Name() == "admin-sess" {
+			return "admin"
+		}
+		return ""
+	})
+
+	for _, name := range []string{"admin-sess", "user-sess"} {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		sess, err := store.New(req, name)
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		sess.Set("who", name)
+		if err := store.Save(req, w, sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		key := store.redisKey(name, sess.ID())
+		onAdmin := admin.Exists(ctx, key).Val() == 1
+		onMain := store.client.Exists(ctx, key).Val() == 1
+		if onAdmin != (name == "admin-sess") || onMain == onAdmin {
+			t.Fatalf("%s stored on wrong backend (admin=%v main=%v)", name, onAdmin, onMain)
+		}
+
+		req2 := httptest.NewRequest("GET", "/", nil)
+		req2.AddCookie(w.Result().Cookies()[0])
+		loaded, err := store.New(req2, name)
+		if err != nil || loaded.Get("who") != name {
+			t.Fatalf("load from shard failed: %v", err)
+		}
+
+		if err := store.RotateID(req2, httptest.NewRecorder(), loaded); err != nil {
+			t.Fatalf("RotateID: %v", err)
+		}
+		if err := store.Destroy(req2, httptest.NewRecorder(), loaded); err != nil {
+			t.Fatalf("Destroy: %v", err)
+		}
+		if admin.DBSize(ctx).Val() != 0 {
+			t.Fatalf("expected shard to be empty after destroy")
+		}
+	}
+}
+
+func TestRedisStore_LoadRejectsNameMismatch(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	id, err := store.crypto.GenerateSessionID()
+	if err != nil {
+		t.Fatalf("GenerateSessionID: %v", err)
+	}
+	forged := NewSession(id, time.Minute)
+	forged.setName("other-name")
+	encrypted, err := store.crypto.EncryptAndSign(forged, []byte("sess-name"))
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	store.client.Set(ctx, store.redisKey("sess-name", id), encrypted, time.Minute)
+
+	if _, err := store.load(ctx, "sess-name", id); !errors.Is(err, ErrInvalidSessionData) {
+		t.Fatalf("expected ErrInvalidSessionData, got %v", err)
+	}
+}
+
+func TestRedisStore_MaxValues(t *testing.T) {
+	t.Run("reject", func(t *testing.T) {
+		store := setupTestStore(t).WithMaxValues(2, RejectExtraValues)
+		req := httptest.NewRequest("GET", "/", nil)
+		sess, err := store.New(req, "sess-max")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		sess.Set("a", 1)
+		sess.Set("b", 2)
+		sess.Set("c", 3)
+		if err := store.Save(req, httptest.NewRecorder(), sess); !errors.Is(err, ErrTooManyValues) {
+			t.Fatalf("expected ErrTooManyValues, got %v", err)
+		}
+		sess.Delete("c")
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save within limit: %v", err)
+		}
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		store := setupTestStore(t).WithMaxValues(2, EvictOldestValues)
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		sess, err := store.New(req, "sess-max")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		sess.Set("a", 1)
+		sess.Set("b", 2)
+		sess.Set("a", 10)
+		sess.Set("c", 3)
+		if sess.Get("a") != nil || sess.Get("b") != 2 || sess.Get("c") != 3 {
+			t.Fatalf("expected oldest key to be evicted")
+		}
+		if err := store.Save(req, w, sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+
+		req2 := httptest.NewRequest("GET", "/", nil)
+		req2.AddCookie(w.Result().Cookies()[0])
+		loaded, err := store.New(req2, "sess-max")
+		if err != nil || loaded.IsNew() {
+			t.Fatalf("reload failed: %v", err)
+		}
+		loaded.Set("d", 4)
+		if loaded.Get("b") != nil || loaded.Get("c") == nil || loaded.Get("d") == nil {
+			t.Fatalf("expected loaded keys to be evicted in key order")
+		}
+	})
+}
+
+func TestRedisStore_FromContext(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := ContextWithStore(context.Background(), store)
+
+	sess, err := store.FromContext(ctx, "grpc-sess")
+	if err != nil || !sess.IsNew() {
+		t.Fatalf("expected fresh session, err=%v", err)
+	}
+	sess.Set("user", "alice")
+	if err := sess.PersistCtx(ctx); err != nil {
+		t.Fatalf("PersistCtx: %v", err)
+	}
+
+	loaded, err := store.FromContext(ContextWithSessionID(ctx, "grpc-sess", sess.ID()), "grpc-sess")
+	if err != nil || loaded.IsNew() || loaded.Get("user") != "alice" {
+		t.Fatalf("expected persisted session, err=%v", err)
+	}
+
+	store.WithContextIDExtractor(func(ctx context.Context, name string) (string, bool) {
+		return sess.ID(), true
+	})
+	viaExtractor, err := store.FromContext(context.Background(), "grpc-sess")
+	if err != nil || viaExtractor.ID() != sess.ID() {
+		t.Fatalf("custom extractor not used, err=%v", err)
+	}
+}
+
+func TestRedisStore_NewWithResult(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	newRequest := func(value string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		if value != "" {
+			req.AddCookie(&http.Cookie{Name: "sess-res", Value: value})
+		}
+		return req
+	}
+
+	sess, err := store.NewWithResult(newRequest(""), "sess-res")
+	if err != nil || sess == nil || !sess.IsNew() {
+		t.Fatalf("no cookie: expected fresh session without error, got %v", err)
+	}
+	if err := store.Save(newRequest(""), httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	key := store.redisKey("sess-res", sess.ID())
+	payload := store.client.Get(ctx, key).Val()
+
+	if loaded, err := store.NewWithResult(newRequest(sess.ID()), "sess-res"); err != nil || loaded.IsNew() {
+		t.Fatalf("valid cookie: expected loaded session, got %v", err)
+	}
+
+	missing, _ := store.crypto.GenerateSessionID()
+	if fresh, err := store.NewWithResult(newRequest(missing), "sess-res"); !errors.Is(err, ErrSessionNotFound) || fresh == nil || !fresh.IsNew() {
+		t.Fatalf("expected ErrSessionNotFound with fresh session, got %v", err)
+	}
+	if _, err := store.NewWithResult(newRequest("garbage"), "sess-res"); !errors.Is(err, ErrInvalidSessionData) {
+		t.Fatalf("expected ErrInvalidSessionData for malformed id, got %v", err)
+	}
+
+	raw, _ := base64.RawStdEncoding.DecodeString(payload)
+	raw[0] ^= 0xff
+	store.client.Set(ctx, key, base64.RawStdEncoding.EncodeToString(raw), time.Minute)
+	if _, err := store.NewWithResult(newRequest(sess.ID()), "sess-res"); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("expected ErrSignatureInvalid for tampered payload, got %v", err)
+	}
+
+	expired := NewSession(sess.ID(), -time.Second)
+	expired.setName("sess-res")
+	enc, _ := store.crypto.EncryptAndSign(expired, []byte("sess-res"))
+	store.client.Set(ctx, key, enc, time.Minute)
+	if _, err := store.NewWithResult(newRequest(sess.ID()), "sess-res"); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected ErrSessionExpired, got %v", err)
+	}
+}
+
+func TestRedisStore_Sweeper(t *testing.T) {
+	store := setupTestStore(t).WithIdlePurge(time.Hour)
+	ctx := context.Background()
+
+	put := func(name string, expiresIn, idle time.Duration) string {
+		id, _ := store.crypto.GenerateSessionID()
+		sess := NewSession(id, expiresIn)
+		sess.setName(name)
+		sess.updatedAt = time.Now().Add(-idle)
+		enc, err := store.crypto.EncryptAndSign(sess, []byte(name))
+		if err != nil {
+			t.Fatalf("EncryptAndSign: %v", err)
+		}
+		key := store.redisKey(name, id)
+		store.client.Set(ctx, key, enc, time.Minute)
+		return key
+	}
+	live := put("sess-a", time.Minute, 0)
+	expired := put("sess-a", -time.Second, 0)
+	idle := put("sess:b", time.Minute, 2*time.Hour)
+	store.client.Set(ctx, "other:key", "untouched", 0)
+
+	reports := make(chan SweepStats, 1)
+	store.WithSweepReporter(func(stats SweepStats, err error) {
+		if err != nil {
+			t.Errorf("sweep: %v", err)
+		}
+		select {
+		case reports <- stats:
+		default:
+		}
+	})
+	stop := store.StartSweeper(ctx, 20*time.Millisecond)
+	var stats SweepStats
+	select {
+	case stats = <-reports:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sweeper never reported")
+	}
+	stop()
+	stop()
+
+	if stats.Scanned != 3 || stats.Expired != 1 || stats.Idle != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if store.client.Exists(ctx, live).Val() != 1 || store.client.Exists(ctx, "other:key").Val() != 1 {
+		t.Fatalf("sweep removed keys it should keep")
+	}
+	if store.client.Exists(ctx, expired, idle).Val() != 0 {
+		t.Fatalf("sweep kept expired or idle sessions")
+	}
+}
+
+func TestRedisStore_StartSweeperDefaultInterval(t *testing.T) {
+	store := setupTestStore(t)
+	for _, interval := range []time.Duration{0, -time.Second} {
+		stop := store.StartSweeper(context.Background(), interval)
+		stop()
+	}
+}
+
+func TestCookieOptions_OmitExpires(t *testing.T) {
+	sess := NewSession("id", time.Hour)
+	sess.setName("sess")
+	options := DefaultCookieOptions()
+
+	if c := options.NewCookie(sess); c.Expires.IsZero() || !strings.Contains(c.String(), "Expires=") {
+		t.Fatalf("expected Expires by default, got %q", c.String())
+	}
+
+	options.OmitExpires = true
+	for _, c := range []*http.Cookie{options.NewCookie(sess), options.RemoveCookie("sess")} {
+		if strings.Contains(c.String(), "Expires=") || !strings.Contains(c.String(), "Max-Age=") {
+			t.Fatalf("expected Max-Age only, got %q", c.String())
+		}
+	}
+}
+
+func TestRedisStore_DestroyAll(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	for i := 0; i < 250; i++ {
+		store.client.Set(ctx, store.redisKey("sess", fmt.Sprintf("id%d", i)), "x", time.Minute)
+	}
+	store.client.Set(ctx, "other:key", "keep", 0)
+	store.client.Set(ctx, "testing:key", "keep", 0)
+
+	deleted, err := store.DestroyAll(ctx)
+	if err != nil {
+		t.Fatalf("DestroyAll: %v", err)
+	}
+	if deleted != 250 {
+		t.Fatalf("expected 250 deleted, got %d", deleted)
+	}
+	if store.client.DBSize(ctx).Val() != 2 {
+		t.Fatalf("DestroyAll touched keys outside the prefix")
+	}
+}
+
+func TestRedisStore_InvalidCookieName(t *testing.T) {
+	store := setupTestStore(t)
+	for _, name := range []string{"", "has space", "semi;colon", "eq=ual", "ctl\x01", "quote\"", "ünicode"} {
+		if _, err := store.New(httptest.NewRequest("GET", "/", nil), name); !errors.Is(err, ErrInvalidConfiguration) {
+			t.Errorf("New(%q): expected ErrInvalidConfiguration, got %v", name, err)
+		}
+		if got := SanitizeCookieName(name); !ValidCookieName(got) {
+			t.Errorf("SanitizeCookieName(%q) = %q is still invalid", name, got)
+		}
+	}
+
+	sess := NewSession("id", time.Minute)
+	sess.setName("bad name")
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), sess); !errors.Is(err, ErrInvalidConfiguration) {
+		t.Fatalf("Save: expected ErrInvalidConfiguration, got %v", err)
+	}
+	if !ValidCookieName("__Host-sess.id_1") {
+		t.Fatalf("expected valid name to pass")
+	}
+}
+
+func TestCrypto_FallbackAADs(t *testing.T) {
+	crypto := setupTestCrypto(t)
+	legacy, err := crypto.EncryptAndSign(map[string]string{"msg": "old"}, nil)
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	var out map[string]string
+	if err := crypto.DecryptAndVerify(legacy, &out, []byte("sess")); !errors.Is(err, ErrEncryptionFailed) {
+		t.Fatalf("expected legacy payload to fail without fallback, got %v", err)
+	}
+
+	crypto.WithFallbackAADs([]byte("older-name"), nil)
+	if err := crypto.DecryptAndVerify(legacy, &out, []byte("sess")); err != nil || out["msg"] != "old" {
+		t.Fatalf("expected fallback AAD to open legacy payload: %v", err)
+	}
+	current, _ := crypto.EncryptAndSign(map[string]string{"msg": "new"}, []byte("sess"))
+	if err := crypto.DecryptAndVerify(current, &out, []byte("sess")); err != nil || out["msg"] != "new" {
+		t.Fatalf("canonical AAD should still work: %v", err)
+	}
+	if err := crypto.DecryptAndVerify(current, &out, []byte("other")); err == nil {
+		t.Fatalf("fallbacks must not open payloads sealed for a different AAD")
+	}
+}
+
+func TestRedisStore_SetExpiresAt(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "sess-exp")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	tokenExp := time.Now().Add(5 * time.Second).Truncate(time.Second)
+	sess.SetExpiresAt(tokenExp)
+	if !sess.ExpiresAt().Equal(tokenExp) || !sess.IsDirty() {
+		t.Fatalf("SetExpiresAt did not pin expiry or mark the session dirty")
+	}
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if sess.IsDirty() {
+		t.Fatalf("expected Save to clear the dirty flag")
+	}
+	ttl := store.client.PTTL(ctx, store.redisKey("sess-exp", sess.ID())).Val()
+	if ttl <= 3*time.Second || ttl > 5*time.Second {
+		t.Fatalf("Redis TTL %v not aligned with pinned expiry", ttl)
+	}
+	if c := w.Result().Cookies()[0]; !c.Expires.Equal(tokenExp) {
+		t.Fatalf("cookie expiry %v, want %v", c.Expires, tokenExp)
+	}
+
+	sess.SetExpiresAt(time.Now().Add(-time.Second))
+	if err := store.Save(req, httptest.NewRecorder(), sess); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected ErrSessionExpired for past expiry, got %v", err)
+	}
+}
+
+func TestRedisStore_SubSecondTTL(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		prec TTLPrecision
+		min  time.Duration
+		max  time.Duration
+	}{
+		{"seconds", SecondPrecision, 900 * time.Millisecond, time.Second},
+		{"milliseconds", MillisecondPrecision, 1, 500 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := setupTestStore(t).WithTTLPrecision(tc.prec)
+			req := httptest.NewRequest("GET", "/", nil)
+			sess, err := store.New(req, "sess-ttl")
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			sess.SetExpiresAt(time.Now().Add(500 * time.Millisecond))
+			if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			ttl := store.client.PTTL(context.Background(), store.redisKey("sess-ttl", sess.ID())).Val()
+			if ttl < tc.min || ttl > tc.max {
+				t.Fatalf("ttl %v outside [%v, %v]", ttl, tc.min, tc.max)
+			}
+		})
+	}
+}
+
+func TestRedisStore_BeforeSave(t *testing.T) {
+	errAbort := errors.New("abort")
+	store := setupTestStore(t).WithBeforeSave(func(s *Session) error {
+		s.Delete("db_object")
+		switch s.Get("mode") {
+		case "skip":
+			return ErrSkipSave
+		case "abort":
+			return errAbort
+		}
+		return nil
+	})
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, err := store.New(req, "sess-before")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	key := store.redisKey("sess-before", sess.ID())
+
+	sess.Set("mode", "skip")
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("skip: expected nil error, got %v", err)
+	}
+	if store.client.Exists(ctx, key).Val() != 0 || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("skip: expected no Redis write and no cookie")
+	}
+
+	sess.Set("mode", "abort")
+	if err := store.Save(req, httptest.NewRecorder(), sess); !errors.Is(err, errAbort) {
+		t.Fatalf("abort: expected hook error, got %v", err)
+	}
+
+	sess.Set("mode", "save")
+	sess.Set("db_object", "heavy")
+	w = httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, err := store.load(ctx, "sess-before", sess.ID())
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if loaded.Get("db_object") != nil || loaded.Get("mode") != "save" {
+		t.Fatalf("expected scrubbed key to be absent from stored session")
+	}
+}
+
+func TestTypedStore_RoundTrip(t *testing.T) {
+	type profile struct {
+		UserID int64    `json:"user_id"`
+		Roles  []string `json:"roles"`
+	}
+	store := NewTypedStore[profile](setupTestStore(t))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "typed")
+	if err != nil || !sess.IsNew() {
+		t.Fatalf("New: %v", err)
+	}
+	sess.Data = profile{UserID: 1 << 53, Roles: []string{"admin"}}
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(w.Result().Cookies()[0])
+	loaded, err := store.New(req2, "typed")
+	if err != nil || loaded.IsNew() {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if loaded.Data.UserID != 1<<53 || len(loaded.Data.Roles) != 1 || loaded.ID() != sess.ID() {
+		t.Fatalf("typed data mismatch: %+v", loaded.Data)
+	}
+
+	if err := store.Destroy(req2, httptest.NewRecorder(), loaded); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	again, err := store.New(req2, "typed")
+	if err != nil || !again.IsNew() {
+		t.Fatalf("expected fresh session after destroy")
+	}
+}
+
+func TestRedisStore_LoadByID(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, err := store.New(req, "sess-id")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	sess.Set("device", "tv")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	loaded, err := store.LoadByID(ctx, "sess-id", sess.ID())
+	if err != nil || loaded.IsNew() || loaded.Get("device") != "tv" {
+		t.Fatalf("LoadByID: %v", err)
+	}
+	missing, _ := store.crypto.GenerateSessionID()
+	if _, err := store.LoadByID(ctx, "sess-id", missing); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	if _, err := store.LoadByID(ctx, "sess-id", "not-an-id"); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound for malformed id, got %v", err)
+	}
+}
+
+func TestRedisStore_ExpirySkew(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	id, _ := store.crypto.GenerateSessionID()
+	sess := NewSession(id, -200*time.Millisecond)
+	sess.setName("sess-skew")
+	enc, _ := store.crypto.EncryptAndSign(sess, []byte("sess-skew"))
+	key := store.redisKey("sess-skew", id)
+
+	store.client.Set(ctx, key, enc, time.Minute)
+	store.WithExpirySkew(time.Second)
+	if _, err := store.load(ctx, "sess-skew", id); err != nil {
+		t.Fatalf("expected session within skew to load, got %v", err)
+	}
+
+	store.WithExpirySkew(0)
+	if _, err := store.load(ctx, "sess-skew", id); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected strict check to expire session, got %v", err)
+	}
+}
+
+func TestRedisStore_ListNames(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	for i, name := range []string{"b-sess", "a-sess", "b-sess", "ns:sess"} {
+		store.client.Set(ctx, store.redisKey(name, fmt.Sprintf("id%d", i)), "x", time.Minute)
+	}
+	store.client.Set(ctx, "other:x:y", "x", time.Minute)
+
+	names, err := store.ListNames(ctx)
+	if err != nil {
+		t.Fatalf("ListNames: %v", err)
+	}
+	if want := []string{"a-sess", "b-sess", "ns:sess"}; !slices.Equal(names, want) {
+		t.Fatalf("ListNames = %v, want %v", names, want)
+	}
+}
+
+func TestRedisStore_SizeReporter(t *testing.T) {
+	var got PayloadStats
+	store := setupTestStore(t).WithSizeReporter(func(s *Session, stats PayloadStats) {
+		got = stats
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, err := store.New(req, "sess-size")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	sess.Set("blob", strings.Repeat("x", 500))
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	stored := store.client.Get(context.Background(), store.redisKey("sess-size", sess.ID())).Val()
+	aead := store.crypto.aead
+	if got.EncodedSize != len(stored) {
+		t.Fatalf("EncodedSize %d, stored %d", got.EncodedSize, len(stored))
+	}
+	if got.SealedSize != got.PlaintextSize+aead.NonceSize()+aead.Overhead()+sha256.Size {
+		t.Fatalf("unexpected sealed size breakdown %+v", got)
+	}
+	if got.EncodedSize != base64.RawStdEncoding.EncodedLen(got.SealedSize) {
+		t.Fatalf("unexpected encoded size %+v", got)
+	}
+}
+
+func TestRedisStore_WithDeadline(t *testing.T) {
+	store := setupTestStore(t)
+
+	ctx, cancel := store.WithDeadline(context.Background(), time.Nanosecond)
+	defer cancel()
+	time.Sleep(time.Millisecond)
+
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	id, _ := store.crypto.GenerateSessionID()
+	req.AddCookie(&http.Cookie{Name: "sess-deadline", Value: id})
+	if _, err := store.New(req, "sess-deadline"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("New: expected context.DeadlineExceeded, got %v", err)
+	}
+	sess := NewSession(id, time.Minute)
+	sess.setName("sess-deadline")
+	if err := store.Save(req, httptest.NewRecorder(), sess); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Save: expected context.DeadlineExceeded, got %v", err)
+	}
+
+	store.WithSessionBudget(time.Nanosecond)
+	rec := httptest.NewRecorder()
+	store.Middleware("sess-deadline")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("never sent"))
+	})).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 from middleware, got %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "never sent") {
+		t.Fatalf("handler output should be discarded after a failed save")
+	}
+}
+
+func TestSession_Update(t *testing.T) {
+	sess := NewSession("upd", time.Hour)
+	sess.Set("balance", 10)
+	before := sess.UpdatedAt()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sess.Update(func(v map[string]interface{}) {
+				v["balance"] = v["balance"].(int) + 1
+				v["ops"], _ = v["ops"].(int)
+				v["ops"] = v["ops"].(int) + 1
+			})
+		}()
+	}
+	wg.Wait()
+
+	if sess.Get("balance") != 60 || sess.Get("ops") != 50 {
+		t.Fatalf("lost updates: balance=%v ops=%v", sess.Get("balance"), sess.Get("ops"))
+	}
+	if sess.UpdatedAt().Before(before) || !sess.IsDirty() {
+		t.Fatalf("Update should bump updatedAt and mark the session dirty")
+	}
+}
+
+func TestCookieStore_RoundTrip(t *testing.T) {
+	options := DefaultCookieOptions()
+	options.ChunkSize = 200
+	store := NewCookieStore(setupTestCrypto(t), options).WithMaxSize(2000)
+
+	req := WithSessionStore(httptest.NewRequest("GET", "/", nil), store)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "cs")
+	if err != nil || !sess.IsNew() {
+		t.Fatalf("New: %v", err)
+	}
+	sess.Set("user", "alice")
+	sess.Set("padding", strings.Repeat("p", 300))
+	if err := sess.Save(req, w); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) < 2 {
+		t.Fatalf("expected payload to be chunked, got %d cookies", len(cookies))
+	}
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	for _, c := range cookies {
+		req2.AddCookie(c)
+	}
+	loaded, err := store.New(req2, "cs")
+	if err != nil || loaded.IsNew() || loaded.Get("user") != "alice" || loaded.ID() != sess.ID() {
+		t.Fatalf("cookie session not restored: %v", err)
+	}
+
+	loaded.Set("padding", strings.Repeat("p", 3000))
+	if err := store.Save(req2, httptest.NewRecorder(), loaded); !errors.Is(err, ErrCookieTooLarge) {
+		t.Fatalf("expected ErrCookieTooLarge, got %v", err)
+	}
+
+	w2 := httptest.NewRecorder()
+	if err := store.Destroy(req2, w2, loaded); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	deleted := make(map[string]bool)
+	for _, c := range w2.Result().Cookies() {
+		deleted[c.Name] = c.MaxAge == -1
+	}
+	for _, c := range cookies {
+		if !deleted[c.Name] {
+			t.Fatalf("chunk %s not deleted", c.Name)
+		}
+	}
+}
+
+func TestRedisStore_NewWithValues(t *testing.T) {
+	store := setupTestStore(t)
+	seed := map[string]interface{}{"user": "alice", "role": "admin"}
+
+	sess, err := store.NewWithValues("sess-seed", seed)
+	if err != nil {
+		t.Fatalf("NewWithValues: %v", err)
+	}
+	seed["role"] = "guest"
+	seed["extra"] = true
+	if sess.Get("role") != "admin" || sess.Get("extra") != nil || !sess.IsNew() || sess.IsDirty() {
+		t.Fatalf("session should hold a private copy of the seed values")
+	}
+	if !sess.CreatedAt().Equal(sess.UpdatedAt()) {
+		t.Fatalf("seeding should not bump updatedAt")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(w.Result().Cookies()[0])
+	loaded, err := store.New(req2, "sess-seed")
+	if err != nil || loaded.Get("user") != "alice" {
+		t.Fatalf("seeded session not persisted: %v", err)
+	}
+}
+
+func TestRedisStore_Labels(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	save := func(labels ...string) *Session {
+		req := httptest.NewRequest("GET", "/", nil)
+		sess, err := store.New(req, "sess-label")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		for _, l := range labels {
+			sess.AddLabel(l)
+		}
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		return sess
+	}
+	eu1 := save("region:eu", "beta")
+	eu2 := save("region:eu")
+	us := save("region:us")
+
+	listed, err := store.ListByLabel(ctx, "region:eu")
+	if err != nil || len(listed) != 2 {
+		t.Fatalf("ListByLabel: %d sessions, err=%v", len(listed), err)
+	}
+	if !listed[0].HasLabel("region:eu") {
+		t.Fatalf("labels not persisted in payload")
+	}
+
+	eu2.RemoveLabel("region:eu")
+	if err := store.Save(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder(), eu2); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if n := store.client.SCard(ctx, store.labelKey("region:eu")).Val(); n != 1 {
+		t.Fatalf("expected removed label to be unindexed, set has %d members", n)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	if err := store.RotateID(req, httptest.NewRecorder(), eu1); err != nil {
+		t.Fatalf("RotateID: %v", err)
+	}
+	deleted, err := store.DestroyByLabel(ctx, "region:eu")
+	if err != nil || deleted != 1 {
+		t.Fatalf("DestroyByLabel: deleted %d, err=%v", deleted, err)
+	}
+	if _, err := store.LoadByID(ctx, "sess-label", eu1.ID()); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("labelled session survived DestroyByLabel: %v", err)
+	}
+	if _, err := store.LoadByID(ctx, "sess-label", us.ID()); err != nil {
+		t.Fatalf("unrelated session destroyed: %v", err)
+	}
+	if n := store.client.SCard(ctx, store.labelKey("beta")).Val(); n != 0 {
+		t.Fatalf("DestroyByLabel left the session in its other label sets")
+	}
+
+	// Dangling entry: us, deleted behind the store's back.
+	store.client.Del(ctx, store.redisKey("sess-label", us.ID()))
+	stats, err := store.Sweep(ctx)
+	if err != nil || stats.LabelsPruned != 1 {
+		t.Fatalf("Sweep should prune the dangling label entry: %+v %v", stats, err)
+	}
+}
+
+func TestRedisStore_SaveAsync(t *testing.T) {
+	store := setupTestStore(t).WithAsyncSaves(2, 16, func(s *Session, err error) {
+		t.Errorf("async save failed: %v", err)
+	})
+	ctx := context.Background()
+
+	var sessions []*Session
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		sess, err := store.New(req, "sess-async")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		sess.Set("n", i)
+		if err := store.SaveAsync(req, w, sess); err != nil {
+			t.Fatalf("SaveAsync: %v", err)
+		}
+		// Mutations after SaveAsync returns must not leak into the queued write.
+		sess.Set("n", -1)
+		if len(w.Result().Cookies()) != 1 {
+			t.Fatalf("expected cookie to be set synchronously")
+		}
+		sessions = append(sessions, sess)
+	}
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	for i, sess := range sessions {
+		loaded, err := store.LoadByID(ctx, "sess-async", sess.ID())
+		if err != nil {
+			t.Fatalf("LoadByID: %v", err)
+		}
+		if loaded.Get("n") != float64(i) {
+			t.Fatalf("session %d stored %v, want snapshot value %d", i, loaded.Get("n"), i)
+		}
+	}
+}
+
+func TestRedisStore_SaveAsyncAfterRotateOrDestroy(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	// Queue without workers, so the jobs wait until the session has moved on.
+	store.asyncOnce.Do(func() { store.asyncQueue = make(chan asyncSave, 4) })
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rotated, _ := store.New(req, "sess-async")
+	rotated.Set("n", 1)
+	if err := store.SaveAsync(req, httptest.NewRecorder(), rotated); err != nil {
+		t.Fatalf("SaveAsync: %v", err)
+	}
+	oldKey := store.redisKey("sess-async", rotated.ID())
+	if err := store.RotateID(req, httptest.NewRecorder(), rotated); err != nil {
+		t.Fatalf("RotateID: %v", err)
+	}
+
+	destroyed, _ := store.New(req, "sess-async")
+	if err := store.Save(req, httptest.NewRecorder(), destroyed); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	destroyed.Set("n", 2)
+	if err := store.SaveAsync(req, httptest.NewRecorder(), destroyed); err != nil {
+		t.Fatalf("SaveAsync: %v", err)
+	}
+	if err := store.DestroyCtx(ctx, destroyed); err != nil {
+		t.Fatalf("DestroyCtx: %v", err)
+	}
+
+	go store.asyncWorker()
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if store.client.Exists(ctx, oldKey).Val() != 0 {
+		t.Fatal("queued write resurrected the pre-rotation key")
+	}
+	if ok, _ := store.Exists(ctx, "sess-async", destroyed.ID()); ok {
+		t.Fatal("queued write resurrected a destroyed session")
+	}
+	if ok, _ := store.Exists(ctx, "sess-async", rotated.ID()); !ok {
+		t.Fatal("rotated session lost")
+	}
+}
+
+func TestRedisStore_FlushDuringSaveAsync(t *testing.T) {
+	store := setupTestStore(t).WithAsyncSaves(2, 16, nil)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				req := httptest.NewRequest("GET", "/", nil)
+				sess, _ := store.New(req, "sess-async")
+				sess.Set("n", i)
+				if err := store.SaveAsync(req, httptest.NewRecorder(), sess); err != nil {
+					t.Errorf("SaveAsync: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	// Flushes racing the saves must neither trip the race detector nor
+	// leave waiters behind when they time out.
+	for i := 0; i < 50; i++ {
+		short, cancel := context.WithTimeout(ctx, time.Millisecond)
+		_ = store.Flush(short)
+		cancel()
+	}
+	wg.Wait()
+	if err := store.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	store.asyncMu.Lock()
+	pending := store.asyncPending
+	store.asyncMu.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d writes still pending after Flush", pending)
+	}
+}
+
+func TestCookieOptions_NewCookieForID(t *testing.T) {
+	options := DefaultCookieOptions()
+	sess := NewSession("abc", time.Hour)
+	sess.setName("sess-id")
+
+	want := options.NewCookie(sess)
+	got := options.NewCookieForID("sess-id", "abc", sess.ExpiresAt())
+	if got.String() != want.String() {
+		t.Fatalf("NewCookieForID = %q, want %q", got.String(), want.String())
+	}
+}
+
+func TestRedisStore_SaveExpiryBoundary(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		offset  time.Duration
+		wantErr bool
+	}{
+		{"past", -time.Millisecond, true},
+		{"now", 0, false},
+		{"sub-second", 10 * time.Millisecond, false},
+		{"just under a second", 999 * time.Millisecond, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := setupTestStore(t)
+			req := httptest.NewRequest("GET", "/", nil)
+			sess, err := store.New(req, "sess-boundary")
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			// Pin expiry to a fixed instant slightly ahead of Save's own clock
+			// read so "now" does not drift into the past before Save runs.
+			exp := time.Now().Add(tc.offset)
+			if !tc.wantErr {
+				exp = exp.Add(time.Millisecond)
+			}
+			sess.SetExpiresAt(exp)
+			err = store.Save(req, httptest.NewRecorder(), sess)
+			if tc.wantErr {
+				if !errors.Is(err, ErrSessionExpired) {
+					t.Fatalf("expected ErrSessionExpired, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			ttl := store.client.PTTL(context.Background(), store.redisKey("sess-boundary", sess.ID())).Val()
+			if ttl < 900*time.Millisecond || ttl > time.Second {
+				t.Fatalf("Redis TTL %v, want at least one second", ttl)
+			}
+		})
+	}
+}
+
+func TestRedisStore_KeyFunc(t *testing.T) {
+	store := setupTestStore(t).WithKeyFunc(
+		func(prefix, name, id string) string {
+			return prefix + "v2:{" + name + "}:" + id
+		},
+		func(prefix, key string) (string, string, bool) {
+			rest, ok := strings.CutPrefix(key, prefix+"v2:{")
+			if !ok {
+				return "", "", false
+			}
+			name, id, ok := strings.Cut(rest, "}:")
+			return name, id, ok
+		},
+	)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "sess-key")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	sess.Set("user", "alice")
+	sess.AddLabel("admin")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	key := "test:v2:{sess-key}:" + sess.ID()
+	if n := store.client.Exists(ctx, key).Val(); n != 1 {
+		t.Fatalf("expected session under %q", key)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	loaded, err := store.Get(req, "sess-key")
+	if err != nil || loaded.IsNew() || loaded.Get("user") != "alice" {
+		t.Fatalf("Get through KeyFunc: %v, %v", loaded, err)
+	}
+	tagged, err := store.ListByLabel(ctx, "admin")
+	if err != nil || len(tagged) != 1 || tagged[0].ID() != sess.ID() {
+		t.Fatalf("ListByLabel = %v, %v", tagged, err)
+	}
+	names, err := store.ListNames(ctx)
+	if err != nil || !slices.Equal(names, []string{"sess-key"}) {
+		t.Fatalf("ListNames = %v, %v", names, err)
+	}
+	if n, err := store.DestroyAll(ctx); err != nil || n != 1 {
+		t.Fatalf("DestroyAll = %d, %v", n, err)
+	}
+}
+
+// failingHook fails the first n cmd commands (SET if cmd is empty) with err.
+type failingHook struct {
+	mu  sync.Mutex
+	n   int
+	err error
+	cmd string
+}
+
+func (h *failingHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *failingHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.mu.Lock()
+		name := h.cmd
+		if name == "" {
+			name = "set"
+		}
+		fail := cmd.Name() == name && h.n > 0
+		if fail {
+			h.n--
+		}
+		h.mu.Unlock()
+		if fail {
+			cmd.SetErr(h.err)
+			return h.err
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (h *failingHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisStore_Retry(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	t.Run("transient", func(t *testing.T) {
+		store := setupTestStore(t).WithRetry(3, time.Millisecond)
+		hook := &failingHook{n: 2, err: refused}
+		store.client.AddHook(hook)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		sess, _ := store.New(req, "sess-retry")
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save should succeed after retries: %v", err)
+		}
+		if hook.n != 0 {
+			t.Fatalf("expected both failures to be consumed, %d left", hook.n)
+		}
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		store := setupTestStore(t).WithRetry(2, time.Millisecond)
+		store.client.AddHook(&failingHook{n: 5, err: refused})
+
+		req := httptest.NewRequest("GET", "/", nil)
+		sess, _ := store.New(req, "sess-retry")
+		if err := store.Save(req, httptest.NewRecorder(), sess); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("expected ECONNREFUSED after retries, got %v", err)
+		}
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		store := setupTestStore(t).WithRetry(3, time.Millisecond)
+		hook := &failingHook{n: 1, err: errors.New("ERR wrong number of arguments")}
+		store.client.AddHook(hook)
+
+		req := httptest.NewRequest("GET", "/", nil)
+		sess, _ := store.New(req, "sess-retry")
+		if err := store.Save(req, httptest.NewRecorder(), sess); err == nil {
+			t.Fatalf("expected command error to be returned without retry")
+		}
+	})
+
+	t.Run("deadline", func(t *testing.T) {
+		store := setupTestStore(t).WithRetry(5, time.Second)
+		hook := &failingHook{n: 5, err: refused}
+		store.client.AddHook(hook)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+		sess, _ := store.New(req, "sess-retry")
+		start := time.Now()
+		if err := store.Save(req, httptest.NewRecorder(), sess); err == nil {
+			t.Fatalf("expected Save to fail")
+		}
+		if time.Since(start) > 500*time.Millisecond || hook.n != 4 {
+			t.Fatalf("retry ignored the request deadline (%d failures left)", hook.n)
+		}
+	})
+}
+
+func TestCrypto_Overhead(t *testing.T) {
+	crypto := setupTestCrypto(t)
+	_, stats, err := crypto.EncryptAndSignWithStats(map[string]string{"user": "alice"}, nil)
+	if err != nil {
+		t.Fatalf("EncryptAndSignWithStats: %v", err)
+	}
+	if got := stats.PlaintextSize + crypto.Overhead(); got != stats.SealedSize {
+		t.Fatalf("plaintext + Overhead = %d, sealed size %d", got, stats.SealedSize)
+	}
+	if got := base64.RawStdEncoding.EncodedLen(stats.SealedSize); got != stats.EncodedSize {
+		t.Fatalf("EncodedLen = %d, encoded size %d", got, stats.EncodedSize)
+	}
+}
+
+func TestRedisStore_Reseal(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	// A session sealed without AAD, as by an older version, opens only via
+	// the fallback until Reseal rewrites it under the current AAD.
+	sess := NewSession("", 5*time.Second)
+	id, _ := store.crypto.GenerateSessionID()
+	sess.setID(id)
+	sess.setName("sess-reseal")
+	sess.Set("user", "alice")
+	legacy, err := store.crypto.EncryptAndSign(sess, nil)
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	key := store.redisKey("sess-reseal", id)
+	store.client.Set(ctx, key, legacy, 5*time.Second)
+
+	store.crypto.WithFallbackAADs(nil)
+	if err := store.Reseal(ctx, "sess-reseal", id); err != nil {
+		t.Fatalf("Reseal: %v", err)
+	}
+	store.crypto.WithFallbackAADs()
+
+	if ttl := store.client.PTTL(ctx, key).Val(); ttl <= 4*time.Second || ttl > 5*time.Second {
+		t.Fatalf("Reseal did not preserve TTL: %v", ttl)
+	}
+	loaded, err := store.LoadByID(ctx, "sess-reseal", id)
+	if err != nil {
+		t.Fatalf("LoadByID after Reseal: %v", err)
+	}
+	if loaded.Get("user") != "alice" || !loaded.CreatedAt().Equal(sess.CreatedAt()) {
+		t.Fatalf("Reseal changed the session: %v", loaded.Snapshot())
+	}
+
+	missing, _ := store.crypto.GenerateSessionID()
+	if err := store.Reseal(ctx, "sess-reseal", missing); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestRedisStore_SameSiteUpgrade(t *testing.T) {
+	options := DefaultCookieOptionsLax()
+	options.Secure = false
+	store := NewRedisStore(setupTestRedis(t), "test:", setupTestCrypto(t), options)
+
+	req := httptest.NewRequest("GET", "/oauth/callback", nil)
+	w := httptest.NewRecorder()
+	sess, err := store.New(req, "sess-samesite")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+	if cookie.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("landing cookie SameSite = %v, want Lax", cookie.SameSite)
+	}
+
+	req = httptest.NewRequest("GET", "/login/done", nil)
+	req.AddCookie(cookie)
+	sess, err = store.Get(req, "sess-samesite")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	sess.SetSameSite(http.SameSiteStrictMode)
+	w = httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Result().Cookies()[0].SameSite; got != http.SameSiteStrictMode {
+		t.Fatalf("upgraded cookie SameSite = %v, want Strict", got)
+	}
+
+	// The upgrade sticks on later requests.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	sess, err = store.Get(req, "sess-samesite")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	w = httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Result().Cookies()[0].SameSite; got != http.SameSiteStrictMode {
+		t.Fatalf("reloaded cookie SameSite = %v, want Strict", got)
+	}
+}
+
+func TestRedisStore_SetIfAbsent(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-once")
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	var wins sync.WaitGroup
+	results := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		wins.Add(1)
+		go func(i int) {
+			defer wins.Done()
+			ok, err := store.SetIfAbsent(ctx, "sess-once", sess.ID(), "token_used", i)
+			if err != nil {
+				t.Errorf("SetIfAbsent: %v", err)
+			}
+			results <- ok
+		}(i)
+	}
+	wins.Wait()
+	close(results)
+	won := 0
+	for ok := range results {
+		if ok {
+			won++
+		}
+	}
+	if won != 1 {
+		t.Fatalf("expected exactly one caller to set the value, got %d", won)
+	}
+
+	loaded, err := store.LoadByID(ctx, "sess-once", sess.ID())
+	if err != nil {
+		t.Fatalf("LoadByID: %v", err)
+	}
+	if loaded.Get("token_used") == nil || loaded.Get("user") != "alice" {
+		t.Fatalf("unexpected values after SetIfAbsent: %v", loaded.Snapshot())
+	}
+	if ttl := store.client.PTTL(ctx, store.redisKey("sess-once", sess.ID())).Val(); ttl <= 0 {
+		t.Fatalf("SetIfAbsent dropped the TTL: %v", ttl)
+	}
+
+	missing, _ := store.crypto.GenerateSessionID()
+	if _, err := store.SetIfAbsent(ctx, "sess-once", missing, "k", 1); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestRedisStore_RotatePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy RotatePolicy
+		want   []string
+	}{
+		{"keep all", KeepAllValues(), []string{"csrf_nonce", "oauth_state", "user"}},
+		{"drop pre-auth", DropValues("csrf_nonce", "oauth_state"), []string{"user"}},
+		{"keep only", KeepOnlyValues("user", "missing"), []string{"user"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := setupTestStore(t).WithRotatePolicy(tc.policy)
+			ctx := context.Background()
+			req := httptest.NewRequest("GET", "/", nil)
+			sess, _ := store.New(req, "sess-rotate")
+			sess.Set("csrf_nonce", "n0nce")
+			sess.Set("oauth_state", "st4te")
+			if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+
+			// Login completes: the user is recorded and the id rotated.
+			sess.Set("user", "alice")
+			if err := store.RotateID(req, httptest.NewRecorder(), sess); err != nil {
+				t.Fatalf("RotateID: %v", err)
+			}
+			loaded, err := store.LoadByID(ctx, "sess-rotate", sess.ID())
+			if err != nil {
+				t.Fatalf("LoadByID: %v", err)
+			}
+			var got []string
+			loaded.Update(func(values map[string]interface{}) {
+				for k := range values {
+					got = append(got, k)
+				}
+			})
+			slices.Sort(got)
+			if !slices.Equal(got, tc.want) {
+				t.Fatalf("values after rotation = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRedisStore_EmptySessionFastPath(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-empty")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	key := store.redisKey("sess-empty", sess.ID())
+	stored := store.client.Get(ctx, key).Val()
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	sess, err := store.Get(req, "sess-empty")
+	if err != nil || sess.IsNew() {
+		t.Fatalf("Get: %v", err)
+	}
+	w = httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if store.client.Get(ctx, key).Val() != stored {
+		t.Fatalf("unchanged empty session was rewritten")
+	}
+	if len(w.Result().Cookies()) != 1 {
+		t.Fatalf("expected the cookie to still be refreshed")
+	}
+
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if store.client.Get(ctx, key).Val() == stored {
+		t.Fatalf("modified session was not written")
+	}
+
+	lazy := setupTestStore(t).WithLazyNewSessions(true)
+	req = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	sess, _ = lazy.New(req, "sess-lazy")
+	if err := lazy.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if len(w.Result().Cookies()) != 0 || lazy.client.Exists(ctx, lazy.redisKey("sess-lazy", sess.ID())).Val() != 0 {
+		t.Fatalf("lazy store persisted an empty new session")
+	}
+	w = httptest.NewRecorder()
+	if err := lazy.SaveAsync(req, w, sess); err != nil {
+		t.Fatalf("SaveAsync: %v", err)
+	}
+	if err := lazy.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(w.Result().Cookies()) != 0 || lazy.client.Exists(ctx, lazy.redisKey("sess-lazy", sess.ID())).Val() != 0 {
+		t.Fatalf("lazy store persisted an empty new session asynchronously")
+	}
+	sess.Set("user", "alice")
+	if err := lazy.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if lazy.client.Exists(ctx, lazy.redisKey("sess-lazy", sess.ID())).Val() != 1 {
+		t.Fatalf("lazy store did not persist a session with values")
+	}
+}
+
+func TestRedisStore_LazyNewSessionsFunc(t *testing.T) {
+	// Visitors count as anonymous until they put something in a cart.
+	store := setupTestStore(t).WithLazyNewSessionsFunc(func(s *Session) bool {
+		return s.Get("cart") == nil
+	})
+	ctx := context.Background()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	sess, _ := store.New(req, "sess-cow")
+	sess.Set("theme", "light")
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if len(w.Result().Cookies()) != 0 || store.client.Exists(ctx, store.redisKey("sess-cow", sess.ID())).Val() != 0 {
+		t.Fatalf("a new session holding only defaults was persisted")
+	}
+
+	sess.Set("cart", "item-1")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if store.client.Exists(ctx, store.redisKey("sess-cow", sess.ID())).Val() != 1 {
+		t.Fatalf("the first real change should materialize the session")
+	}
+}
+
+func BenchmarkRedisStore_SaveEmpty(b *testing.B) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	b.Run("new", func(b *testing.B) {
+		store := setupTestStore(b)
+		for i := 0; i < b.N; i++ {
+			sess, _ := store.New(req, "sess-bench")
+			if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("new lazy", func(b *testing.B) {
+		store := setupTestStore(b).WithLazyNewSessions(true)
+		for i := 0; i < b.N; i++ {
+			sess, _ := store.New(req, "sess-bench")
+			if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("loaded unchanged", func(b *testing.B) {
+		store := setupTestStore(b)
+		sess, _ := store.New(req, "sess-bench")
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			b.Fatal(err)
+		}
+		loaded, err := store.LoadByID(context.Background(), "sess-bench", sess.ID())
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := store.Save(req, httptest.NewRecorder(), loaded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type countingCodec struct {
+	JSONCodec
+	marshals, unmarshals int
+}
+
+func (c *countingCodec) Marshal(v interface{}) ([]byte, error) {
+	c.marshals++
+	return c.JSONCodec.Marshal(v)
+}
+
+func (c *countingCodec) Unmarshal(data []byte, v interface{}) error {
+	c.unmarshals++
+	return c.JSONCodec.Unmarshal(data, v)
+}
+
+func TestCrypto_WithCodec(t *testing.T) {
+	codec := &countingCodec{}
+	store := setupTestStore(t)
+	store.crypto.WithCodec(codec)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-codec")
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, err := store.LoadByID(context.Background(), "sess-codec", sess.ID())
+	if err != nil || loaded.Get("user") != "alice" {
+		t.Fatalf("LoadByID: %v, %v", loaded, err)
+	}
+	// Sessions must reach the codec as plain data, not via MarshalJSON.
+	if codec.marshals != 1 || codec.unmarshals != 1 {
+		t.Fatalf("codec used %d/%d times, want 1/1", codec.marshals, codec.unmarshals)
+	}
+}
+
+func TestSession_Flashes(t *testing.T) {
+	store := setupTestStore(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-flash")
+	sess.AddFlash("saved")
+	sess.AddFlash("profile updated")
+	sess.AddFlash("disk almost full", "warning")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	sess, err := store.Get(req, "sess-flash")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := sess.Flashes("warning"); !slices.Equal(got, []interface{}{"disk almost full"}) {
+		t.Fatalf("warning flashes = %v", got)
+	}
+	if got := sess.Flashes(); !slices.Equal(got, []interface{}{"saved", "profile updated"}) {
+		t.Fatalf("default flashes = %v", got)
+	}
+	if got := sess.Flashes(); got != nil {
+		t.Fatalf("flashes were not cleared: %v", got)
+	}
+	if got := sess.Flashes("error"); got != nil {
+		t.Fatalf("unexpected flashes for empty category: %v", got)
+	}
+	if !sess.IsDirty() {
+		t.Fatalf("reading flashes should mark the session dirty")
+	}
+
+	if v, ok := sess.Pop("missing"); ok || v != nil {
+		t.Fatalf("Pop on missing key = %v, %v", v, ok)
+	}
+	sess.Set("token", "abc")
+	if v, ok := sess.Pop("token"); !ok || v != "abc" || sess.Get("token") != nil {
+		t.Fatalf("Pop = %v, %v", v, ok)
+	}
+}
+
+func TestNewStore_Options(t *testing.T) {
+	client := setupTestRedis(t)
+	crypto := setupTestCrypto(t)
+
+	store := NewStore(client, crypto)
+	if store.prefix != DefaultKeyPrefix || store.options == nil || store.options.MaxAge != DefaultCookieOptions().MaxAge {
+		t.Fatalf("unexpected defaults: prefix %q, options %+v", store.prefix, store.options)
+	}
+
+	options := DefaultCookieOptions()
+	options.Secure = false
+	store = NewStore(client, crypto,
+		WithKeyPrefix("app:"),
+		WithCookieOptions(options),
+		func(s *RedisStore) { s.WithMode(Rolling) },
+	)
+	if store.prefix != "app:" || store.options != options || store.mode != Rolling {
+		t.Fatalf("options not applied: prefix %q, mode %v", store.prefix, store.mode)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-opts")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if n := client.Exists(context.Background(), "app:sess-opts:"+sess.ID()).Val(); n != 1 {
+		t.Fatalf("session not stored under the configured prefix")
+	}
+}
+
+func TestRedisStore_DuplicateCookieRecovery(t *testing.T) {
+	store := setupTestStore(t)
+	store.options.Domain = "example.com"
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	stale, _ := store.New(req, "sess-dup")
+	stale.Set("who", "stale")
+	if err := store.Save(req, httptest.NewRecorder(), stale); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	fresh, _ := store.New(req, "sess-dup")
+	time.Sleep(2 * time.Millisecond)
+	fresh.Set("who", "fresh")
+	if err := store.Save(req, httptest.NewRecorder(), fresh); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "sess-dup", Value: "not-a-session"})
+		req.AddCookie(&http.Cookie{Name: "sess-dup", Value: stale.ID()})
+		req.AddCookie(&http.Cookie{Name: "sess-dup", Value: fresh.ID()})
+		return req
+	}
+
+	// Without recovery only the first, unusable, cookie is considered.
+	if sess, err := store.Get(newRequest(), "sess-dup"); err != nil || !sess.IsNew() {
+		t.Fatalf("expected a fresh session without recovery, got %v", err)
+	}
+
+	store.WithDuplicateCookieRecovery()
+	req = newRequest()
+	sess, err := store.Get(req, "sess-dup")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if sess.ID() != fresh.ID() || sess.Get("who") != "fresh" {
+		t.Fatalf("expected the most recently updated session, got %v", sess.Get("who"))
+	}
+
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("expected a removal and the session cookie, got %d cookies", len(cookies))
+	}
+	if c := cookies[0]; c.MaxAge >= 0 || c.Domain != "" {
+		t.Fatalf("expected the host-only duplicate to be expired, got %+v", c)
+	}
+	if c := cookies[1]; c.Value != fresh.ID() || c.Domain != "example.com" {
+		t.Fatalf("unexpected session cookie %+v", c)
+	}
+
+	// The duplicate is only cleared once.
+	w = httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if n := len(w.Result().Cookies()); n != 1 {
+		t.Fatalf("expected only the session cookie on a later save, got %d", n)
+	}
+	if _, err := store.LoadByID(ctx, "sess-dup", stale.ID()); err != nil {
+		t.Fatalf("stale session should be left in Redis: %v", err)
+	}
+}
+
+func TestCrypto_WithNewPrimary(t *testing.T) {
+	old := setupTestCrypto(t)
+	next := setupTestCrypto(t)
+	rotated := old.WithNewPrimary(next.aead, next.signingKey)
+	aad := []byte("sess")
+
+	oldSealed, err := old.EncryptAndSign(map[string]string{"gen": "old"}, aad)
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	newSealed, err := rotated.EncryptAndSign(map[string]string{"gen": "new"}, aad)
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	for _, tc := range []struct {
+		sealed, want string
+	}{
+		{oldSealed, "old"},
+		{newSealed, "new"},
+	} {
+		var got map[string]string
+		if err := rotated.DecryptAndVerify(tc.sealed, &got, aad); err != nil || got["gen"] != tc.want {
+			t.Fatalf("rotated Crypto failed to open %s payload: %v, %v", tc.want, got, err)
+		}
+	}
+
+	// New payloads are sealed with the new key only, and c is unchanged.
+	var got map[string]string
+	if err := next.DecryptAndVerify(newSealed, &got, aad); err != nil {
+		t.Fatalf("new payload not sealed with the new primary: %v", err)
+	}
+	if err := old.DecryptAndVerify(newSealed, &got, aad); err == nil {
+		t.Fatalf("WithNewPrimary modified the original Crypto")
+	}
+	// The legacy key verifies the signature, so its error wins over the
+	// primary's ErrSignatureInvalid.
+	if err := rotated.DecryptAndVerify(oldSealed, &got, []byte("other")); !errors.Is(err, ErrKeyMismatch) {
+		t.Fatalf("expected the legacy key's error for an unopenable payload, got %v", err)
+	}
+}
+
+func TestRedisStore_DeployTag(t *testing.T) {
+	blue := setupTestStore(t).WithDeployTag("blue")
+	green := NewRedisStore(blue.client, blue.prefix, blue.crypto, blue.options).WithDeployTag("green")
+	untagged := NewRedisStore(blue.client, blue.prefix, blue.crypto, blue.options)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := blue.New(req, "sess-deploy")
+	sess.Set("user", "alice")
+	if err := blue.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		return req
+	}
+
+	if loaded, err := blue.Get(newRequest(), "sess-deploy"); err != nil || loaded.IsNew() || loaded.Get("user") != "alice" {
+		t.Fatalf("same tag failed to load the session: %v", err)
+	}
+	for name, other := range map[string]*RedisStore{"green": green, "untagged": untagged} {
+		loaded, err := other.NewWithResult(newRequest(), "sess-deploy")
+		if !errors.Is(err, ErrEncryptionFailed) {
+			t.Fatalf("%s: expected ErrEncryptionFailed, got %v", name, err)
+		}
+		if !loaded.IsNew() || loaded.Get("user") != nil {
+			t.Fatalf("%s: read a session from another deploy", name)
+		}
+	}
+}
+
+func TestRedisStore_Exists(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-exists")
+	if ok, err := store.Exists(ctx, "sess-exists", sess.ID()); err != nil || ok {
+		t.Fatalf("Exists before Save = %v, %v", ok, err)
+	}
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if ok, err := store.Exists(ctx, "sess-exists", sess.ID()); err != nil || !ok {
+		t.Fatalf("Exists after Save = %v, %v", ok, err)
+	}
+	if ok, err := store.Exists(ctx, "other", sess.ID()); err != nil || ok {
+		t.Fatalf("Exists for another name = %v, %v", ok, err)
+	}
+	if ok, err := store.Exists(ctx, "sess-exists", "not-an-id"); err != nil || ok {
+		t.Fatalf("Exists for a malformed id = %v, %v", ok, err)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.Exists(cancelled, "sess-exists", sess.ID()); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRedisStore_Handler(t *testing.T) {
+	store := setupTestStore(t)
+	mux := http.NewServeMux()
+	mux.Handle("GET /items/{id}", store.Handler("sess-mux", func(w http.ResponseWriter, r *http.Request) {
+		sess := MustCurrent(r)
+		sess.Set("last_item", r.PathValue("id"))
+		fmt.Fprint(w, sess.ID())
+	}))
+	mux.HandleFunc("GET /plain", func(w http.ResponseWriter, r *http.Request) {
+		if Current(r) != nil {
+			t.Errorf("expected no session outside the middleware")
+		}
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected MustCurrent to panic outside the middleware")
+			}
+		}()
+		MustCurrent(r)
+	})
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/items/42", nil))
+	if w.Code != http.StatusOK || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("unexpected response %d with %d cookies", w.Code, len(w.Result().Cookies()))
+	}
+	loaded, err := store.LoadByID(context.Background(), "sess-mux", w.Body.String())
+	if err != nil || loaded.Get("last_item") != "42" {
+		t.Fatalf("session not saved by Handler: %v", err)
+	}
+
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/plain", nil))
+}
+
+func TestRedisStore_HashedKeys(t *testing.T) {
+	store := setupTestStore(t).WithHashedKeys([]byte("key-hashing-secret"))
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-hashed")
+	sess.Set("user", "alice")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	keys := store.client.Keys(ctx, "test:*").Val()
+	if len(keys) != 1 {
+		t.Fatalf("expected one key, got %v", keys)
+	}
+	if strings.Contains(keys[0], "sess-hashed") || strings.Contains(keys[0], sess.ID()) {
+		t.Fatalf("key %q leaks the name or id", keys[0])
+	}
+	if c := w.Result().Cookies()[0]; c.Value != sess.ID() {
+		t.Fatalf("cookie should carry the plain id")
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	loaded, err := store.Get(req, "sess-hashed")
+	if err != nil || loaded.IsNew() || loaded.Get("user") != "alice" {
+		t.Fatalf("Get under hashed keys: %v", err)
+	}
+	oldID := loaded.ID()
+	if err := store.RotateID(req, httptest.NewRecorder(), loaded); err != nil {
+		t.Fatalf("RotateID: %v", err)
+	}
+	if ok, _ := store.Exists(ctx, "sess-hashed", oldID); ok {
+		t.Fatalf("old hashed key survived RotateID")
+	}
+	if ok, _ := store.Exists(ctx, "sess-hashed", loaded.ID()); !ok {
+		t.Fatalf("rotated session not stored under its hashed key")
+	}
+	if err := store.Destroy(req, httptest.NewRecorder(), loaded); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	if n := len(store.client.Keys(ctx, "test:*").Val()); n != 0 {
+		t.Fatalf("Destroy left %d keys", n)
+	}
+}
+
+func TestRedisStore_HashedKeysDestroyAll(t *testing.T) {
+	store := setupTestStore(t).WithHashedKeys([]byte("key-hashing-secret")).WithRevocationList(true)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		sess, _ := store.New(req, "sess-hashed")
+		sess.AddLabel("admin")
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	store.client.ZAdd(ctx, store.revokedKey(), redis.Z{Score: float64(time.Now().Add(time.Hour).UnixMilli()), Member: "gone"})
+
+	deleted, err := store.DestroyAll(ctx)
+	if err != nil {
+		t.Fatalf("DestroyAll: %v", err)
+	}
+	if deleted != 3 {
+		t.Fatalf("expected 3 hashed sessions deleted, got %d", deleted)
+	}
+	for _, key := range store.client.Keys(ctx, "test:*").Val() {
+		if !store.isIndexKey(key) {
+			t.Fatalf("DestroyAll left session key %q", key)
+		}
+	}
+	if store.client.Exists(ctx, store.revokedKey()).Val() != 1 {
+		t.Fatalf("DestroyAll deleted the revocation list")
+	}
+}
+
+func TestRedisStore_DestroyUserSessionsRevokes(t *testing.T) {
+	store := setupTestStore(t).WithUserIndex("").WithRevocationList(true)
+	ctx := context.Background()
+
+	var sessions []*Session
+	for i := 0; i < 2; i++ {
+		sess, _ := store.New(httptest.NewRequest("GET", "/", nil), "sess-user")
+		sess.Set(DefaultUserIDKey, "carol")
+		sess.AddLabel("staff")
+		if err := store.SaveCtx(ctx, sess); err != nil {
+			t.Fatalf("SaveCtx: %v", err)
+		}
+		sessions = append(sessions, sess)
+	}
+	n, err := store.DestroyUserSessions(ctx, "carol")
+	if err != nil || n != 2 {
+		t.Fatalf("DestroyUserSessions = %d, %v; want 2", n, err)
+	}
+	for _, sess := range sessions {
+		if revoked, _ := store.isRevoked(ctx, store.redisKey(sess.Name(), sess.ID())); !revoked {
+			t.Fatal("DestroyUserSessions did not revoke the session")
+		}
+	}
+	if n := store.client.SCard(ctx, store.labelKey("staff")).Val(); n != 0 {
+		t.Fatalf("label index still holds %d destroyed sessions", n)
+	}
+	if store.client.Exists(ctx, store.userKey("carol")).Val() != 0 {
+		t.Fatal("user index set survived DestroyUserSessions")
+	}
+}
+
+func TestRedisStore_HashedKeysUserIndex(t *testing.T) {
+	store := setupTestStore(t).
+		WithHashedKeys([]byte("key-hashing-secret")).
+		WithUserIndex("").
+		WithMaxUserIndexSize(1, DestroyOldestSessions).
+		WithRevocationList(true)
+	admin := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 2})
+	ctx := context.Background()
+	admin.FlushDB(ctx)
+	t.Cleanup(func() {
+		admin.FlushDB(ctx)
+		admin.Close()
+	})
+	store.WithShards(map[string]*redis.Client{"admin": admin}, func(s *Session) string {
+		if s.Name() == "admin-sess" {
+			return "admin"
+		}
+		return ""
+	})
+
+	var sessions []*Session
+	for _, name := range []string{"sess-a", "sess-b", "admin-sess"} {
+		sess, _ := store.New(httptest.NewRequest("GET", "/", nil), name)
+		sess.Set(DefaultUserIDKey, "bob")
+		sess.AddLabel("staff")
+		if err := store.SaveCtx(ctx, sess); err != nil {
+			t.Fatalf("SaveCtx %s: %v", name, err)
+		}
+		sessions = append(sessions, sess)
+	}
+	if n := store.client.SCard(ctx, store.userKey("bob")).Val(); n != 3 {
+		t.Fatalf("user index holds %d entries; hashed keys must not be trimmed", n)
+	}
+	if _, err := store.Sweep(ctx); err != nil {
+		t.Fatalf("Sweep: %v", err)
+	}
+	if n := store.client.SCard(ctx, store.userKey("bob")).Val(); n != 3 {
+		t.Fatalf("user index holds %d entries after Sweep; live hashed keys must not be pruned", n)
+	}
+
+	n, err := store.DestroyUserSessions(ctx, "bob")
+	if err != nil || n != 3 {
+		t.Fatalf("DestroyUserSessions = %d, %v; want 3", n, err)
+	}
+	for _, sess := range sessions {
+		if ok, _ := store.Exists(ctx, sess.Name(), sess.ID()); ok {
+			t.Fatalf("%s survived DestroyUserSessions", sess.Name())
+		}
+		if revoked, _ := store.isRevoked(ctx, store.redisKey(sess.Name(), sess.ID())); !revoked {
+			t.Fatalf("%s not revoked by DestroyUserSessions", sess.Name())
+		}
+	}
+
+	sess, _ := store.New(httptest.NewRequest("GET", "/", nil), "sess-a")
+	sess.AddLabel("staff")
+	if err := store.SaveCtx(ctx, sess); err != nil {
+		t.Fatalf("SaveCtx: %v", err)
+	}
+	if n, err := store.DestroyByLabel(ctx, "staff"); err != nil || n != 1 {
+		t.Fatalf("DestroyByLabel = %d, %v; want 1", n, err)
+	}
+}
+
+func TestSession_GetDefault(t *testing.T) {
+	store := setupTestStore(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-default")
+	sess.Set("name", "alice")
+	sess.Set("visits", 3)
+	sess.Set("big", int64(1)<<40)
+	sess.Set("ratio", 0.5)
+	sess.Set("admin", true)
+	sess.Set("nil", nil)
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(w.Result().Cookies()[0])
+	loaded, err := store.Get(req, "sess-default")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	// Check both the in-memory values and the JSON round-tripped ones.
+	for label, s := range map[string]*Session{"memory": sess, "loaded": loaded} {
+		if got := s.GetDefault("missing", "fb"); got != "fb" {
+			t.Errorf("%s: GetDefault(missing) = %v", label, got)
+		}
+		if got := s.GetDefault("nil", "fb"); got != nil {
+			t.Errorf("%s: GetDefault on a stored nil = %v, want nil", label, got)
+		}
+		if got := s.GetStringDefault("name", "x"); got != "alice" {
+			t.Errorf("%s: GetStringDefault = %q", label, got)
+		}
+		if got := s.GetStringDefault("visits", "x"); got != "x" {
+			t.Errorf("%s: GetStringDefault on a number = %q", label, got)
+		}
+		if got := s.GetIntDefault("visits", -1); got != 3 {
+			t.Errorf("%s: GetIntDefault = %d", label, got)
+		}
+		if got := s.GetIntDefault("ratio", -1); got != -1 {
+			t.Errorf("%s: GetIntDefault on a fraction = %d", label, got)
+		}
+		if got := s.GetIntDefault("name", -1); got != -1 {
+			t.Errorf("%s: GetIntDefault on a string = %d", label, got)
+		}
+		if got := s.GetInt64Default("big", -1); got != 1<<40 {
+			t.Errorf("%s: GetInt64Default = %d", label, got)
+		}
+		if got := s.GetFloat64Default("ratio", -1); got != 0.5 {
+			t.Errorf("%s: GetFloat64Default = %v", label, got)
+		}
+		if got := s.GetFloat64Default("missing", -1); got != -1 {
+			t.Errorf("%s: GetFloat64Default(missing) = %v", label, got)
+		}
+		if got := s.GetBoolDefault("admin", false); !got {
+			t.Errorf("%s: GetBoolDefault = %v", label, got)
+		}
+		if got := s.GetBoolDefault("name", false); got {
+			t.Errorf("%s: GetBoolDefault on a string = %v", label, got)
+		}
+	}
+}
+
+func TestRedisStore_TLSClientCertBinding(t *testing.T) {
+	store := setupTestStore(t).WithBinding(TLSClientCertBinding)
+	withCert := func(req *http.Request, raw string) *http.Request {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: []byte(raw)}}}
+		return req
+	}
+
+	req := withCert(httptest.NewRequest("GET", "/", nil), "cert-a")
+	w := httptest.NewRecorder()
+	sess, _ := store.New(req, "sess-bind")
+	sess.Set("user", "alice")
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := w.Result().Cookies()[0]
+
+	req = withCert(httptest.NewRequest("GET", "/", nil), "cert-a")
+	req.AddCookie(cookie)
+	if loaded, err := store.NewWithResult(req, "sess-bind"); err != nil || loaded.IsNew() {
+		t.Fatalf("same certificate failed to load the session: %v", err)
+	}
+
+	for name, req := range map[string]*http.Request{
+		"other cert": withCert(httptest.NewRequest("GET", "/", nil), "cert-b"),
+		"no cert":    httptest.NewRequest("GET", "/", nil),
+	} {
+		req.AddCookie(cookie)
+		loaded, err := store.NewWithResult(req, "sess-bind")
+		if !errors.Is(err, ErrSessionBindingMismatch) {
+			t.Fatalf("%s: expected ErrSessionBindingMismatch, got %v", name, err)
+		}
+		if !loaded.IsNew() || loaded.Get("user") != nil {
+			t.Fatalf("%s: bound session was handed out", name)
+		}
+	}
+
+	// Without mTLS sessions are simply left unbound.
+	req = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	plain, _ := store.New(req, "sess-bind")
+	plain.Set("user", "bob")
+	if err := store.Save(req, w, plain); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	req = withCert(httptest.NewRequest("GET", "/", nil), "cert-b")
+	req.AddCookie(w.Result().Cookies()[0])
+	if loaded, err := store.NewWithResult(req, "sess-bind"); err != nil || loaded.IsNew() {
+		t.Fatalf("unbound session failed to load: %v", err)
+	}
+}
+
+func TestCrypto_UnixTimestamps(t *testing.T) {
+	classic := setupTestCrypto(t)
+	unix := NewCrypto(classic.aead, classic.signingKey).WithUnixTimestamps(true)
+	aad := []byte("sess")
+
+	sess := NewSession("id", time.Hour)
+	sess.Set("user", "alice")
+	plain := struct {
+		classic, unix []byte
+	}{}
+	plain.classic, _ = classic.marshal(sess)
+	plain.unix, _ = unix.marshal(sess)
+	if !bytes.Contains(plain.unix, []byte(`"created_at":`+strconv.FormatInt(sess.CreatedAt().UnixMilli(), 10))) {
+		t.Fatalf("expected Unix millisecond timestamps, got %s", plain.unix)
+	}
+	if len(plain.unix) >= len(plain.classic) {
+		t.Fatalf("Unix timestamps did not shrink the payload: %d >= %d", len(plain.unix), len(plain.classic))
+	}
+
+	// Payloads in either format open under either setting.
+	for _, from := range []*Crypto{classic, unix} {
+		sealed, err := from.EncryptAndSign(sess, aad)
+		if err != nil {
+			t.Fatalf("EncryptAndSign: %v", err)
+		}
+		for _, to := range []*Crypto{classic, unix} {
+			var got Session
+			if err := to.DecryptAndVerify(sealed, &got, aad); err != nil {
+				t.Fatalf("DecryptAndVerify: %v", err)
+			}
+			if got.Get("user") != "alice" || got.ExpiresAt().UnixMilli() != sess.ExpiresAt().UnixMilli() {
+				t.Fatalf("mixed-format read mismatch (unix %v -> %v): %s", from.unixTimes, to.unixTimes, got.Snapshot())
+			}
+		}
+	}
+}
+
+func BenchmarkCrypto_Timestamps(b *testing.B) {
+	sess := NewSession("id", time.Hour)
+	sess.Set("user", "alice")
+	aad := []byte("sess")
+	for _, unixTimes := range []bool{false, true} {
+		name := "rfc3339"
+		if unixTimes {
+			name = "unix"
+		}
+		b.Run(name, func(b *testing.B) {
+			crypto := setupTestCrypto(b).WithUnixTimestamps(unixTimes)
+			var sealed string
+			for i := 0; i < b.N; i++ {
+				var err error
+				sealed, err = crypto.EncryptAndSign(sess, aad)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var out Session
+				if err := crypto.DecryptAndVerify(sealed, &out, aad); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(sealed)), "payload-bytes")
+		})
+	}
+}
+
+func TestRedisStore_RollingIgnoresPayloadExpiry(t *testing.T) {
+	store := setupTestStore(t).WithMode(Rolling)
+	ctx := context.Background()
+
+	// A Rolling session loaded a while ago: the TTL was slid, the payload
+	// still carries the expiry from its last save.
+	id, _ := store.crypto.GenerateSessionID()
+	sess := NewSession(id, time.Minute)
+	sess.setName("sess-rolling")
+	sess.SetExpiresAt(time.Now().Add(-time.Minute))
+	encrypted, _, err := store.seal(sess, "sess-rolling", sess.ID())
+	if err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	key := store.redisKey("sess-rolling", sess.ID())
+	store.client.Set(ctx, key, encrypted, 5*time.Second)
+
+	seen := 0
+	err = store.ScanFilter(ctx, func(*Session) bool { return true }, func(s *Session) error {
+		seen++
+		if left := time.Until(s.ExpiresAt()); left > 5*time.Second || left < 4*time.Second {
+			t.Errorf("ScanFilter expiry should follow the Redis TTL, %v left", left)
+		}
+		return nil
+	})
+	if err != nil || seen != 1 {
+		t.Fatalf("ScanFilter saw %d sessions, %v", seen, err)
+	}
+	if set, err := store.SetIfAbsent(ctx, "sess-rolling", sess.ID(), "nonce", "n1"); err != nil || !set {
+		t.Fatalf("SetIfAbsent = %v, %v", set, err)
+	}
+	stats, err := store.Sweep(ctx)
+	if err != nil {
+		t.Fatalf("Sweep: %v", err)
+	}
+	if stats.Expired != 0 || store.client.Exists(ctx, key).Val() != 1 {
+		t.Fatalf("Sweep deleted a live Rolling session: %+v", stats)
+	}
+}
+
+func TestRedisStore_Peek(t *testing.T) {
+	store := setupTestStore(t).WithMode(Rolling)
+	loads := 0
+	store.WithOnLoad(func(ctx context.Context, s *Session) error {
+		loads++
+		return nil
+	})
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-peek")
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	key := store.redisKey("sess-peek", sess.ID())
+	store.client.PExpire(ctx, key, 3*time.Second)
+
+	peeked, err := store.Peek(ctx, "sess-peek", sess.ID())
+	if err != nil {
+		t.Fatalf("Peek: %v", err)
+	}
+	if peeked.Get("user") != "alice" || peeked.IsNew() {
+		t.Fatalf("unexpected peeked session %s", peeked.Snapshot())
+	}
+	if ttl := store.client.PTTL(ctx, key).Val(); ttl > 3*time.Second {
+		t.Fatalf("Peek slid the TTL to %v", ttl)
+	}
+	if left := time.Until(peeked.ExpiresAt()); left > 3*time.Second || left < 2*time.Second {
+		t.Fatalf("peeked expiry should follow the Redis TTL, %v left", left)
+	}
+	if loads != 0 {
+		t.Fatalf("Peek ran the OnLoad hook")
+	}
+
+	// LoadByID, by contrast, slides it.
+	if _, err := store.LoadByID(ctx, "sess-peek", sess.ID()); err != nil {
+		t.Fatalf("LoadByID: %v", err)
+	}
+	if ttl := store.client.PTTL(ctx, key).Val(); ttl <= 3*time.Second {
+		t.Fatalf("expected LoadByID to slide the TTL, got %v", ttl)
+	}
+
+	// In fixed mode an expired session is reported but left in place.
+	fixed := setupTestStore(t)
+	old, _ := fixed.New(req, "sess-peek")
+	old.SetExpiresAt(time.Now().Add(time.Second))
+	if err := fixed.Save(req, httptest.NewRecorder(), old); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	fixed.WithExpirySkew(-2 * time.Second)
+	if _, err := fixed.Peek(ctx, "sess-peek", old.ID()); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("expected ErrSessionExpired, got %v", err)
+	}
+	if n := fixed.client.Exists(ctx, fixed.redisKey("sess-peek", old.ID())).Val(); n != 1 {
+		t.Fatalf("Peek deleted the expired session")
+	}
+	missing, _ := fixed.crypto.GenerateSessionID()
+	if _, err := fixed.Peek(ctx, "sess-peek", missing); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestRedisStore_UserIndex(t *testing.T) {
+	// The user id lives in a nested value, as after decoding a token.
+	store := setupTestStore(t).WithUserIDFunc(func(s *Session) (string, bool) {
+		profile, ok := s.Get("profile").(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		id, ok := profile["sub"].(string)
+		return id, ok
+	})
+	ctx := context.Background()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	save := func(profile interface{}) *Session {
+		sess, _ := store.New(req, "sess-user")
+		if profile != nil {
+			sess.Set("profile", profile)
+		}
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		return sess
+	}
+	alice1 := save(map[string]interface{}{"sub": "alice"})
+	alice2 := save(map[string]interface{}{"sub": "alice"})
+	bob := save(map[string]interface{}{"sub": "bob"})
+	save(nil) // anonymous, not indexed
+
+	ids := func(sessions []*Session) []string {
+		var out []string
+		for _, s := range sessions {
+			out = append(out, s.ID())
+		}
+		slices.Sort(out)
+		return out
+	}
+	want := []string{alice1.ID(), alice2.ID()}
+	slices.Sort(want)
+	got, err := store.ListUserSessions(ctx, "alice")
+	if err != nil || !slices.Equal(ids(got), want) {
+		t.Fatalf("ListUserSessions(alice) = %v, %v; want %v", ids(got), err, want)
+	}
+
+	// A session that switches user drops out of the old user's index.
+	alice2.Set("profile", map[string]interface{}{"sub": "bob"})
+	if err := store.Save(req, httptest.NewRecorder(), alice2); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	got, err = store.ListUserSessions(ctx, "alice")
+	if err != nil || !slices.Equal(ids(got), []string{alice1.ID()}) {
+		t.Fatalf("ListUserSessions(alice) after switch = %v, %v", ids(got), err)
+	}
+	if n := store.client.SCard(ctx, store.userKey("alice")).Val(); n != 1 {
+		t.Fatalf("stale index entry not removed, %d members", n)
+	}
+
+	// RotateID moves the index entry to the new key.
+	if err := store.RotateID(req, httptest.NewRecorder(), bob); err != nil {
+		t.Fatalf("RotateID: %v", err)
+	}
+	n, err := store.DestroyUserSessions(ctx, "bob")
+	if err != nil || n != 2 {
+		t.Fatalf("DestroyUserSessions(bob) = %d, %v; want 2", n, err)
+	}
+	if ok, _ := store.Exists(ctx, "sess-user", bob.ID()); ok {
+		t.Fatalf("rotated session survived DestroyUserSessions")
+	}
+
+	// The default extractor reads a string value.
+	simple := setupTestStore(t).WithUserIndex("")
+	sess, _ := simple.New(req, "sess-user")
+	sess.Set(DefaultUserIDKey, "carol")
+	if err := simple.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got, err := simple.ListUserSessions(ctx, "carol"); err != nil || len(got) != 1 {
+		t.Fatalf("ListUserSessions(carol) = %v, %v", got, err)
+	}
+}
+
+func TestCookieOptions_Domain(t *testing.T) {
+	sess := NewSession("abc", time.Hour)
+	sess.setName("sess-domain")
+
+	var want string
+	for _, domain := range []string{"example.com", ".example.com", " .Example.COM. "} {
+		options := DefaultCookieOptions()
+		options.Domain = domain
+		if err := options.Validate(); err != nil {
+			t.Fatalf("Validate(%q): %v", domain, err)
+		}
+		set, removed := options.NewCookie(sess), options.RemoveCookie("sess-domain")
+		if set.Domain != "example.com" || removed.Domain != "example.com" {
+			t.Fatalf("Domain %q normalized to %q / %q", domain, set.Domain, removed.Domain)
+		}
+		if want == "" {
+			want = set.String()
+		} else if set.String() != want {
+			t.Fatalf("Domain %q produced %q, want %q", domain, set.String(), want)
+		}
+	}
+
+	options := DefaultCookieOptions()
+	options.Domain = ".example.com"
+	options.RawDomain = true
+	if c := options.NewCookie(sess); c.Domain != ".example.com" {
+		t.Fatalf("RawDomain altered the domain to %q", c.Domain)
+	}
+
+	for _, bad := range []string{"https://example.com", "example.com:8080", "example.com/app", "exa mple.com", "a..b"} {
+		options := DefaultCookieOptions()
+		options.Domain = bad
+		if err := options.Validate(); !errors.Is(err, ErrInvalidConfiguration) {
+			t.Fatalf("Validate(%q) = %v, want ErrInvalidConfiguration", bad, err)
+		}
+	}
+}
+
+func TestRedisStore_ExportImport(t *testing.T) {
+	source := setupTestStore(t)
+	options := DefaultCookieOptions()
+	options.Secure = false
+	target := NewRedisStore(source.client, "other:", source.crypto, options)
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := source.New(req, "sess-handoff")
+	sess.Set("user", "alice")
+	if err := source.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	token, err := source.Export(sess)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	var stored Session
+	if err := source.crypto.DecryptAndVerify(token, &stored, source.aad("sess-handoff", sess.ID())); err == nil {
+		t.Fatal("handoff token opened as a stored session")
+	}
+
+	imported, err := target.Import(ctx, token)
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if imported.ID() == sess.ID() || imported.Name() != "sess-handoff" || imported.Get("user") != "alice" {
+		t.Fatalf("unexpected imported session %s", imported.Snapshot())
+	}
+	if !imported.ExpiresAt().Equal(sess.ExpiresAt()) {
+		t.Fatalf("expiry changed from %v to %v", sess.ExpiresAt(), imported.ExpiresAt())
+	}
+	if _, err := target.Peek(ctx, "sess-handoff", imported.ID()); err != nil {
+		t.Fatalf("imported session not stored: %v", err)
+	}
+
+	source.WithHandoffTTL(time.Millisecond)
+	token, err = source.Export(sess)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := target.Import(ctx, token); !errors.Is(err, ErrSessionExpired) {
+		t.Fatalf("Import of an expired token = %v, want ErrSessionExpired", err)
+	}
+}
+
+func TestRedisStore_Close(t *testing.T) {
+	setupTestRedis(t)
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	options := DefaultCookieOptions()
+	options.Secure = false
+	store := NewRedisStore(client, "test:", setupTestCrypto(t), options).
+		WithAsyncSaves(1, 8, nil).
+		WithCloseClient(true)
+	ctx := context.Background()
+
+	sweeps := 0
+	store.WithSweepReporter(func(SweepStats, error) { sweeps++ })
+	store.StartSweeper(ctx, time.Millisecond)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-close")
+	sess.Set("user", "alice")
+	if err := store.SaveAsync(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("SaveAsync: %v", err)
+	}
+	if err := store.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := store.Close(ctx); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	after := sweeps
+	time.Sleep(10 * time.Millisecond)
+	if sweeps != after {
+		t.Fatal("sweeper still running after Close")
+	}
+
+	if err := client.Ping(ctx).Err(); !errors.Is(err, redis.ErrClosed) {
+		t.Fatalf("client not closed: %v", err)
+	}
+	other := NewRedisStore(redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1}), "test:", store.crypto, options)
+	defer other.client.Close()
+	if _, err := other.Peek(ctx, "sess-close", sess.ID()); err != nil {
+		t.Fatalf("queued write lost on Close: %v", err)
+	}
+
+	sess.Set("user", "bob")
+	if err := store.SaveAsync(req, httptest.NewRecorder(), sess); !errors.Is(err, ErrStoreClosed) {
+		t.Fatalf("SaveAsync after Close = %v, want ErrStoreClosed", err)
+	}
+}
+
+func TestRedisStore_ListingsArePeeks(t *testing.T) {
+	store := setupTestStore(t).WithMode(Rolling).WithUserIndex("")
+	loads := 0
+	store.WithOnLoad(func(ctx context.Context, s *Session) error {
+		loads++
+		return nil
+	})
+	ctx := context.Background()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-list")
+	sess.Set(DefaultUserIDKey, "alice")
+	sess.AddLabel("staff")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	key := store.redisKey("sess-list", sess.ID())
+	store.client.PExpire(ctx, key, 3*time.Second)
+
+	if listed, err := store.ListByLabel(ctx, "staff"); err != nil || len(listed) != 1 {
+		t.Fatalf("ListByLabel = %d sessions, %v", len(listed), err)
+	}
+	if listed, err := store.ListUserSessions(ctx, "alice"); err != nil || len(listed) != 1 {
+		t.Fatalf("ListUserSessions = %d sessions, %v", len(listed), err)
+	}
+	if loaded, err := store.LoadMany(ctx, "sess-list", []string{sess.ID()}); err != nil || len(loaded) != 1 {
+		t.Fatalf("LoadMany = %d sessions, %v", len(loaded), err)
+	}
+	if ttl := store.client.PTTL(ctx, key).Val(); ttl > 3*time.Second {
+		t.Fatalf("listing slid the Rolling TTL to %v", ttl)
+	}
+	if loads != 0 {
+		t.Fatalf("listing ran the OnLoad hook %d times", loads)
+	}
+}
+
+func TestRedisStore_BatchLoadWithErrors(t *testing.T) {
+	store := setupTestStore(t).WithUserIndex("")
+	ctx := context.Background()
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		sess, _ := store.New(req, "sess-batch")
+		sess.Set("user_id", "alice")
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		ids = append(ids, sess.ID())
+	}
+	foreign, err := setupTestCrypto(t).EncryptAndSign(NewSession(ids[1], time.Hour), store.aad("sess-batch", ids[1]))
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	badKey := store.redisKey("sess-batch", ids[1])
+	store.client.Set(ctx, badKey, foreign, time.Minute)
+	store.client.Del(ctx, store.redisKey("sess-batch", ids[2]))
+
+	sessions, failed, err := store.ListUserSessionsWithErrors(ctx, "alice")
+	if err != nil {
+		t.Fatalf("ListUserSessionsWithErrors: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].ID() != ids[0] {
+		t.Fatalf("got %d sessions, want only %s", len(sessions), ids[0])
+	}
+	if len(failed) != 1 || !errors.Is(failed[badKey], ErrSignatureInvalid) {
+		t.Fatalf("failed = %v, want only %s with ErrSignatureInvalid", failed, badKey)
+	}
+
+	sessions, failed, err = store.LoadManyWithErrors(ctx, "sess-batch", ids)
+	if err != nil {
+		t.Fatalf("LoadManyWithErrors: %v", err)
+	}
+	if len(sessions) != 1 || len(failed) != 1 || !errors.Is(failed[ids[1]], ErrSignatureInvalid) {
+		t.Fatalf("LoadManyWithErrors = %d sessions, failed %v", len(sessions), failed)
+	}
+	if sessions, err := store.LoadMany(ctx, "sess-batch", ids); err != nil || len(sessions) != 1 {
+		t.Fatalf("LoadMany = %d sessions, %v", len(sessions), err)
+	}
+
+	_, failed, err = store.LoadManyWithErrors(ctx, "sess-batch", []string{ids[0], "not a session id"})
+	if err != nil || len(failed) != 1 || !errors.Is(failed["not a session id"], ErrSessionNotFound) {
+		t.Fatalf("invalid id: failed = %v, %v; want ErrSessionNotFound", failed, err)
+	}
+}
+
+func TestRedisStore_SaveCount(t *testing.T) {
+	store := setupTestStore(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-count")
+	if sess.SaveCount() != 0 {
+		t.Fatalf("new session SaveCount = %d", sess.SaveCount())
+	}
+	for i := 1; i <= 3; i++ {
+		sess.Set("n", i)
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		if sess.SaveCount() != uint64(i) {
+			t.Fatalf("SaveCount after %d saves = %d", i, sess.SaveCount())
+		}
+	}
+	loaded, err := store.Peek(context.Background(), "sess-count", sess.ID())
+	if err != nil {
+		t.Fatalf("Peek: %v", err)
+	}
+	if loaded.SaveCount() != 3 {
+		t.Fatalf("stored SaveCount = %d, want 3", loaded.SaveCount())
+	}
+
+	closed := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 1})
+	closed.Close()
+	broken := NewRedisStore(closed, "test:", store.crypto, store.options)
+	sess.Set("n", 4)
+	if err := broken.Save(req, httptest.NewRecorder(), sess); err == nil {
+		t.Fatal("Save on a closed client succeeded")
+	}
+	if sess.SaveCount() != 3 {
+		t.Fatalf("failed save changed SaveCount to %d", sess.SaveCount())
+	}
+}
+
+func TestRedisStore_SaveNilWriter(t *testing.T) {
+	store := setupTestStore(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-nilw")
+	sess.Set("user", "alice")
+	if err := store.Save(req, nil, sess); err != nil {
+		t.Fatalf("Save with nil writer: %v", err)
+	}
+	loaded, err := store.Peek(context.Background(), "sess-nilw", sess.ID())
+	if err != nil {
+		t.Fatalf("Peek: %v", err)
+	}
+	if loaded.Get("user") != "alice" {
+		t.Fatalf("unexpected stored session %s", loaded.Snapshot())
+	}
+}
+
+// downHook fails every command as if Redis refused the connection.
+type downHook struct{}
+
+var errRefused = &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+func (downHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (downHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		cmd.SetErr(errRefused)
+		return errRefused
+	}
+}
+
+func (downHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		for _, cmd := range cmds {
+			cmd.SetErr(errRefused)
+		}
+		return errRefused
+	}
+}
+
+// failCmdHook fails every command called name as if Redis refused the
+// connection, and passes the rest through.
+type failCmdHook struct{ name string }
+
+func (failCmdHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h failCmdHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == h.name {
+			cmd.SetErr(errRefused)
+			return errRefused
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (failCmdHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// onceHook runs fn before the first command called name.
+type onceHook struct {
+	name string
+	once *sync.Once
+	fn   func()
+}
+
+func (onceHook) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h onceHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if cmd.Name() == h.name {
+			h.once.Do(h.fn)
+		}
+		return next(ctx, cmd)
+	}
+}
+
+func (onceHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+func TestRedisStore_ResealConcurrentSave(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	sess, _ := store.New(httptest.NewRequest("GET", "/", nil), "sess-reseal")
+	sess.Set("user", "alice")
+	if err := store.SaveCtx(ctx, sess); err != nil {
+		t.Fatalf("SaveCtx: %v", err)
+	}
+
+	// A save from another connection lands between Reseal's read and write.
+	other := redis.NewClient(store.client.Options())
+	defer other.Close()
+	concurrent := NewRedisStore(other, store.prefix, store.crypto, store.options)
+	store.client.AddHook(onceHook{name: "pttl", once: &sync.Once{}, fn: func() {
+		sess.Set("user", "bob")
+		if err := concurrent.SaveCtx(ctx, sess); err != nil {
+			t.Errorf("concurrent SaveCtx: %v", err)
+		}
+	}})
+	if err := store.Reseal(ctx, "sess-reseal", sess.ID()); err != nil {
+		t.Fatalf("Reseal: %v", err)
+	}
+	loaded, err := store.LoadByID(ctx, "sess-reseal", sess.ID())
+	if err != nil || loaded.Get("user") != "bob" {
+		t.Fatalf("Reseal overwrote a concurrent save: %v", err)
+	}
+}
+
+func TestRedisStore_PruneLabelsKeepsUncheckedMembers(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	sess, _ := store.New(httptest.NewRequest("GET", "/", nil), "sess-prune")
+	sess.AddLabel("staff")
+	if err := store.SaveCtx(ctx, sess); err != nil {
+		t.Fatalf("SaveCtx: %v", err)
+	}
+
+	store.client.AddHook(failCmdHook{"exists"})
+	if _, err := store.pruneLabels(ctx); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("pruneLabels with EXISTS failing = %v, want ErrStoreUnavailable", err)
+	}
+	if n := store.client.SCard(ctx, store.labelKey("staff")).Val(); n != 1 {
+		t.Fatalf("label index holds %d entries; a failed check must not prune", n)
+	}
+}
+
+func TestRedisStore_StoreUnavailable(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-down")
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	missing, _ := store.crypto.GenerateSessionID()
+	if _, err := store.Peek(ctx, "sess-down", missing); !errors.Is(err, ErrSessionNotFound) || errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("Peek of a missing session = %v, want only ErrSessionNotFound", err)
+	}
+
+	store.client.AddHook(downHook{})
+	if _, err := store.Peek(ctx, "sess-down", sess.ID()); !errors.Is(err, ErrStoreUnavailable) || !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("Peek with Redis down = %v, want ErrStoreUnavailable wrapping ECONNREFUSED", err)
+	}
+	if _, err := store.Exists(ctx, "sess-down", sess.ID()); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("Exists with Redis down = %v, want ErrStoreUnavailable", err)
+	}
+	sess.Set("user", "bob")
+	if err := store.Save(req, httptest.NewRecorder(), sess); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("Save with Redis down = %v, want ErrStoreUnavailable", err)
+	}
+	if err := store.revoke(ctx, store.redisKey("sess-down", sess.ID()), sess.ExpiresAt()); !errors.Is(err, ErrStoreUnavailable) {
+		t.Fatalf("revoke with Redis down = %v, want ErrStoreUnavailable", err)
+	}
+}
+
+func TestCrypto_AllowUnsignedLegacy(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	aead, signKey := store.crypto.aead, store.crypto.signingKey
+	unsigned := NewCrypto(aead, nil)
+
+	sess := NewSession("", time.Hour)
+	id, _ := store.crypto.GenerateSessionID()
+	sess.setID(id)
+	sess.setName("sess-unsigned")
+	sess.Set("user", "alice")
+	blob, err := unsigned.EncryptAndSign(sess, store.aad("sess-unsigned", id))
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	key := store.redisKey("sess-unsigned", id)
+	store.client.Set(ctx, key, blob, time.Minute)
+
+	if _, err := store.Peek(ctx, "sess-unsigned", id); err == nil {
+		t.Fatal("unsigned payload accepted without WithAllowUnsignedLegacy")
+	}
+
+	store.crypto = NewCrypto(aead, signKey).WithAllowUnsignedLegacy(true)
+	loaded, err := store.Peek(ctx, "sess-unsigned", id)
+	if err != nil {
+		t.Fatalf("Peek of unsigned payload: %v", err)
+	}
+	if loaded.Get("user") != "alice" {
+		t.Fatalf("unexpected session %s", loaded.Snapshot())
+	}
+	if err := store.SaveCtx(ctx, loaded); err != nil {
+		t.Fatalf("SaveCtx: %v", err)
+	}
+
+	store.crypto = NewCrypto(aead, signKey)
+	if _, err := store.Peek(ctx, "sess-unsigned", id); err != nil {
+		t.Fatalf("session not re-sealed with a signature: %v", err)
+	}
+}
+
+func TestSession_Context(t *testing.T) {
+	if ctx := NewSession("abc", time.Hour).Context(); ctx != context.Background() {
+		t.Fatalf("default Context = %v, want context.Background()", ctx)
+	}
+
+	type ctxKey struct{}
+	store := setupTestStore(t).WithSessionBudget(time.Second)
+	var got context.Context
+	h := store.Handler("sess-ctx", func(w http.ResponseWriter, r *http.Request) {
+		got = MustCurrent(r).Context()
+		if got.Value(ctxKey{}) != "req" {
+			t.Error("session context does not carry the request's values")
+		}
+		if _, ok := got.Deadline(); ok {
+			t.Error("session context carries the store budget deadline")
+		}
+	})
+	req := httptest.NewRequest("GET", "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), ctxKey{}, "req"))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got == nil {
+		t.Fatal("handler did not run")
+	}
+
+	sess, _ := store.New(req, "sess-ctx")
+	if sess.Context().Value(ctxKey{}) != "req" {
+		t.Fatal("New did not attach the request context")
+	}
+	if bytes.Contains(sess.Snapshot(), []byte("ctx")) {
+		t.Fatalf("context leaked into the payload: %s", sess.Snapshot())
+	}
+}
+
+func TestCrypto_IDEncodings(t *testing.T) {
+	for name, enc := range map[string]IDEncoding{
+		"base64url": Base64URLIDs,
+		"hex":       HexIDs,
+		"base32":    Base32IDs,
+		"base58":    Base58IDs,
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := setupTestStore(t)
+			store.crypto.WithIDEncoding(enc)
+
+			req := httptest.NewRequest("GET", "/", nil)
+			sess, _ := store.New(req, "sess-ids")
+			b, err := enc.Decode(sess.ID())
+			if err != nil || len(b) != sessionIDBytes {
+				t.Fatalf("id %q does not decode to %d bytes: %v", sess.ID(), sessionIDBytes, err)
+			}
+			sess.Set("user", "alice")
+			w := httptest.NewRecorder()
+			if err := store.Save(req, w, sess); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+			if store.client.Exists(context.Background(), store.redisKey("sess-ids", sess.ID())).Val() != 1 {
+				t.Fatal("session not stored under its id")
+			}
+
+			req = httptest.NewRequest("GET", "/", nil)
+			for _, c := range w.Result().Cookies() {
+				req.AddCookie(c)
+			}
+			loaded, err := store.NewWithResult(req, "sess-ids")
+			if err != nil || loaded.ID() != sess.ID() || loaded.Get("user") != "alice" {
+				t.Fatalf("session did not round-trip through the cookie: %v", err)
+			}
+
+			if enc != Base64URLIDs && store.crypto.ValidSessionID("-"+strings.Repeat("A", 42)) {
+				t.Fatal("base64url shaped id accepted")
+			}
+			if store.crypto.ValidSessionID(sess.ID() + sess.ID()[:1]) {
+				t.Fatal("over-long id accepted")
+			}
+		})
+	}
+
+	b := make([]byte, sessionIDBytes)
+	b[1] = 7
+	if got, err := Base58IDs.Decode(Base58IDs.Encode(b)); err != nil || !bytes.Equal(got, b) {
+		t.Fatalf("base58 lost leading zeros: %x, %v", got, err)
+	}
+}
+
+func TestRedisStore_RotateIDPartialFailure(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	ctx := context.Background()
+	setup := func(t *testing.T) (*RedisStore, *Session) {
+		store := setupTestStore(t)
+		req := httptest.NewRequest("GET", "/", nil)
+		sess, _ := store.New(req, "sess-rotfail")
+		sess.Set("user", "alice")
+		if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		return store, sess
+	}
+
+	t.Run("new write fails", func(t *testing.T) {
+		store, sess := setup(t)
+		oldID := sess.ID()
+		store.client.AddHook(&failingHook{n: 1, err: refused})
+		w := httptest.NewRecorder()
+		if err := store.RotateID(httptest.NewRequest("GET", "/", nil), w, sess); !errors.Is(err, ErrStoreUnavailable) {
+			t.Fatalf("RotateID = %v, want ErrStoreUnavailable", err)
+		}
+		if sess.ID() != oldID {
+			t.Fatalf("failed rotation left the session on id %s", sess.ID())
+		}
+		if len(w.Result().Cookies()) != 0 {
+			t.Fatal("failed rotation set a cookie")
+		}
+		if _, err := store.Peek(ctx, "sess-rotfail", oldID); err != nil {
+			t.Fatalf("old session no longer loads: %v", err)
+		}
+	})
+
+	t.Run("old delete fails", func(t *testing.T) {
+		store, sess := setup(t)
+		oldID := sess.ID()
+		store.client.AddHook(&failingHook{n: 1, err: refused, cmd: "del"})
+		w := httptest.NewRecorder()
+		if err := store.RotateID(httptest.NewRequest("GET", "/", nil), w, sess); !errors.Is(err, ErrStoreUnavailable) {
+			t.Fatalf("RotateID = %v, want ErrStoreUnavailable", err)
+		}
+		cookies := w.Result().Cookies()
+		if sess.ID() == oldID || len(cookies) != 1 || cookies[0].Value != sess.ID() {
+			t.Fatalf("rotation not kept after the old key survived: id %s, cookies %v", sess.ID(), cookies)
+		}
+		if _, err := store.Peek(ctx, "sess-rotfail", sess.ID()); err != nil {
+			t.Fatalf("new session does not load: %v", err)
+		}
+	})
+}
+
+func TestRedisStore_ReadFallback(t *testing.T) {
+	old := setupTestStore(t)
+	ctx := context.Background()
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := old.New(req, "sess-migrate")
+	sess.Set("user", "alice")
+	w := httptest.NewRecorder()
+	if err := old.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	store := NewRedisStore(old.client, "next:", old.crypto, old.options).WithReadFallback("test:")
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	loaded, err := store.NewWithResult(req, "sess-migrate")
+	if err != nil || loaded.ID() != sess.ID() || loaded.Get("user") != "alice" {
+		t.Fatalf("session under the old prefix did not load: %v", err)
+	}
+	if ok, err := store.Exists(ctx, "sess-migrate", sess.ID()); err != nil || !ok {
+		t.Fatalf("Exists = %v, %v", ok, err)
+	}
+	if _, err := store.Peek(ctx, "sess-migrate", sess.ID()); err != nil {
+		t.Fatalf("Peek: %v", err)
+	}
+
+	loaded.Set("user", "bob")
+	if err := store.Save(req, httptest.NewRecorder(), loaded); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	newKey, oldKey := store.redisKey("sess-migrate", sess.ID()), old.redisKey("sess-migrate", sess.ID())
+	if store.client.Exists(ctx, newKey).Val() != 1 {
+		t.Fatal("Save did not write under the new prefix")
+	}
+	if again, _ := store.Peek(ctx, "sess-migrate", sess.ID()); again == nil || again.Get("user") != "bob" {
+		t.Fatal("new copy not preferred over the old one")
+	}
+
+	if err := store.Destroy(req, httptest.NewRecorder(), loaded); err != nil {
+		t.Fatalf("Destroy: %v", err)
+	}
+	if store.client.Exists(ctx, newKey, oldKey).Val() != 0 {
+		t.Fatal("Destroy left a copy behind")
+	}
+}
+
+func TestRedisStore_ReadFallbackScans(t *testing.T) {
+	for _, tc := range []struct{ oldPrefix, newPrefix string }{
+		{"test:", "test-next:"},
+		{"test:", "test:v2:"},
+		{"test:v1:", "test:"},
+	} {
+		old := setupTestStore(t)
+		old.prefix = tc.oldPrefix
+		store := NewRedisStore(old.client, tc.newPrefix, old.crypto, old.options).WithReadFallback(tc.oldPrefix)
+		ctx := context.Background()
+		req := httptest.NewRequest("GET", "/", nil)
+		for _, st := range []*RedisStore{old, old, store} {
+			sess, _ := st.New(req, "sess-migrate")
+			sess.AddLabel("admin")
+			if err := st.Save(req, httptest.NewRecorder(), sess); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+
+		if names, err := store.ListNames(ctx); err != nil || len(names) != 1 || names[0] != "sess-migrate" {
+			t.Fatalf("%s -> %s: ListNames = %v, %v", tc.oldPrefix, tc.newPrefix, names, err)
+		}
+		seen := 0
+		err := store.ScanFilter(ctx, func(*Session) bool { return true }, func(*Session) error {
+			seen++
+			return nil
+		})
+		if err != nil || seen != 3 {
+			t.Fatalf("%s -> %s: ScanFilter saw %d sessions, %v", tc.oldPrefix, tc.newPrefix, seen, err)
+		}
+		deleted, err := store.DestroyAll(ctx)
+		if err != nil || deleted != 3 {
+			t.Fatalf("%s -> %s: DestroyAll = %d, %v", tc.oldPrefix, tc.newPrefix, deleted, err)
+		}
+		for _, st := range []*RedisStore{old, store} {
+			if store.client.Exists(ctx, st.labelKey("admin")).Val() != 1 {
+				t.Fatalf("%s -> %s: DestroyAll deleted the label index under %s", tc.oldPrefix, tc.newPrefix, st.prefix)
+			}
+		}
+		store.client.FlushDB(ctx)
+	}
+}
+
+func TestSession_TTLSeconds(t *testing.T) {
+	sess := NewSession("abc", 90*time.Second)
+	if ttl := sess.TTLSeconds(); ttl < 89 || ttl > 90 {
+		t.Fatalf("TTLSeconds = %d, want about 90", ttl)
+	}
+	sess.SetExpiresAt(time.Now().Add(-time.Second))
+	if ttl := sess.TTLSeconds(); ttl != 0 {
+		t.Fatalf("TTLSeconds of an expired session = %d, want 0", ttl)
+	}
+
+	store := setupTestStore(t).WithExpiresInHeader(true)
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ = store.New(req, "sess-ttl")
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if got := w.Header().Get(ExpiresInHeader); got != "9" && got != "10" {
+		t.Fatalf("%s = %q, want the 10s MaxAge", ExpiresInHeader, got)
+	}
+}
+
+func TestCrypto_SigningHash(t *testing.T) {
+	base := setupTestCrypto(t)
+	c := NewCrypto(base.aead, base.signingKey).WithSigningHash(sha512.New512_256)
+	sess := NewSession("abc", time.Hour)
+	sess.Set("user", "alice")
+
+	encrypted, err := c.EncryptAndSign(sess, []byte("aad"))
+	if err != nil {
+		t.Fatalf("EncryptAndSign: %v", err)
+	}
+	var out Session
+	if err := c.DecryptAndVerify(encrypted, &out, []byte("aad")); err != nil || out.Get("user") != "alice" {
+		t.Fatalf("SHA-512/256 round trip: %v", err)
+	}
+	// Same key and size, different hash: the signature must not verify.
+	if err := base.DecryptAndVerify(encrypted, &out, []byte("aad")); !errors.Is(err, ErrSignatureInvalid) {
+		t.Fatalf("SHA-256 Crypto opened a SHA-512/256 signature: %v", err)
+	}
+	_, stats, err := c.EncryptAndSignWithStats(sess, []byte("aad"))
+	if err != nil {
+		t.Fatalf("EncryptAndSignWithStats: %v", err)
+	}
+	if want := stats.SealedSize - stats.PlaintextSize; c.Overhead() != want {
+		t.Fatalf("Overhead = %d, sealed payload adds %d", c.Overhead(), want)
+	}
+
+	rotated := c.WithNewPrimary(base.aead, base.signingKey).WithSigningHash(nil)
+	if err := rotated.DecryptAndVerify(encrypted, &out, []byte("aad")); err != nil {
+		t.Fatalf("legacy key lost its signing hash: %v", err)
+	}
+}
+
+func TestCrypto_SignatureSize(t *testing.T) {
+	base := setupTestCrypto(t)
+	for name, fn := range map[string]func() hash.Hash{
+		"sha224": sha256.New224,
+		"sha512": sha512.New,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := NewCrypto(base.aead, base.signingKey).WithSigningHash(fn)
+			encrypted, err := c.EncryptAndSign(map[string]string{"k": "v"}, nil)
+			if err != nil {
+				t.Fatalf("EncryptAndSign: %v", err)
+			}
+			var out map[string]string
+			if err := c.DecryptAndVerify(encrypted, &out, nil); err != nil || out["k"] != "v" {
+				t.Fatalf("round trip with a %d byte MAC: %v", fn().Size(), err)
+			}
+
+			// A payload just one byte short of signature + nonce + tag + 1
+			// must be rejected as malformed rather than misparsed.
+			short := make([]byte, fn().Size()+base.aead.NonceSize()+base.aead.Overhead())
+			err = c.DecryptAndVerify(base64.RawStdEncoding.EncodeToString(short), &out, nil)
+			if !errors.Is(err, ErrInvalidSessionData) {
+				t.Fatalf("short payload: %v, want ErrInvalidSessionData", err)
+			}
+		})
+	}
+}
+
+func TestRedisStore_IDInAAD(t *testing.T) {
+	ctx := context.Background()
+	swap := func(t *testing.T, store *RedisStore) error {
+		req := httptest.NewRequest("GET", "/", nil)
+		a, _ := store.New(req, "sess-swap")
+		a.Set("user", "alice")
+		b, _ := store.New(req, "sess-swap")
+		b.Set("user", "bob")
+		for _, sess := range []*Session{a, b} {
+			if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+				t.Fatalf("Save: %v", err)
+			}
+		}
+		blob := store.client.Get(ctx, store.redisKey("sess-swap", a.ID())).Val()
+		store.client.Set(ctx, store.redisKey("sess-swap", b.ID()), blob, time.Minute)
+		_, err := store.Peek(ctx, "sess-swap", b.ID())
+		return err
+	}
+	if err := swap(t, setupTestStore(t)); err != nil {
+		t.Fatalf("without the id in the AAD a swapped blob should still open: %v", err)
+	}
+	if err := swap(t, setupTestStore(t).WithIDInAAD(true)); !errors.Is(err, ErrEncryptionFailed) {
+		t.Fatalf("swapped blob = %v, want ErrEncryptionFailed", err)
+	}
+
+	store := setupTestStore(t)
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-bound")
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	store.WithIDInAAD(true)
+	if _, err := store.Peek(ctx, "sess-bound", sess.ID()); err == nil {
+		t.Fatal("unbound payload opened without WithUnboundAADFallback")
+	}
+	store.WithUnboundAADFallback(true)
+	loaded, err := store.Peek(ctx, "sess-bound", sess.ID())
+	if err != nil {
+		t.Fatalf("unbound payload during migration: %v", err)
+	}
+	if err := store.SaveCtx(ctx, loaded); err != nil {
+		t.Fatalf("SaveCtx: %v", err)
+	}
+	store.WithUnboundAADFallback(false)
+	if _, err := store.Peek(ctx, "sess-bound", sess.ID()); err != nil {
+		t.Fatalf("session not re-sealed with its id: %v", err)
+	}
+}
+
+func TestSession_RenameKey(t *testing.T) {
+	sess := NewSession("abc", time.Hour)
+	sess.Set("uid", 42)
+	sess.markClean()
+
+	if sess.RenameKey("missing", "user_id") || sess.IsDirty() {
+		t.Fatal("renaming an absent key changed the session")
+	}
+	if !sess.RenameKey("uid", "user_id") {
+		t.Fatal("RenameKey reported no move")
+	}
+	if sess.Get("uid") != nil || sess.Get("user_id") != 42 || !sess.IsDirty() {
+		t.Fatalf("unexpected session after rename: %s", sess.Snapshot())
+	}
+
+	sess.Set("name", "old")
+	sess.Set("display_name", "kept?")
+	if !sess.RenameKey("name", "display_name") || sess.Get("display_name") != "old" {
+		t.Fatal("RenameKey did not overwrite the existing key")
+	}
+}
+
+func TestRedisStore_ReadReplica(t *testing.T) {
+	primary := setupTestStore(t)
+	ctx := context.Background()
+	replica := redis.NewClient(&redis.Options{Addr: "localhost:6379", DB: 2})
+	replica.FlushDB(ctx)
+	t.Cleanup(func() {
+		replica.FlushDB(ctx)
+		replica.Close()
+	})
+	store := NewRedisStoreWithReplica(primary.client, replica, "test:", primary.crypto, primary.options)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sess-replica")
+	sess.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	key := store.redisKey("sess-replica", sess.ID())
+	if replica.Exists(ctx, key).Val() != 0 {
+		t.Fatal("Save wrote to the replica")
+	}
+
+	// Not replicated yet: reads fall back to the primary.
+	if loaded, err := store.Peek(ctx, "sess-replica", sess.ID()); err != nil || loaded.Get("user") != "alice" {
+		t.Fatalf("Peek did not fall back to the primary: %v", err)
+	}
+
+	// Once the replica has a copy, reads are served from it.
+	stale := primary.client.Get(ctx, key).Val()
+	replica.Set(ctx, key, stale, time.Minute)
+	sess.Set("user", "bob")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if loaded, err := store.Peek(ctx, "sess-replica", sess.ID()); err != nil || loaded.Get("user") != "alice" {
+		t.Fatalf("Peek not served by the replica: %v", err)
+	}
+	if ok, err := store.Exists(ctx, "sess-replica", sess.ID()); err != nil || !ok {
+		t.Fatalf("Exists = %v, %v", ok, err)
+	}
+
+	store.WithMode(Rolling)
+	if loaded, err := store.load(ctx, "sess-replica", sess.ID()); err != nil || loaded.Get("user") != "bob" {
+		t.Fatalf("Rolling load not served by the primary: %v", err)
+	}
+}
+
+func TestRedisStore_LegacyCookieNames(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	req := httptest.NewRequest("GET", "/", nil)
+	sess, _ := store.New(req, "sid")
+	sess.Set("user", "alice")
+	w := httptest.NewRecorder()
+	if err := store.Save(req, w, sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	oldKey := store.redisKey("sid", sess.ID())
+
+	store.WithLegacyCookieNames("sid")
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range w.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	renamed, err := store.NewWithResult(req, "__Host-sid")
+	if err != nil || renamed.IsNew() || renamed.Get("user") != "alice" || renamed.Name() != "__Host-sid" {
+		t.Fatalf("legacy cookie not picked up: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	if err := store.Save(req, w, renamed); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookies := map[string]*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		cookies[c.Name] = c
+	}
+	if c := cookies["__Host-sid"]; c == nil || c.Value != renamed.ID() {
+		t.Fatalf("new cookie not set: %v", cookies)
+	}
+	if c := cookies["sid"]; c == nil || c.MaxAge >= 0 {
+		t.Fatalf("legacy cookie not expired: %v", cookies)
+	}
+	if store.client.Exists(ctx, oldKey).Val() != 0 {
+		t.Fatal("legacy copy not deleted")
+	}
+	if store.client.Exists(ctx, store.redisKey("__Host-sid", renamed.ID())).Val() != 1 {
+		t.Fatal("session not stored under the new name")
+	}
+
+	// The new name wins when both cookies are present.
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "sid", Value: sess.ID()})
+	req.AddCookie(cookies["__Host-sid"])
+	again, err := store.NewWithResult(req, "__Host-sid")
+	if err != nil || again.ID() != renamed.ID() {
+		t.Fatalf("new cookie not preferred: %v", err)
+	}
+}
+
+func TestRedisStore_PerSessionKeys(t *testing.T) {
+	store := setupTestStore(t)
+	ctx := context.Background()
+	req := httptest.NewRequest("GET", "/", nil)
+	before, _ := store.New(req, "sess-keys")
+	before.Set("user", "alice")
+	if err := store.Save(req, httptest.NewRecorder(), before); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	master, _ := GenerateKey(32)
+	store.WithPerSessionKeys(master, NewAESGCM)
+	if _, err := store.Peek(ctx, "sess-keys", before.ID()); err != nil {
+		t.Fatalf("session sealed before enabling per-session keys: %v", err)
+	}
+
+	sess, _ := store.New(req, "sess-keys")
+	sess.Set("user", "bob")
+	if err := store.Save(req, httptest.NewRecorder(), sess); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, err := store.Peek(ctx, "sess-keys", sess.ID())
+	if err != nil || loaded.Get("user") != "bob" {
+		t.Fatalf("Peek: %v", err)
+	}
+	blob := store.client.Get(ctx, store.redisKey("sess-keys", sess.ID())).Val()
+	var out Session
+	if err := store.crypto.DecryptAndVerify(blob, &out, store.aad("sess-keys", sess.ID())); err == nil {
+		t.Fatal("payload opened with the store's shared key")
+	}
+
+	// A blob moved to another session's key no longer opens there.
+	store.client.Set(ctx, store.redisKey("sess-keys", before.ID()), blob, time.Minute)
+	if _, err := store.Peek(ctx, "sess-keys", before.ID()); err == nil {
+		t.Fatal("payload opened under another session's derived key")
+	}
+}
@@ -0,0 +1,91 @@
+package redissession
+
+import (
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+)
+
+// sessionKeyCacheSize bounds the derived AEADs kept in memory. The cache is
+// simply reset when full; a miss costs one derivation.
+const sessionKeyCacheSize = 4096
+
+type sessionKeys struct {
+	master  []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+
+	mu    sync.Mutex
+	cache map[string]cipher.AEAD
+}
+
+// WithPerSessionKeys encrypts every session under its own key, derived with
+// HKDF-SHA256 from master and the session's name and id, instead of the
+// Crypto's single AEAD key. A leaked derived key then exposes one session
+// rather than all of them, and no two stored payloads share a key. newAEAD
+// builds the cipher from the 32-byte derived key, e.g. NewAESGCM or
+// NewXChaCha20Poly1305. Signing still uses the Crypto's signing key.
+//
+// Deriving costs an HKDF run and a cipher key schedule, a few
+// microseconds; the most recent few thousand sessions' ciphers are cached.
+// Sessions sealed under the Crypto's own keys, including those from before
+// this option was enabled, still open and are moved to their derived key on
+// their next save. master is separate from the Crypto keys, so rotating those
+// with WithNewPrimary leaves encryption alone, while changing master makes
+// every session sealed under derived keys unreadable. A nil master turns
+// per-session keys off.
+func (s *RedisStore) WithPerSessionKeys(master []byte, newAEAD func(key []byte) (cipher.AEAD, error)) *RedisStore {
+	if master == nil {
+		s.sessionKeys = nil
+		return s
+	}
+	s.sessionKeys = &sessionKeys{
+		master:  append([]byte(nil), master...),
+		newAEAD: newAEAD,
+		cache:   make(map[string]cipher.AEAD),
+	}
+	return s
+}
+
+// cryptoFor returns the Crypto sealing the session called name with the
+// given id: the store's own, or with WithPerSessionKeys a copy sealing with
+// the session's derived key and still opening with the store's keys.
+func (s *RedisStore) cryptoFor(name, sessionID string) (*Crypto, error) {
+	if s.sessionKeys == nil {
+		return s.crypto, nil
+	}
+	aead, err := s.sessionKeys.aead(name, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	c := *s.crypto
+	c.aead = aead
+	c.legacy = append([]cryptoKey{s.crypto.primary()}, s.crypto.legacy...)
+	return &c, nil
+}
+
+func (k *sessionKeys) aead(name, sessionID string) (cipher.AEAD, error) {
+	info := name + "\x00" + sessionID
+	k.mu.Lock()
+	aead, ok := k.cache[info]
+	k.mu.Unlock()
+	if ok {
+		return aead, nil
+	}
+	key, err := hkdf.Key(sha256.New, k.master, nil, "redissession session key\x00"+info, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: derive session key: %v", ErrEncryptionFailed, err)
+	}
+	aead, err = k.newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfiguration, err)
+	}
+	k.mu.Lock()
+	if len(k.cache) >= sessionKeyCacheSize {
+		clear(k.cache)
+	}
+	k.cache[info] = aead
+	k.mu.Unlock()
+	return aead, nil
+}
@@ -0,0 +1,103 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// watchAttempts bounds how often SetIfAbsent and Reseal restart after a
+// concurrent write to the session invalidated their WATCH.
+const watchAttempts = 10
+
+// SetIfAbsent stores val under key in the session called name with the given
+// id unless the session already has a value for key, and reports whether it
+// did. The read-modify-write runs under WATCH/MULTI on the session key, so of
+// several concurrent callers exactly one wins, which makes it suitable for
+// single-use tokens and other once-only operations tied to a session. The
+// session keeps its remaining Redis TTL. A session in the caller's hands
+// does not see the change until it is loaded again, and saving such a stale
+// copy overwrites it.
+func (s *RedisStore) SetIfAbsent(ctx context.Context, name, sessionID, key string, val interface{}) (bool, error) {
+	if !s.crypto.ValidSessionID(sessionID) {
+		return false, ErrSessionNotFound
+	}
+	rkey := s.redisKey(name, sessionID)
+	client := s.clientFor(name, sessionID)
+
+	var set bool
+	txf := func(tx *redis.Tx) error {
+		set = false
+		encrypted, err := tx.Get(ctx, rkey).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return ErrSessionNotFound
+			}
+			return err
+		}
+		var session Session
+		if err := s.unseal(encrypted, &session, name, sessionID); err != nil {
+			return err
+		}
+		if s.payloadExpired(&session, time.Now()) {
+			return ErrSessionExpired
+		}
+		if _, exists := session.values[key]; exists {
+			return nil
+		}
+		if err := session.applyValueLimit(s.maxValues, s.valuePolicy); err != nil {
+			return err
+		}
+		session.Set(key, val)
+		if session.overValueLimit() {
+			return ErrTooManyValues
+		}
+		ttl, err := tx.PTTL(ctx, rkey).Result()
+		if err != nil {
+			return err
+		}
+		ttl, ok := keptTTL(ttl)
+		if !ok {
+			return ErrSessionNotFound
+		}
+		updated, _, err := s.seal(&session, name, sessionID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, rkey, updated, ttl)
+			return nil
+		})
+		if err == nil {
+			set = true
+		}
+		return err
+	}
+
+	for attempt := 0; attempt < watchAttempts; attempt++ {
+		err := client.Watch(ctx, txf, rkey)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return false, redisError(ctx, err)
+		}
+		return set, nil
+	}
+	return false, redis.TxFailedErr
+}
+
+// keptTTL turns a PTTL reply into the ttl to rewrite a key with so it keeps
+// its remaining lifetime: zero for a key without expiry. ok is false if the
+// key no longer exists.
+func keptTTL(pttl time.Duration) (ttl time.Duration, ok bool) {
+	switch {
+	case pttl == -2:
+		return 0, false
+	case pttl < 0:
+		return 0, true
+	}
+	return pttl, true
+}
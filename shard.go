@@ -0,0 +1,45 @@
+package redissession
+
+import (
+	"slices"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// WithShards routes session operations to one of several named Redis
+// backends. fn is consulted by load, Save, RotateID and Destroy; when a
+// session is loaded only its Name and ID are known, so fn must derive the
+// shard from those alone and always resolve a session to the same backend.
+// An empty or unknown shard name falls back to the store's main client.
+func (s *RedisStore) WithShards(backends map[string]*redis.Client, fn func(session *Session) string) *RedisStore {
+	s.shards = backends
+	s.shardFunc = fn
+	return s
+}
+
+func (s *RedisStore) clientFor(name, sessionID string) *redis.Client {
+	if s.shardFunc == nil {
+		return s.client
+	}
+	if c, ok := s.shards[s.shardFunc(&Session{name: name, id: sessionID})]; ok {
+		return c
+	}
+	return s.client
+}
+
+// clientsForKey returns the backends that may hold the session stored under
+// key, for index entries that cannot be parsed back into a name and id, as
+// with WithHashedKeys: the one clientFor picks when they can, otherwise every
+// backend.
+func (s *RedisStore) clientsForKey(key string) []*redis.Client {
+	if name, id, ok := s.parseKey(key); ok || s.shardFunc == nil {
+		return []*redis.Client{s.clientFor(name, id)}
+	}
+	clients := []*redis.Client{s.client}
+	for _, c := range s.shards {
+		if !slices.Contains(clients, c) {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
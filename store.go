@@ -3,26 +3,269 @@ package redissession
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// SessionMode controls how a session's expiry evolves after creation.
+type SessionMode int
+
+const (
+	// Fixed expires a session MaxAge after it was created (or last
+	// explicitly refreshed); loading it never changes its lifetime.
+	Fixed SessionMode = iota
+	// Rolling resets the expiry to MaxAge on every successful load. The Redis
+	// TTL is slid atomically with the read (GETEX); the refreshed cookie is
+	// sent on the next Save.
+	Rolling
+)
+
+// TTLPrecision selects how Save converts a session's remaining lifetime into
+// a Redis TTL.
+type TTLPrecision int
+
+const (
+	// SecondPrecision rounds the TTL up to whole seconds (SET ... EX), so a
+	// session with less than a second left still gets a one second TTL
+	// instead of being truncated to zero by servers without PX support.
+	SecondPrecision TTLPrecision = iota
+	// MillisecondPrecision passes the TTL through in milliseconds
+	// (SET ... PX).
+	MillisecondPrecision
+)
+
 type RedisStore struct {
 	client  *redis.Client
 	prefix  string
 	crypto  *Crypto
 	options *CookieOptions
+	mode    SessionMode
+	ttlPrec TTLPrecision
+
+	keyFunc  KeyFunc
+	keyParse KeyParser
+
+	expirySkew time.Duration
+	budget     time.Duration
+
+	retryAttempts int
+	retryDelay    time.Duration
+
+	rotatePolicy RotatePolicy
+	lazyNew      func(session *Session) bool
+
+	dupRecovery bool
+	dupScopes   []CookieScope
+	legacyNames []string
+
+	deployTag  string
+	idInAAD    bool
+	unboundAAD bool
+	binding    BindingFunc
+
+	userID          func(session *Session) (string, bool)
+	maxUserIndex    int
+	userIndexPolicy UserIndexPolicy
+
+	handoffTTL time.Duration
+
+	readFallback   bool
+	fallbackPrefix string
+
+	onLoad     func(ctx context.Context, session *Session) error
+	beforeSave func(session *Session) error
+	sizeReport func(session *Session, stats PayloadStats)
+
+	revocation   bool
+	minCreatedAt func() time.Time
+	contextID    func(ctx context.Context, name string) (string, bool)
+	bearer       func(token string) (string, error)
+
+	maxValues   int
+	valuePolicy ValueLimitPolicy
+
+	cookieBehavior CookieBehavior
+
+	replica     *redis.Client
+	ownedClient *redis.Client
+	sessionKeys *sessionKeys
+
+	shards    map[string]*redis.Client
+	shardFunc func(session *Session) string
+
+	idlePurge   time.Duration
+	sweepReport func(SweepStats, error)
+	sweepMu     sync.Mutex
+
+	asyncWorkers   int
+	asyncQueueSize int
+	asyncError     func(session *Session, err error)
+	asyncOnce      sync.Once
+	asyncQueue     chan asyncSave
+	asyncMu        sync.Mutex
+	asyncPending   int
+	asyncIdle      chan struct{}
+
+	closeMu     sync.RWMutex
+	closed      bool
+	closeClient bool
+	sweepers    []func()
+
+	companionName   string
+	companionClaims func(*Session) map[string]interface{}
+	expiresInHeader bool
+	cookieClaims    func(*Session) map[string]string
 }
 
-func NewRedisStore(client *redis.Client, keyPrefix string, crypto *Crypto, options *CookieOptions) *RedisStore {
-	return &RedisStore{
+// DefaultKeyPrefix is the Redis key prefix used by NewStore unless
+// WithKeyPrefix sets another.
+const DefaultKeyPrefix = "session:"
+
+// Option configures a RedisStore built by NewStore. Any of the store's
+// chainable With* methods can be used as one too:
+//
+//	NewStore(client, crypto,
+//		WithKeyPrefix("app:"),
+//		func(s *RedisStore) { s.WithMode(Rolling) },
+//	)
+type Option func(s *RedisStore)
+
+// WithKeyPrefix sets the prefix of every Redis key the store uses.
+func WithKeyPrefix(prefix string) Option {
+	return func(s *RedisStore) { s.prefix = prefix }
+}
+
+// WithCookieOptions sets the options for the cookies the store issues.
+func WithCookieOptions(options *CookieOptions) Option {
+	return func(s *RedisStore) { s.options = options }
+}
+
+// NewStore creates a RedisStore using keys under DefaultKeyPrefix and
+// DefaultCookieOptions, then applies opts in order.
+func NewStore(client *redis.Client, crypto *Crypto, opts ...Option) *RedisStore {
+	s := &RedisStore{
 		client:  client,
-		prefix:  keyPrefix,
+		prefix:  DefaultKeyPrefix,
 		crypto:  crypto,
-		options: options,
+		options: DefaultCookieOptions(),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
+}
+
+// NewRedisStore is NewStore with the key prefix and cookie options given
+// positionally.
+func NewRedisStore(client *redis.Client, keyPrefix string, crypto *Crypto, options *CookieOptions) *RedisStore {
+	return NewStore(client, crypto, WithKeyPrefix(keyPrefix), WithCookieOptions(options))
+}
+
+// NewRedisStoreWithReplica is NewRedisStore with reads served by replica;
+// see WithReadReplica.
+func NewRedisStoreWithReplica(primary, replica *redis.Client, keyPrefix string, crypto *Crypto, options *CookieOptions) *RedisStore {
+	return NewRedisStore(primary, keyPrefix, crypto, options).WithReadReplica(replica)
+}
+
+// NewRedisStoreChecked is like NewRedisStore but fails fast: it round-trips a
+// dummy session through crypto and pings Redis before returning the store.
+func NewRedisStoreChecked(ctx context.Context, client *redis.Client, keyPrefix string, crypto *Crypto, options *CookieOptions) (*RedisStore, error) {
+	if client == nil || crypto == nil || crypto.aead == nil || options == nil {
+		return nil, ErrInvalidConfiguration
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if err := crypto.selfTest(); err != nil {
+		return nil, fmt.Errorf("%w: crypto self-test: %w", ErrInvalidConfiguration, err)
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		return nil, fmt.Errorf("redis ping: %w", redisError(ctx, err))
+	}
+	return NewRedisStore(client, keyPrefix, crypto, options), nil
+}
+
+// WithMode sets how loading a session affects its lifetime. In Fixed mode,
+// the default, a load is a plain GET and leaves the Redis TTL alone, so the
+// session expires MaxAge after it was created or last refreshed. In Rolling
+// mode every load is a GETEX that slides the TTL back to MaxAge, keeping
+// active sessions alive; the cookie's own expiry catches up on the next Save.
+func (s *RedisStore) WithMode(mode SessionMode) *RedisStore {
+	s.mode = mode
+	return s
+}
+
+// WithOnLoad registers fn to run after a stored session has been decrypted.
+// Returning an error makes the session count as invalid, so New hands out a
+// fresh one instead. fn runs on the request path on every load and must be
+// fast.
+func (s *RedisStore) WithOnLoad(fn func(ctx context.Context, session *Session) error) *RedisStore {
+	s.onLoad = fn
+	return s
+}
+
+// WithBeforeSave registers fn to run at the start of every Save, before the
+// session is validated or serialized, so it can scrub transient values. It
+// runs ahead of any dirty check, and changes it makes are included in the
+// write. Returning ErrSkipSave silently skips both the Redis write and the
+// cookie; any other error aborts Save with that error.
+func (s *RedisStore) WithBeforeSave(fn func(session *Session) error) *RedisStore {
+	s.beforeSave = fn
+	return s
+}
+
+// WithExpirySkew tolerates sessions that Redis still holds but whose stored
+// expiry is up to d in the past by the local clock, avoiding spurious logouts
+// when app and Redis clocks disagree. Zero keeps the strict check.
+func (s *RedisStore) WithExpirySkew(d time.Duration) *RedisStore {
+	s.expirySkew = d
+	return s
+}
+
+// WithLazyNewSessions makes Save and SaveAsync skip new sessions that hold
+// no values or labels: nothing is written to Redis and no cookie is sent
+// until the first value is set. Visitors that never get a value, such as
+// bots and health checks, then cost no Redis write at all, at the price of a
+// fresh id, and CreatedAt, on every request until one sticks.
+func (s *RedisStore) WithLazyNewSessions(enabled bool) *RedisStore {
+	if !enabled {
+		return s.WithLazyNewSessionsFunc(nil)
+	}
+	return s.WithLazyNewSessionsFunc((*Session).isEmpty)
+}
+
+// WithLazyNewSessionsFunc is WithLazyNewSessions for apps that seed every
+// session with defaults (a theme, a consent flag) before the handler runs, so
+// new sessions are never empty: a new session is skipped while anonymous
+// reports true, typically while it holds nothing but the defaults, and is
+// first written by the Save after a real change. anonymous runs on every
+// Save of a new session and must not modify it. A nil anonymous turns this
+// off.
+func (s *RedisStore) WithLazyNewSessionsFunc(anonymous func(session *Session) bool) *RedisStore {
+	s.lazyNew = anonymous
+	return s
+}
+
+// WithSizeReporter registers fn to receive the payload size breakdown after
+// every successful save, for capacity planning.
+func (s *RedisStore) WithSizeReporter(fn func(session *Session, stats PayloadStats)) *RedisStore {
+	s.sizeReport = fn
+	return s
+}
+
+// WithTTLPrecision sets the unit Redis TTLs are written in. The default,
+// SecondPrecision, rounds each TTL up to the next whole second, never down,
+// so a key outlives its session's expiry by less than a second rather than
+// vanishing early; MillisecondPrecision rounds up to the millisecond instead.
+// Either way a TTL below one unit is raised to one.
+func (s *RedisStore) WithTTLPrecision(p TTLPrecision) *RedisStore {
+	s.ttlPrec = p
+	return s
 }
 
 func (s *RedisStore) Get(r *http.Request, name string) (*Session, error) {
@@ -30,48 +273,465 @@ func (s *RedisStore) Get(r *http.Request, name string) (*Session, error) {
 }
 
 func (s *RedisStore) New(r *http.Request, name string) (*Session, error) {
-	var session *Session
-	cookie, err := r.Cookie(name)
-	if err == nil {
-		loaded, err := s.load(r.Context(), name, cookie.Value)
-		if err == nil {
-			session = loaded
-			session.setIsNew(false)
+	if err := validateCookieName(name); err != nil {
+		return nil, err
+	}
+	res, err := s.openRequest(r, name)
+	return res.session, err
+}
+
+// NewWithResult behaves like New but also reports why a session referenced
+// by the request could not be used: ErrSessionNotFound, ErrSessionExpired,
+// ErrSignatureInvalid (likely tampering), ErrKeyMismatch (a key rotated
+// inconsistently), ErrEncryptionFailed, ErrInvalidSessionData, or an error
+// returned by Redis or the OnLoad hook. In that case the returned session is
+// a fresh one and the error is informational. The error is nil when the
+// request carried no session or it loaded fine.
+func (s *RedisStore) NewWithResult(r *http.Request, name string) (*Session, error) {
+	if err := validateCookieName(name); err != nil {
+		return nil, err
+	}
+	res, err := s.openRequest(r, name)
+	if err != nil {
+		return nil, err
+	}
+	return res.session, res.loadErr
+}
+
+// NewWithValues mints a brand-new session called name seeded with a copy of
+// values, e.g. right after login. It does not look at any existing cookie.
+func (s *RedisStore) NewWithValues(name string, values map[string]interface{}) (*Session, error) {
+	if err := validateCookieName(name); err != nil {
+		return nil, err
+	}
+	id, err := s.crypto.GenerateSessionID()
+	if err != nil {
+		return nil, err
+	}
+	session := NewSessionWithValues(id, time.Duration(s.options.MaxAge)*time.Second, values)
+	session.setName(name)
+	session.applyValueLimit(s.maxValues, s.valuePolicy)
+	return session, nil
+}
+
+// LoadByID loads the session called name with the given id, for flows where
+// the id arrives out of band. It never touches cookies and returns
+// ErrSessionNotFound or ErrSessionExpired instead of a fresh session.
+func (s *RedisStore) LoadByID(ctx context.Context, name, sessionID string) (*Session, error) {
+	if !s.crypto.ValidSessionID(sessionID) {
+		return nil, ErrSessionNotFound
+	}
+	session, err := s.load(ctx, name, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	session.setIsNew(false)
+	session.setName(name)
+	return session, nil
+}
+
+// Peek loads the session called name with the given id strictly read-only,
+// for admin views and monitoring. Unlike LoadByID it never slides the TTL in
+// Rolling mode, never deletes an expired session and does not run the
+// OnLoad hook, so looking at a session cannot keep it alive or otherwise
+// change it. In Rolling mode the returned expiry is taken from the remaining
+// Redis TTL. Saving a peeked session is possible but defeats the purpose.
+func (s *RedisStore) Peek(ctx context.Context, name, sessionID string) (*Session, error) {
+	if !s.crypto.ValidSessionID(sessionID) {
+		return nil, ErrSessionNotFound
+	}
+	key := s.redisKey(name, sessionID)
+	if s.revocation {
+		revoked, err := s.isRevoked(ctx, key)
+		if err != nil {
+			return nil, redisError(ctx, err)
+		}
+		if revoked {
+			return nil, ErrSessionRevoked
+		}
+	}
+	var get *redis.StringCmd
+	var pttl *redis.DurationCmd
+search:
+	for _, client := range s.readClients(name, sessionID) {
+		for _, key := range s.readKeys(name, sessionID) {
+			pipe := client.Pipeline()
+			get = pipe.Get(ctx, key)
+			pttl = pipe.PTTL(ctx, key)
+			if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+				return nil, redisError(ctx, err)
+			}
+			if !errors.Is(get.Err(), redis.Nil) {
+				break search
+			}
+		}
+	}
+	encrypted, err := get.Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, redisError(ctx, err)
+	}
+	var session Session
+	if err := s.unseal(encrypted, &session, name, sessionID); err != nil {
+		return nil, err
+	}
+	if session.Name() != name {
+		return nil, ErrInvalidSessionData
+	}
+	if s.issuedTooEarly(session.CreatedAt()) {
+		return nil, ErrSessionRevoked
+	}
+	if s.mode == Rolling {
+		if ttl, ok := keptTTL(pttl.Val()); ok && ttl > 0 {
+			session.setExpiresAt(time.Now().Add(ttl))
+		}
+	} else if time.Now().After(session.ExpiresAt().Add(s.expirySkew)) {
+		return nil, ErrSessionExpired
+	}
+	session.setIsNew(false)
+	return &session, nil
+}
+
+// payloadExpired reports whether the expiry sealed into session has passed.
+// Rolling loads slide the Redis TTL without rewriting the payload, so in
+// that mode the TTL alone decides and payloadExpired never reports true.
+func (s *RedisStore) payloadExpired(session *Session, now time.Time) bool {
+	return s.mode != Rolling && now.After(session.ExpiresAt().Add(s.expirySkew))
+}
+
+// Exists reports whether a session called name with the given id is stored,
+// using EXISTS without fetching or decrypting it. A stored session may still
+// fail to load, e.g. if it was sealed under a key or deploy tag the store no
+// longer accepts, or its payload expiry has passed ahead of the Redis TTL.
+func (s *RedisStore) Exists(ctx context.Context, name, sessionID string) (bool, error) {
+	if !s.crypto.ValidSessionID(sessionID) {
+		return false, nil
+	}
+	for _, client := range s.readClients(name, sessionID) {
+		n, err := client.Exists(ctx, s.readKeys(name, sessionID)...).Result()
+		if err != nil {
+			return false, redisError(ctx, err)
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Reseal re-encrypts the stored session called name with the given id under
+// the store's current key and AAD, keeping its id, contents and remaining
+// Redis TTL. Unlike a load and Save it does not touch timestamps or run the
+// load and save hooks. The rewrite runs under WATCH/MULTI on the session key,
+// as in SetIfAbsent, so a save landing in between is never overwritten with
+// the older contents. It returns ErrSessionNotFound if the session is absent.
+func (s *RedisStore) Reseal(ctx context.Context, name, sessionID string) error {
+	if !s.crypto.ValidSessionID(sessionID) {
+		return ErrSessionNotFound
+	}
+	key := s.redisKey(name, sessionID)
+	client := s.clientFor(name, sessionID)
+
+	txf := func(tx *redis.Tx) error {
+		encrypted, err := tx.Get(ctx, key).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				return ErrSessionNotFound
+			}
+			return err
+		}
+		var session Session
+		if err := s.unseal(encrypted, &session, name, sessionID); err != nil {
+			return err
+		}
+		ttl, err := tx.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		ttl, ok := keptTTL(ttl)
+		if !ok {
+			return ErrSessionNotFound
+		}
+		resealed, _, err := s.seal(&session, name, sessionID)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, resealed, ttl)
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < watchAttempts; attempt++ {
+		err := s.retry(ctx, func() error {
+			return client.Watch(ctx, txf, key)
+		})
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return redisError(ctx, err)
+		}
+		return nil
+	}
+	return redis.TxFailedErr
+}
+
+func cookieValue(r *http.Request, name string) string {
+	if cookie, err := r.Cookie(name); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+// openRequest is open for the session cookie(s) or bearer token carried by r,
+// checking a loaded session's binding to the request.
+func (s *RedisStore) openRequest(r *http.Request, name string) (openResult, error) {
+	token, bearer := s.bearerToken(r)
+	if !bearer {
+		r = s.withCookieClaims(r, name)
+	}
+	if !bearer && len(s.legacyNames) > 0 && cookieValue(r, name) == "" {
+		if session := s.openLegacy(r, name); session != nil {
+			if bindErr := s.checkBinding(r, session); bindErr == nil {
+				session.SetContext(r.Context())
+				return openResult{session: session}, nil
+			}
+		}
+	}
+	var res openResult
+	var err error
+	if bearer {
+		res, err = s.openBearer(r.Context(), name, token)
+	} else {
+		res, err = s.openCookies(r, name)
+	}
+	if err == nil && !res.session.IsNew() {
+		if bindErr := s.checkBinding(r, res.session); bindErr != nil {
+			res, err = s.fresh(r.Context(), name, bindErr)
 		}
 	}
-	if session == nil {
+	if err != nil {
+		return res, err
+	}
+	session := res.session
+	if id, err := s.cookieSessionID(name, cookieValue(r, name)); err == nil && !session.IsNew() && id == session.ID() {
+		session.mu.Lock()
+		session.cookieID = session.id
+		session.mu.Unlock()
+	}
+	session.SetContext(r.Context())
+	return res, nil
+}
+
+// openResult is the outcome of open and its request-level wrappers: the
+// session, a fresh one if the referenced session could not be used, and
+// loadErr telling why it could not.
+type openResult struct {
+	session *Session
+	loadErr error
+}
+
+// open loads the session stored under sessionID, or returns a fresh one if
+// sessionID is empty or cannot be loaded; loadErr then tells why. The error
+// is set only when no session could be produced at all.
+func (s *RedisStore) open(ctx context.Context, name, sessionID string) (openResult, error) {
+	var res openResult
+	if sessionID != "" {
+		if !s.crypto.ValidSessionID(sessionID) {
+			res.loadErr = ErrInvalidSessionData
+		} else if res.session, res.loadErr = s.load(ctx, name, sessionID); res.loadErr == nil {
+			res.session.setIsNew(false)
+		} else if ctx.Err() != nil {
+			return openResult{loadErr: res.loadErr}, res.loadErr
+		}
+	}
+	if res.session == nil {
 		id, err := s.crypto.GenerateSessionID()
 		if err != nil {
-			return nil, err
+			return openResult{loadErr: res.loadErr}, err
 		}
-		session = NewSession(id, time.Duration(s.options.MaxAge)*time.Second)
-		session.setIsNew(true)
+		res.session = NewSession(id, time.Duration(s.options.MaxAge)*time.Second)
+		res.session.setIsNew(true)
+		res.session.applyValueLimit(s.maxValues, s.valuePolicy)
 	}
-	session.setName(name)
-	return session, nil
+	res.session.setName(name)
+	return res, nil
 }
 
+// fresh is open for a new session, reporting loadErr as the reason the one
+// the request referenced was not used.
+func (s *RedisStore) fresh(ctx context.Context, name string, loadErr error) (openResult, error) {
+	res, err := s.open(ctx, name, "")
+	res.loadErr = loadErr
+	return res, err
+}
+
+// Save writes session to Redis and then sets its cookie on w, so a failed
+// write never hands the client a cookie for a missing key. A nil w skips the
+// cookie and only persists the session, for code paths such as background
+// revalidation where the response already carries the cookie or has been
+// flushed; unlike SaveCtx it still applies the request's binding.
 func (s *RedisStore) Save(r *http.Request, w http.ResponseWriter, session *Session) error {
-	key := s.redisKey(session.Name(), session.ID())
-	ttl := time.Until(session.ExpiresAt())
+	if headersWritten(w) {
+		return ErrHeadersAlreadySent
+	}
+	if err := validateCookieName(session.Name()); err != nil {
+		return err
+	}
+	s.bind(r, session)
+	send := w != nil && s.cookieDue(session)
+	var prev cookieState
+	if send {
+		prev = session.markCookieSent()
+	}
+	if err := s.persist(r.Context(), session); err != nil {
+		if send {
+			session.restoreCookie(prev)
+		}
+		if errors.Is(err, ErrSkipSave) {
+			return nil
+		}
+		return err
+	}
+	if w == nil {
+		return nil
+	}
 
-	if ttl <= 0 {
-		return ErrSessionExpired
+	if err := s.setCookies(w, session, send); err != nil {
+		return err
 	}
-	encrypted, err := s.crypto.EncryptAndSign(session, []byte(session.Name()))
+	return s.retireLegacy(r.Context(), w, session)
+}
+
+// setCookies issues the session cookie and the companion cookie if send is
+// set, and the expiry header if configured, after a successful save.
+func (s *RedisStore) setCookies(w http.ResponseWriter, session *Session, send bool) error {
+	if s.expiresInHeader {
+		w.Header().Set(ExpiresInHeader, strconv.Itoa(session.TTLSeconds()))
+	}
+	if !send {
+		return nil
+	}
+	cookie, err := s.sessionCookie(session)
 	if err != nil {
 		return err
 	}
-	if err := s.client.Set(r.Context(), key, encrypted, ttl).Err(); err != nil {
+	s.removeDuplicateCookies(w, session)
+	http.SetCookie(w, cookie)
+	return s.setCompanionCookie(w, session)
+}
+
+// SaveCtx writes session to Redis without touching any cookie, for callers
+// outside net/http such as gRPC services.
+func (s *RedisStore) SaveCtx(ctx context.Context, session *Session) error {
+	if err := s.persist(ctx, session); err != nil && !errors.Is(err, ErrSkipSave) {
 		return err
 	}
+	return nil
+}
 
-	cookie := s.options.NewCookie(session)
-	http.SetCookie(w, cookie)
+func (s *RedisStore) persist(ctx context.Context, session *Session) error {
+	key, ttl, err := s.prepareSave(session)
+	if err != nil {
+		return err
+	}
+	if unchangedEmpty(session) {
+		return nil
+	}
+	current, removed := session.labelChanges()
+	// The count is bumped before sealing so the stored copy includes this
+	// save, and restored if the write fails.
+	count := session.SaveCount()
+	session.setSaveCount(count + 1)
+	if err := s.write(ctx, session, session.Name(), session.ID(), key, ttl, session, current, removed); err != nil {
+		session.setSaveCount(count)
+		return err
+	}
+	session.clearRemovedLabels()
+	session.markClean()
+	return nil
+}
+
+// prepareSave runs the BeforeSave hook and the checks that must pass before
+// session may be written, returning its key and Redis TTL.
+func (s *RedisStore) prepareSave(session *Session) (string, time.Duration, error) {
+	if s.beforeSave != nil {
+		if err := s.beforeSave(session); err != nil {
+			return "", 0, err
+		}
+	}
+	if s.lazyNew != nil && session.IsNew() && s.lazyNew(session) {
+		return "", 0, ErrSkipSave
+	}
+	key := s.redisKey(session.Name(), session.ID())
+	now := time.Now()
+	// Only an expiry strictly in the past is rejected; a session expiring at
+	// this very instant is still written, with the minimum Redis TTL.
+	if session.ExpiresAt().Before(now) {
+		return "", 0, ErrSessionExpired
+	}
+	ttl := session.ExpiresAt().Sub(now)
+	if session.overValueLimit() {
+		return "", 0, ErrTooManyValues
+	}
+	return key, s.redisTTL(ttl), nil
+}
+
+// unchangedEmpty reports whether session was loaded without values or labels
+// and not modified since, in which case the stored copy is already current
+// and the write can be skipped. This is the common case for anonymous
+// traffic.
+func unchangedEmpty(session *Session) bool {
+	return !session.IsNew() && !session.IsDirty() && session.isEmpty()
+}
+
+// write seals payload (the session itself or a serialized snapshot of it)
+// and stores it under key, then updates the label index. name and sessionID
+// are those key was built from, passed in rather than read from session so
+// a queued SaveAsync write stays tied to the id it was prepared for.
+func (s *RedisStore) write(ctx context.Context, session *Session, name, sessionID, key string, ttl time.Duration, payload interface{}, labels, removedLabels []string) error {
+	encrypted, stats, err := s.seal(payload, name, sessionID)
+	if err != nil {
+		return err
+	}
+	client := s.clientFor(name, sessionID)
+	err = s.retry(ctx, func() error {
+		return client.Set(ctx, key, encrypted, ttl).Err()
+	})
+	if err != nil {
+		return redisError(ctx, err)
+	}
+	if err := s.indexLabels(ctx, key, labels, removedLabels); err != nil {
+		return err
+	}
+	if err := s.indexUser(ctx, session, key); err != nil {
+		return err
+	}
+	if s.sizeReport != nil {
+		s.sizeReport(session, stats)
+	}
 	return nil
 }
 
+// RotateID moves session to a fresh id, e.g. after login. The steps are
+// ordered so that no failure leaves the client pointing at a deleted key:
+// the new key is written first, and if that fails the session keeps its old
+// id and no cookie is sent (values dropped by the rotate policy stay
+// dropped). Only once the new key is confirmed is the cookie set and the old
+// key deleted. If the delete fails, the error is returned but the rotation
+// stands, with the new cookie already set; the old key then lives until its
+// TTL runs out. A response that never reaches the client still strands it on
+// the deleted old key, which no server-side ordering can prevent. The cookie
+// goes out as on Save, with any companion cookie and expires-in header, and
+// with revocation enabled the old id is revoked once its key is deleted.
 func (s *RedisStore) RotateID(r *http.Request, w http.ResponseWriter, session *Session) error {
+	if headersWritten(w) {
+		return ErrHeadersAlreadySent
+	}
 	ctx := r.Context()
 
 	oldID := session.ID()
@@ -81,76 +741,271 @@ func (s *RedisStore) RotateID(r *http.Request, w http.ResponseWriter, session *S
 	if err != nil {
 		return err
 	}
+	s.rotatePolicy.apply(session)
 	session.setID(newID)
 	newKey := s.redisKey(session.Name(), newID)
-
-	ttl := time.Until(session.ExpiresAt())
-	if ttl <= 0 {
-		ttl = time.Second
+	send := s.cookieBehavior != CookieNever
+	var prev cookieState
+	if send {
+		prev = session.markCookieSent()
 	}
 
-	encrypted, err := s.crypto.EncryptAndSign(session, []byte(session.Name()))
+	ttl := s.redisTTL(time.Until(session.ExpiresAt()))
+
+	_, err = s.sessionCookie(session)
+	var encrypted string
+	if err == nil {
+		encrypted, _, err = s.seal(session, session.Name(), newID)
+	}
 	if err != nil {
+		session.setID(oldID)
+		if send {
+			session.restoreCookie(prev)
+		}
 		return err
 	}
 
-	pipe := s.client.TxPipeline()
-	pipe.Set(ctx, newKey, encrypted, ttl)
-	pipe.Del(ctx, oldKey)
-	if _, err := pipe.Exec(ctx); err != nil {
-		return err
+	newClient := s.clientFor(session.Name(), newID)
+	err = s.retry(ctx, func() error {
+		return newClient.Set(ctx, newKey, encrypted, ttl).Err()
+	})
+	if err != nil {
+		// The write may still have landed; a stray new key only lingers
+		// until its TTL, whereas the old one must stay usable.
+		session.setID(oldID)
+		if send {
+			session.restoreCookie(prev)
+		}
+		return redisError(ctx, err)
 	}
+	// The new key is stored, so a cookie error must not stop the old one
+	// from being cleaned up; it is reported once that is done.
+	cookieErr := s.setCookies(w, session, send)
 
-	http.SetCookie(w, s.options.NewCookie(session))
-	return nil
+	oldClient := s.clientFor(session.Name(), oldID)
+	err = s.retry(ctx, func() error {
+		return oldClient.Del(ctx, s.readKeys(session.Name(), oldID)...).Err()
+	})
+	if err != nil {
+		return redisError(ctx, err)
+	}
+	if s.revocation {
+		if err := s.revoke(ctx, oldKey, session.ExpiresAt()); err != nil {
+			return err
+		}
+	}
+	if err := s.unindexLabels(ctx, session, oldKey); err != nil {
+		return err
+	}
+	current, removed := session.labelChanges()
+	if err := s.indexLabels(ctx, newKey, current, removed); err != nil {
+		return err
+	}
+	session.clearRemovedLabels()
+	if err := s.unindexUser(ctx, session, oldKey); err != nil {
+		return err
+	}
+	if err := s.indexUser(ctx, session, newKey); err != nil {
+		return err
+	}
+	return cookieErr
 }
 
 func (s *RedisStore) Destroy(r *http.Request, w http.ResponseWriter, session *Session) error {
-	key := s.redisKey(session.Name(), session.ID())
-	if err := s.client.Del(r.Context(), key).Err(); err != nil {
+	if err := s.DestroyCtx(r.Context(), session); err != nil {
 		return err
 	}
 	expiredCookie := s.options.RemoveCookie(session.Name())
 	http.SetCookie(w, expiredCookie)
-	return nil
+	s.removeCompanionCookie(w)
+	return s.retireLegacy(r.Context(), w, session)
+}
+
+// DestroyCtx deletes session from Redis, along with its index entries,
+// without touching any cookie, for callers outside net/http and maintenance
+// jobs such as ScanFilter.
+func (s *RedisStore) DestroyCtx(ctx context.Context, session *Session) error {
+	key := s.redisKey(session.Name(), session.ID())
+	client := s.clientFor(session.Name(), session.ID())
+	if err := client.Del(ctx, s.readKeys(session.Name(), session.ID())...).Err(); err != nil {
+		return redisError(ctx, err)
+	}
+	session.markDestroyed()
+	if s.revocation {
+		if err := s.revoke(ctx, key, session.ExpiresAt()); err != nil {
+			return err
+		}
+	}
+	if err := s.unindexLabels(ctx, session, key); err != nil {
+		return err
+	}
+	return s.unindexUser(ctx, session, key)
 }
 
 func (s *RedisStore) load(ctx context.Context, name, sessionID string) (*Session, error) {
 	key := s.redisKey(name, sessionID)
-	encrypted, err := s.client.Get(ctx, key).Result()
+	if s.revocation {
+		revoked, err := s.isRevoked(ctx, key)
+		if err != nil {
+			return nil, redisError(ctx, err)
+		}
+		if revoked {
+			return nil, ErrSessionRevoked
+		}
+	}
+	client := s.clientFor(name, sessionID)
+	maxAge := time.Duration(s.options.MaxAge) * time.Second
+	var encrypted string
+	var err error
+	// Rolling loads slide the TTL, which is a write.
+	readers := []*redis.Client{client}
+	if s.mode != Rolling {
+		readers = s.readClients(name, sessionID)
+	}
+search:
+	for _, reader := range readers {
+		for _, key = range s.readKeys(name, sessionID) {
+			if s.mode == Rolling {
+				encrypted, err = reader.GetEx(ctx, key, maxAge).Result()
+			} else {
+				encrypted, err = reader.Get(ctx, key).Result()
+			}
+			if !errors.Is(err, redis.Nil) {
+				break search
+			}
+		}
+	}
 	if err != nil {
 		if errors.Is(err, redis.Nil) {
 			return nil, ErrSessionNotFound
 		}
-		return nil, err
+		return nil, redisError(ctx, err)
 	}
 	var session Session
-	if err := s.crypto.DecryptAndVerify(encrypted, &session, []byte(name)); err != nil {
+	if err := s.unseal(encrypted, &session, name, sessionID); err != nil {
 		return nil, err
 	}
+	if session.Name() != name {
+		return nil, ErrInvalidSessionData
+	}
+	if s.issuedTooEarly(session.CreatedAt()) {
+		return nil, ErrSessionRevoked
+	}
 
-	if time.Now().After(session.ExpiresAt()) {
-		s.client.Del(ctx, key)
+	if s.mode == Rolling {
+		session.setExpiresAt(time.Now().Add(maxAge))
+	} else if time.Now().After(session.ExpiresAt().Add(s.expirySkew)) {
+		client.Del(ctx, key)
 		return nil, ErrSessionExpired
 	}
 
+	if err := session.applyValueLimit(s.maxValues, s.valuePolicy); err != nil {
+		return nil, err
+	}
+	if s.onLoad != nil {
+		if err := s.onLoad(ctx, &session); err != nil {
+			return nil, err
+		}
+	}
 	return &session, nil
 }
 
-func (s *RedisStore) redisKey(name string, sessionID string) string {
-	return s.prefix + name + ":" + sessionID
+// WithDeadline returns a context that caps the total time spent on session
+// Redis calls made with it (New, Save, RotateID, ...). Use it, or
+// WithSessionBudget for the middleware, to keep a slow Redis from eating the
+// whole request budget. Timeouts configured on the Redis client itself still
+// apply to each call within it; whichever expires first wins. When the
+// deadline passes, the store returns the context error (errors.Is
+// context.DeadlineExceeded) rather than silently handing out a fresh session.
+func (s *RedisStore) WithDeadline(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, d)
+}
+
+// WithSessionBudget makes Middleware bound its session load and save with
+// WithDeadline(d). When the budget runs out the middleware responds 503.
+func (s *RedisStore) WithSessionBudget(d time.Duration) *RedisStore {
+	s.budget = d
+	return s
+}
+
+// redisError converts an error from a Redis call: ctx's own error wins if it
+// is done, and connection-level failures are wrapped in ErrStoreUnavailable
+// so callers can tell an unreachable Redis from a missing session.
+func redisError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil && unavailableError(err) {
+		return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+	return err
+}
+
+// redisTTL rounds ttl up to the configured precision. A ttl below one unit,
+// including zero for a session expiring right now, becomes one unit so the
+// key is never written without a lifetime.
+func (s *RedisStore) redisTTL(ttl time.Duration) time.Duration {
+	unit := time.Second
+	if s.ttlPrec == MillisecondPrecision {
+		unit = time.Millisecond
+	}
+	if ttl < unit {
+		return unit
+	}
+	if rem := ttl % unit; rem != 0 {
+		ttl += unit - rem
+	}
+	return ttl
+}
+
+// Store is implemented by RedisStore and CookieStore.
+type Store interface {
+	Get(r *http.Request, name string) (*Session, error)
+	New(r *http.Request, name string) (*Session, error)
+	Save(r *http.Request, w http.ResponseWriter, session *Session) error
+	RotateID(r *http.Request, w http.ResponseWriter, session *Session) error
+	Destroy(r *http.Request, w http.ResponseWriter, session *Session) error
 }
 
+var (
+	_ Store = (*RedisStore)(nil)
+	_ Store = (*CookieStore)(nil)
+)
+
 type storeContextKey struct{}
 
 func WithStore(r *http.Request, store *RedisStore) *http.Request {
-	ctx := context.WithValue(r.Context(), storeContextKey{}, store)
-	return r.WithContext(ctx)
+	return WithSessionStore(r, store)
 }
 
 func GetStore(r *http.Request) (*RedisStore, error) {
-	if store, ok := r.Context().Value(storeContextKey{}).(*RedisStore); ok {
+	return StoreFromContext(r.Context())
+}
+
+// WithSessionStore attaches any Store to the request so Session.Save,
+// RotateID and Destroy can find it.
+func WithSessionStore(r *http.Request, store Store) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), storeContextKey{}, store))
+}
+
+func GetSessionStore(r *http.Request) (Store, error) {
+	if store, ok := r.Context().Value(storeContextKey{}).(Store); ok {
 		return store, nil
 	}
 	return nil, ErrStoreNotFound
 }
+
+func ContextWithStore(ctx context.Context, store *RedisStore) context.Context {
+	return context.WithValue(ctx, storeContextKey{}, Store(store))
+}
+
+func StoreFromContext(ctx context.Context) (*RedisStore, error) {
+	if store, ok := ctx.Value(storeContextKey{}).(*RedisStore); ok {
+		return store, nil
+	}
+	return nil, ErrStoreNotFound
+}
+
+func (s *RedisStore) PoolStats() *redis.PoolStats {
+	return s.client.PoolStats()
+}
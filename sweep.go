@@ -0,0 +1,343 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const scanBatchSize = 100
+
+// DefaultSweepInterval is the interval StartSweeper uses when given one of
+// zero or less.
+const DefaultSweepInterval = 5 * time.Minute
+
+// SweepStats reports what a single sweep cleaned up.
+type SweepStats struct {
+	Scanned           int
+	Expired           int
+	Idle              int
+	RevocationsPruned int
+	LabelsPruned      int
+	Undecryptable     int
+	Duration          time.Duration
+}
+
+// WithIdlePurge makes sweeps also delete sessions that have not been updated
+// for longer than d. Zero disables idle purging.
+func (s *RedisStore) WithIdlePurge(d time.Duration) *RedisStore {
+	s.idlePurge = d
+	return s
+}
+
+// WithSweepReporter registers fn to receive the result of every sweep run by
+// StartSweeper.
+func (s *RedisStore) WithSweepReporter(fn func(SweepStats, error)) *RedisStore {
+	s.sweepReport = fn
+	return s
+}
+
+// Sweep walks the store's keys with SCAN, deleting sessions whose payload says
+// they have expired (or gone idle, see WithIdlePurge) and pruning stale label
+// index and revocation entries. In Rolling mode the payload expiry is left
+// alone, since the Redis TTL is what expires those sessions. Keys that
+// cannot be decrypted are counted but left alone. Only one sweep runs at a
+// time; a concurrent call returns ErrSweepInProgress.
+func (s *RedisStore) Sweep(ctx context.Context) (SweepStats, error) {
+	var stats SweepStats
+	if !s.sweepMu.TryLock() {
+		return stats, ErrSweepInProgress
+	}
+	defer s.sweepMu.Unlock()
+
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
+
+	for _, client := range s.allClients() {
+		err := s.scanKeys(ctx, client, func(keys []string) error {
+			return s.sweepBatch(ctx, client, keys, &stats)
+		})
+		if err != nil {
+			return stats, err
+		}
+	}
+	pruned, err := s.pruneLabels(ctx)
+	if err != nil {
+		return stats, err
+	}
+	stats.LabelsPruned = pruned
+	if s.revocation {
+		n, err := s.client.ZRemRangeByScore(ctx, s.revokedKey(), "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10)).Result()
+		if err != nil {
+			return stats, redisError(ctx, err)
+		}
+		stats.RevocationsPruned = int(n)
+	}
+	return stats, nil
+}
+
+// StartSweeper runs Sweep every interval until ctx is cancelled, the
+// returned stop function is called or the store is closed. stop waits for a
+// running sweep to finish. On a closed store it starts nothing. An interval
+// of zero or less selects DefaultSweepInterval.
+func (s *RedisStore) StartSweeper(ctx context.Context, interval time.Duration) (stop func()) {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+	if s.closed {
+		return func() {}
+	}
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				stats, err := s.Sweep(ctx)
+				if errors.Is(err, ErrSweepInProgress) {
+					continue
+				}
+				if s.sweepReport != nil {
+					s.sweepReport(stats, err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	s.sweepers = append(s.sweepers, stop)
+	return stop
+}
+
+// DestroyAll deletes every session under the store prefix, on every shard,
+// and returns how many were removed. Keys are found with SCAN and deleted in
+// pipelined batches, so other data sharing the Redis database is untouched.
+// Every key under the prefix other than the label and user indexes and the
+// revocation list counts as a session, so keys that cannot be parsed back
+// into a name and id, such as those of WithHashedKeys, are deleted too, as
+// are sessions still under a WithReadFallback prefix. The indexes are left
+// for Sweep to prune.
+func (s *RedisStore) DestroyAll(ctx context.Context) (int, error) {
+	deleted := 0
+	for _, client := range s.allClients() {
+		err := s.scanKeys(ctx, client, func(keys []string) error {
+			pipe := client.Pipeline()
+			var cmds []*redis.IntCmd
+			for _, key := range keys {
+				if !s.isScannedIndexKey(key) {
+					cmds = append(cmds, pipe.Del(ctx, key))
+				}
+			}
+			if len(cmds) == 0 {
+				return nil
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+			for _, cmd := range cmds {
+				deleted += int(cmd.Val())
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// ListNames returns the distinct session names stored under the prefix, in
+// sorted order. It is a diagnostic aid built on SCAN and may miss or include
+// names that are being written or removed concurrently.
+func (s *RedisStore) ListNames(ctx context.Context) ([]string, error) {
+	seen := make(map[string]struct{})
+	for _, client := range s.allClients() {
+		err := s.scanKeys(ctx, client, func(keys []string) error {
+			for _, key := range keys {
+				if name, _, ok := s.parseScannedKey(key); ok {
+					seen[name] = struct{}{}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ScanFilter walks every session under the prefix, on every shard, and calls
+// fn with each live one pred accepts, e.g. to destroy every admin session
+// after a policy change:
+//
+//	err := store.ScanFilter(ctx, func(s *redissession.Session) bool {
+//		return s.Get("role") == "admin"
+//	}, func(s *redissession.Session) error {
+//		return store.DestroyCtx(ctx, s)
+//	})
+//
+// It decrypts every session in the store, so it is a maintenance tool for
+// admin jobs, never for the request path. Entries that cannot be decrypted
+// or have expired are skipped, and in Rolling mode each session's expiry is
+// taken from its Redis TTL, as with Peek; an error from fn stops the walk
+// and is returned. Like ListNames it may miss or include sessions written or
+// removed concurrently. Hashed keys (see WithHashedKeys) are skipped.
+func (s *RedisStore) ScanFilter(ctx context.Context, pred func(*Session) bool, fn func(*Session) error) error {
+	now := time.Now()
+	for _, client := range s.allClients() {
+		err := s.scanKeys(ctx, client, func(keys []string) error {
+			for _, key := range keys {
+				name, id, ok := s.parseScannedKey(key)
+				if !ok {
+					continue
+				}
+				pipe := client.Pipeline()
+				get := pipe.Get(ctx, key)
+				pttl := pipe.PTTL(ctx, key)
+				if _, err := pipe.Exec(ctx); err != nil {
+					if errors.Is(err, redis.Nil) {
+						continue
+					}
+					return redisError(ctx, err)
+				}
+				var session Session
+				if err := s.unseal(get.Val(), &session, name, id); err != nil || session.Name() != name {
+					continue
+				}
+				if s.mode == Rolling {
+					if ttl, ok := keptTTL(pttl.Val()); ok && ttl > 0 {
+						session.setExpiresAt(now.Add(ttl))
+					}
+				}
+				if s.payloadExpired(&session, now) || !pred(&session) {
+					continue
+				}
+				if err := fn(&session); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) sweepBatch(ctx context.Context, client *redis.Client, keys []string, stats *SweepStats) error {
+	now := time.Now()
+	var stale []string
+	for _, key := range keys {
+		name, id, ok := s.parseScannedKey(key)
+		if !ok {
+			continue
+		}
+		stats.Scanned++
+		encrypted, err := client.Get(ctx, key).Result()
+		if err != nil {
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			return redisError(ctx, err)
+		}
+		var session Session
+		if err := s.unseal(encrypted, &session, name, id); err != nil {
+			stats.Undecryptable++
+			continue
+		}
+		switch {
+		case s.payloadExpired(&session, now):
+			stats.Expired++
+			stale = append(stale, key)
+		case s.idlePurge > 0 && now.Sub(session.UpdatedAt()) > s.idlePurge:
+			stats.Idle++
+			stale = append(stale, key)
+		}
+	}
+	if len(stale) == 0 {
+		return nil
+	}
+	return redisError(ctx, client.Del(ctx, stale...).Err())
+}
+
+// scanKeys pages through every key under the store prefix, and the fallback
+// prefix if one is set, scanBatchSize at a time, so large keyspaces never
+// block Redis.
+func (s *RedisStore) scanKeys(ctx context.Context, client *redis.Client, fn func(keys []string) error) error {
+	for _, prefix := range s.scanPrefixes() {
+		if err := scanPrefix(ctx, client, prefix, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func scanPrefix(ctx context.Context, client *redis.Client, prefix string, fn func(keys []string) error) error {
+	match := escapeGlob(prefix) + "*"
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, match, scanBatchSize).Result()
+		if err != nil {
+			return redisError(ctx, err)
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *RedisStore) allClients() []*redis.Client {
+	clients := []*redis.Client{s.client}
+	for _, c := range s.shards {
+		if c != s.client {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
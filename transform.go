@@ -0,0 +1,40 @@
+package redissession
+
+import "fmt"
+
+// ValueTransformer rewrites individual session values on their way into and
+// out of the sealed payload, for field-level handling such as encrypting an
+// access token with a separate key or keeping it out of exports. Decode must
+// undo Encode, and both must pass through values they do not handle. Encode
+// sees the value as the handler stored it; Decode sees what the codec
+// produced when reading the payload back (a JSON type with the default
+// codec).
+type ValueTransformer interface {
+	Encode(key string, val interface{}) (interface{}, error)
+	Decode(key string, val interface{}) (interface{}, error)
+}
+
+// WithValueTransformer applies t to every session value when a session is
+// sealed and opened. It costs a copy of the values map and a call per value
+// on every save and every load, on top of whatever t does, so keep t cheap
+// for the keys it passes through. Session.MarshalJSON and Snapshot are not
+// affected, and neither are TypedStore payloads. nil removes it. Sessions
+// stored before it was set are decoded too, so t.Decode must accept values
+// Encode never produced.
+func (c *Crypto) WithValueTransformer(t ValueTransformer) *Crypto {
+	c.transformer = t
+	return c
+}
+
+// transformValues returns a copy of values with fn applied to each one.
+func transformValues(values map[string]interface{}, fn func(key string, val interface{}) (interface{}, error)) (map[string]interface{}, error) {
+	out := make(map[string]interface{}, len(values))
+	for key, val := range values {
+		v, err := fn(key, val)
+		if err != nil {
+			return nil, fmt.Errorf("transform value %q: %w", key, err)
+		}
+		out[key] = v
+	}
+	return out, nil
+}
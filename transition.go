@@ -0,0 +1,184 @@
+package redissession
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Transition replaces session's values with newValues, moves it to a fresh
+// id, resets its expiry to maxAge from now and sends the new cookie, for
+// privilege changes such as completing step-up authentication. newValues is
+// copied; labels and binding carry over. A maxAge of zero or less uses the
+// store's MaxAge. A BeforeSave hook runs as for Save, but any error from it,
+// ErrSkipSave included, aborts the transition.
+//
+// The new key is written and the old one deleted in a single MULTI/EXEC
+// transaction, so Redis never holds both the old and the new state, or
+// neither. With sharding the two ids may live on different clients; in
+// that case the writes are ordered as in RotateID. If the write fails the
+// session is left exactly as it was, with its old id, values and expiry,
+// and no cookie is sent.
+func (s *RedisStore) Transition(r *http.Request, w http.ResponseWriter, session *Session, newValues map[string]interface{}, maxAge time.Duration) error {
+	if headersWritten(w) {
+		return ErrHeadersAlreadySent
+	}
+	ctx := r.Context()
+	if maxAge <= 0 {
+		maxAge = time.Duration(s.options.MaxAge) * time.Second
+	}
+	name := session.Name()
+	oldID := session.ID()
+	oldKey := s.redisKey(name, oldID)
+	// The old entry is indexed under the user the old values belong to.
+	oldUser, indexed := s.sessionUserID(session)
+
+	newID, err := s.crypto.GenerateSessionID()
+	if err != nil {
+		return err
+	}
+	prev := session.swap(newID, newValues, time.Now().Add(maxAge))
+	send := s.cookieBehavior != CookieNever
+	var prevCookie cookieState
+	if send {
+		prevCookie = session.markCookieSent()
+	}
+	count := session.SaveCount()
+	session.setSaveCount(count + 1)
+	undo := func() {
+		session.restore(prev)
+		session.setSaveCount(count)
+		if send {
+			session.restoreCookie(prevCookie)
+		}
+	}
+
+	if s.beforeSave != nil {
+		if err := s.beforeSave(session); err != nil {
+			undo()
+			return err
+		}
+	}
+	if session.overValueLimit() {
+		undo()
+		return ErrTooManyValues
+	}
+	cookie, err := s.sessionCookie(session)
+	if err != nil {
+		undo()
+		return err
+	}
+	newKey := s.redisKey(name, newID)
+	encrypted, stats, err := s.seal(session, name, newID)
+	if err != nil {
+		undo()
+		return err
+	}
+	ttl := s.redisTTL(maxAge)
+	newClient := s.clientFor(name, newID)
+	oldClient := s.clientFor(name, oldID)
+	if newClient == oldClient {
+		err = s.retry(ctx, func() error {
+			_, err := newClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, newKey, encrypted, ttl)
+				pipe.Del(ctx, s.readKeys(name, oldID)...)
+				return nil
+			})
+			return err
+		})
+		if err != nil {
+			undo()
+			return redisError(ctx, err)
+		}
+	} else {
+		err = s.retry(ctx, func() error {
+			return newClient.Set(ctx, newKey, encrypted, ttl).Err()
+		})
+		if err != nil {
+			undo()
+			return redisError(ctx, err)
+		}
+		err = s.retry(ctx, func() error {
+			return oldClient.Del(ctx, s.readKeys(name, oldID)...).Err()
+		})
+		if err != nil {
+			session.markClean()
+			if send {
+				http.SetCookie(w, cookie)
+			}
+			return redisError(ctx, err)
+		}
+	}
+	session.markClean()
+	session.notifyChange()
+	if s.sizeReport != nil {
+		s.sizeReport(session, stats)
+	}
+	if err := s.setCookies(w, session, send); err != nil {
+		return err
+	}
+
+	if err := s.unindexLabels(ctx, session, oldKey); err != nil {
+		return err
+	}
+	current, removed := session.labelChanges()
+	if err := s.indexLabels(ctx, newKey, current, removed); err != nil {
+		return err
+	}
+	session.clearRemovedLabels()
+	if indexed {
+		if err := s.client.SRem(ctx, s.userKey(oldUser), oldKey).Err(); err != nil {
+			return redisError(ctx, err)
+		}
+	}
+	return s.indexUser(ctx, session, newKey)
+}
+
+// sessionState is the part of a session Transition replaces, kept so a
+// failed transition can be undone.
+type sessionState struct {
+	id        string
+	values    map[string]interface{}
+	order     []string
+	updatedAt time.Time
+	expiresAt time.Time
+	dirty     bool
+}
+
+// swap gives the session id, a copy of values and expiresAt, returning the
+// state it replaced.
+func (s *Session) swap(id string, values map[string]interface{}, expiresAt time.Time) sessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev := sessionState{
+		id:        s.id,
+		values:    s.values,
+		order:     s.order,
+		updatedAt: s.updatedAt,
+		expiresAt: s.expiresAt,
+		dirty:     s.dirty,
+	}
+	s.id = id
+	s.values = make(map[string]interface{}, len(values))
+	for k, v := range values {
+		s.values[k] = v
+	}
+	s.order = nil
+	s.reconcileOrder()
+	s.updatedAt = time.Now()
+	s.expiresAt = expiresAt
+	s.dirty = true
+	return prev
+}
+
+func (s *Session) restore(st sessionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.id = st.id
+	s.values = st.values
+	s.order = st.order
+	s.updatedAt = st.updatedAt
+	s.expiresAt = st.expiresAt
+	s.dirty = st.dirty
+}
@@ -0,0 +1,160 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TypedStore persists a single user-defined struct as the whole session body
+// instead of the map[string]interface{} used by Session, avoiding boxing and
+// the float64 round-trip of JSON numbers. It shares the underlying
+// RedisStore's client, crypto, key layout and cookie options; the session id
+// and timestamps travel in a small header next to the struct. Session-level
+// features (hooks, value limits, rolling mode) do not apply to typed sessions.
+type TypedStore[T any] struct {
+	store *RedisStore
+}
+
+func NewTypedStore[T any](store *RedisStore) *TypedStore[T] {
+	return &TypedStore[T]{store: store}
+}
+
+// TypedSession is not safe for concurrent mutation of Data; guard it yourself
+// if handlers share a session across goroutines.
+type TypedSession[T any] struct {
+	Data T
+
+	id        string
+	name      string
+	isNew     bool
+	createdAt time.Time
+	expiresAt time.Time
+}
+
+func (s *TypedSession[T]) ID() string           { return s.id }
+func (s *TypedSession[T]) Name() string         { return s.name }
+func (s *TypedSession[T]) IsNew() bool          { return s.isNew }
+func (s *TypedSession[T]) CreatedAt() time.Time { return s.createdAt }
+func (s *TypedSession[T]) ExpiresAt() time.Time { return s.expiresAt }
+
+func (s *TypedSession[T]) SetExpiresAt(t time.Time) {
+	s.expiresAt = t
+}
+
+type typedHeader struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"n"`
+	CreatedAt time.Time `json:"c"`
+	ExpiresAt time.Time `json:"e"`
+}
+
+type typedPayload[T any] struct {
+	Header typedHeader `json:"h"`
+	Data   T           `json:"d"`
+}
+
+func (t *TypedStore[T]) New(r *http.Request, name string) (*TypedSession[T], error) {
+	if err := validateCookieName(name); err != nil {
+		return nil, err
+	}
+	if id := cookieValue(r, name); t.store.crypto.ValidSessionID(id) {
+		if session, err := t.load(r.Context(), name, id); err == nil {
+			return session, nil
+		}
+	}
+	id, err := t.store.crypto.GenerateSessionID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &TypedSession[T]{
+		id:        id,
+		name:      name,
+		isNew:     true,
+		createdAt: now,
+		expiresAt: now.Add(time.Duration(t.store.options.MaxAge) * time.Second),
+	}, nil
+}
+
+func (t *TypedStore[T]) Save(r *http.Request, w http.ResponseWriter, session *TypedSession[T]) error {
+	if headersWritten(w) {
+		return ErrHeadersAlreadySent
+	}
+	now := time.Now()
+	if session.expiresAt.Before(now) {
+		return ErrSessionExpired
+	}
+	ttl := session.expiresAt.Sub(now)
+	payload := typedPayload[T]{
+		Header: typedHeader{
+			ID:        session.id,
+			Name:      session.name,
+			CreatedAt: session.createdAt,
+			ExpiresAt: session.expiresAt,
+		},
+		Data: session.Data,
+	}
+	encrypted, _, err := t.store.seal(&payload, session.name, session.id)
+	if err != nil {
+		return err
+	}
+	key := t.store.redisKey(session.name, session.id)
+	client := t.store.clientFor(session.name, session.id)
+	if err := client.Set(r.Context(), key, encrypted, t.store.redisTTL(ttl)).Err(); err != nil {
+		return redisError(r.Context(), err)
+	}
+	http.SetCookie(w, t.store.options.newCookie(session.name, session.id, session.expiresAt))
+	return nil
+}
+
+func (t *TypedStore[T]) Destroy(r *http.Request, w http.ResponseWriter, session *TypedSession[T]) error {
+	key := t.store.redisKey(session.name, session.id)
+	client := t.store.clientFor(session.name, session.id)
+	if err := client.Del(r.Context(), key).Err(); err != nil {
+		return redisError(r.Context(), err)
+	}
+	http.SetCookie(w, t.store.options.RemoveCookie(session.name))
+	return nil
+}
+
+func (t *TypedStore[T]) load(ctx context.Context, name, sessionID string) (*TypedSession[T], error) {
+	key := t.store.redisKey(name, sessionID)
+	var encrypted string
+	var err error
+	for _, client := range t.store.readClients(name, sessionID) {
+		if encrypted, err = client.Get(ctx, key).Result(); !errors.Is(err, redis.Nil) {
+			break
+		}
+	}
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, redisError(ctx, err)
+	}
+	var payload typedPayload[T]
+	if err := t.store.unseal(encrypted, &payload, name, sessionID); err != nil {
+		return nil, err
+	}
+	if payload.Header.Name != name || payload.Header.ID != sessionID {
+		return nil, ErrInvalidSessionData
+	}
+	if t.store.issuedTooEarly(payload.Header.CreatedAt) {
+		return nil, ErrSessionRevoked
+	}
+	if time.Now().After(payload.Header.ExpiresAt) {
+		t.store.clientFor(name, sessionID).Del(ctx, key)
+		return nil, ErrSessionExpired
+	}
+	return &TypedSession[T]{
+		Data:      payload.Data,
+		id:        payload.Header.ID,
+		name:      payload.Header.Name,
+		createdAt: payload.Header.CreatedAt,
+		expiresAt: payload.Header.ExpiresAt,
+	}, nil
+}
@@ -0,0 +1,236 @@
+package redissession
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+)
+
+// The user index keeps one set per user (prefix + "user:" + user id) holding
+// the keys of that user's sessions, so "user" cannot be used as a session
+// name while it is enabled. Entries are added on every Save and removed on
+// Destroy; entries left behind by sessions that expired or changed user are
+// dropped when the index is read and by Sweep.
+const userKeyPart = "user:"
+
+// DefaultUserIDKey is the session value WithUserIndex reads the user id from
+// when given an empty key.
+const DefaultUserIDKey = "user_id"
+
+// WithUserIndex indexes sessions by the string stored under userIDKey, so
+// ListUserSessions and DestroyUserSessions can find every session of a user.
+// Sessions without a non-empty string there are not indexed.
+func (s *RedisStore) WithUserIndex(userIDKey string) *RedisStore {
+	if userIDKey == "" {
+		userIDKey = DefaultUserIDKey
+	}
+	return s.WithUserIDFunc(func(session *Session) (string, bool) {
+		id, ok := session.Get(userIDKey).(string)
+		return id, ok && id != ""
+	})
+}
+
+// WithUserIDFunc indexes sessions by the user id fn derives from them, for
+// apps that keep the id in a nested value or derive it from a token. fn
+// returns false for sessions that should not be indexed, such as anonymous
+// ones. It runs on every Save and on every session read back from the index,
+// and must not modify the session. A nil fn disables the index.
+func (s *RedisStore) WithUserIDFunc(fn func(session *Session) (string, bool)) *RedisStore {
+	s.userID = fn
+	return s
+}
+
+func (s *RedisStore) userKey(userID string) string {
+	return s.prefix + userKeyPart + userID
+}
+
+func (s *RedisStore) isUserKey(key string) bool {
+	return s.userID != nil && strings.HasPrefix(key, s.prefix+userKeyPart)
+}
+
+func (s *RedisStore) sessionUserID(session *Session) (string, bool) {
+	if s.userID == nil {
+		return "", false
+	}
+	return s.userID(session)
+}
+
+// UserIndexPolicy decides what happens to the sessions trimmed from a user's
+// index once it grows past the limit set with WithMaxUserIndexSize.
+type UserIndexPolicy int
+
+const (
+	// UnlinkOldestSessions only removes the oldest sessions from the index;
+	// they stay usable until they expire but no longer show up in
+	// ListUserSessions or get removed by DestroyUserSessions.
+	UnlinkOldestSessions UserIndexPolicy = iota
+	// DestroyOldestSessions also deletes them, which turns the limit into a
+	// cap on concurrent sessions per user: signing in on one device too many
+	// logs out the one signed in longest ago.
+	DestroyOldestSessions
+)
+
+// WithMaxUserIndexSize caps each user's index at n sessions. When a Save
+// pushes it over, entries whose session is gone or unreadable are dropped
+// first, then the sessions created longest ago, per policy; the session being
+// saved is always kept. Trimming loads the indexed sessions, so it costs a
+// read per entry, but only on the saves that exceed the limit. Zero disables
+// the limit.
+func (s *RedisStore) WithMaxUserIndexSize(n int, policy UserIndexPolicy) *RedisStore {
+	s.maxUserIndex = n
+	s.userIndexPolicy = policy
+	return s
+}
+
+// indexUser must run after the session itself has been written under key.
+func (s *RedisStore) indexUser(ctx context.Context, session *Session, key string) error {
+	userID, ok := s.sessionUserID(session)
+	if !ok {
+		return nil
+	}
+	setKey := s.userKey(userID)
+	if err := s.client.SAdd(ctx, setKey, key).Err(); err != nil {
+		return redisError(ctx, err)
+	}
+	if s.maxUserIndex <= 0 {
+		return nil
+	}
+	return s.trimUserIndex(ctx, userID, key)
+}
+
+// trimUserIndex brings userID's index back to the configured size, never
+// removing keep.
+func (s *RedisStore) trimUserIndex(ctx context.Context, userID, keep string) error {
+	setKey := s.userKey(userID)
+	n, err := s.client.SCard(ctx, setKey).Result()
+	if err != nil {
+		return redisError(ctx, err)
+	}
+	excess := int(n) - s.maxUserIndex
+	if excess <= 0 {
+		return nil
+	}
+	keys, err := s.client.SMembers(ctx, setKey).Result()
+	if err != nil {
+		return redisError(ctx, err)
+	}
+	var stale []interface{}
+	var live []*Session
+	for _, key := range keys {
+		if key == keep {
+			continue
+		}
+		name, id, ok := s.parseKey(key)
+		if !ok {
+			// A hashed key cannot be loaded to rank it; keep it so
+			// DestroyUserSessions still finds the session.
+			continue
+		}
+		session, err := s.Peek(ctx, name, id)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, ErrStoreUnavailable) {
+				return err
+			}
+			stale = append(stale, key)
+			continue
+		}
+		if id, ok := s.sessionUserID(session); !ok || id != userID {
+			stale = append(stale, key)
+			continue
+		}
+		live = append(live, session)
+	}
+	slices.SortFunc(live, func(a, b *Session) int {
+		return a.CreatedAt().Compare(b.CreatedAt())
+	})
+	victims := live[:min(max(excess-len(stale), 0), len(live))]
+	for _, session := range victims {
+		stale = append(stale, s.redisKey(session.Name(), session.ID()))
+	}
+	if len(stale) > 0 {
+		if err := s.client.SRem(ctx, setKey, stale...).Err(); err != nil {
+			return redisError(ctx, err)
+		}
+	}
+	if s.userIndexPolicy != DestroyOldestSessions {
+		return nil
+	}
+	for _, session := range victims {
+		key := s.redisKey(session.Name(), session.ID())
+		if err := s.clientFor(session.Name(), session.ID()).Del(ctx, s.readKeys(session.Name(), session.ID())...).Err(); err != nil {
+			return redisError(ctx, err)
+		}
+		if s.revocation {
+			if err := s.revoke(ctx, key, session.ExpiresAt()); err != nil {
+				return err
+			}
+		}
+		if err := s.unindexLabels(ctx, session, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) unindexUser(ctx context.Context, session *Session, key string) error {
+	userID, ok := s.sessionUserID(session)
+	if !ok {
+		return nil
+	}
+	return redisError(ctx, s.client.SRem(ctx, s.userKey(userID), key).Err())
+}
+
+// ListUserSessions loads every live session indexed under userID. Entries
+// whose session is gone or now belongs to someone else are removed from the
+// index; ones that cannot be decrypted are skipped. Sessions are read as by
+// Peek, as with ListByLabel.
+func (s *RedisStore) ListUserSessions(ctx context.Context, userID string) ([]*Session, error) {
+	return s.listUserSessions(ctx, userID, nil)
+}
+
+// ListUserSessionsWithErrors is ListUserSessions, but also returns why each
+// entry that could not be loaded was skipped, keyed by its Redis key, so a
+// botched key rotation shows up as ErrSignatureInvalid or
+// ErrEncryptionFailed rather than as missing sessions.
+func (s *RedisStore) ListUserSessionsWithErrors(ctx context.Context, userID string) ([]*Session, map[string]error, error) {
+	failed := make(map[string]error)
+	sessions, err := s.listUserSessions(ctx, userID, failed)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sessions, failed, nil
+}
+
+func (s *RedisStore) listUserSessions(ctx context.Context, userID string, failed map[string]error) ([]*Session, error) {
+	setKey := s.userKey(userID)
+	sessions, err := s.listIndexed(ctx, setKey, failed)
+	if err != nil {
+		return nil, err
+	}
+	live := sessions[:0]
+	var stale []interface{}
+	for _, session := range sessions {
+		if id, ok := s.sessionUserID(session); ok && id == userID {
+			live = append(live, session)
+			continue
+		}
+		stale = append(stale, s.redisKey(session.Name(), session.ID()))
+	}
+	if len(stale) > 0 {
+		if err := s.client.SRem(ctx, setKey, stale...).Err(); err != nil {
+			return nil, redisError(ctx, err)
+		}
+	}
+	return live, nil
+}
+
+// DestroyUserSessions deletes every session indexed under userID, e.g. to
+// log a user out everywhere, and returns how many were removed. Each session
+// is destroyed as by DestroyCtx, as with DestroyByLabel.
+func (s *RedisStore) DestroyUserSessions(ctx context.Context, userID string) (int, error) {
+	return s.destroyIndexed(ctx, s.userKey(userID))
+}